@@ -11,8 +11,11 @@ import (
 )
 
 type ECDSAAlgorithm struct {
-	name string
-	hash crypto.Hash
+	name  string
+	hash  crypto.Hash
+	curve elliptic.Curve
+	// JWK curve name
+	crv string
 }
 
 func (a *ECDSAAlgorithm) Name() string {
@@ -30,7 +33,7 @@ func (a *ECDSAAlgorithm) Sign(privateKey []byte, data []byte) ([]byte, error) {
 	var ok bool
 
 	// Validate type of key
-	if ecdsaKey, ok = parsedKey.(*ecdsa.PrivateKey); !ok {
+	if ecdsaKey, ok = parsedKey.(*ecdsa.PrivateKey); !ok || ecdsaKey.Curve != a.curve {
 		return nil, algo.ErrInvalidKeyType
 	}
 
@@ -56,8 +59,8 @@ func (a *ECDSAAlgorithm) ValidateSignature(publicKey []byte, signature []byte, d
 
 	var pkey *ecdsa.PublicKey
 	var ok bool
-	// Validate type of key
-	if pkey, ok = parsedKey.(*ecdsa.PublicKey); !ok {
+	// Validate type of key, curve must match the algorithm
+	if pkey, ok = parsedKey.(*ecdsa.PublicKey); !ok || pkey.Curve != a.curve {
 		return algo.ErrInvalidKeyType
 	}
 
@@ -78,7 +81,7 @@ func (a *ECDSAAlgorithm) ValidateSignature(publicKey []byte, signature []byte, d
 }
 
 func (a *ECDSAAlgorithm) Generate() (algo.DerKeys, error) {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key, err := ecdsa.GenerateKey(a.curve, rand.Reader)
 	if err != nil {
 		return algo.DerKeys{}, err
 	}
@@ -96,6 +99,26 @@ func (a *ECDSAAlgorithm) Generate() (algo.DerKeys, error) {
 	return algo.DerKeys{Public: pubKeyBytes, Private: keyBytes}, nil
 }
 
+func (a *ECDSAAlgorithm) PublicKeyToJWK(publicKey []byte) (*algo.JWK, error) {
+	jwk, err := algo.PublicKeyToJWK(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := algo.CheckJWKType(jwk, "EC", a.crv); err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+func (a *ECDSAAlgorithm) JWKToPublicKey(jwk *algo.JWK) ([]byte, error) {
+	if err := algo.CheckJWKType(jwk, "EC", a.crv); err != nil {
+		return nil, err
+	}
+	return algo.JWKToPublicKey(jwk)
+}
+
 func init() {
-	algo.RegisterSignAlgorithm(&ECDSAAlgorithm{name: "ES256", hash: crypto.SHA256})
+	algo.RegisterSignAlgorithm(&ECDSAAlgorithm{name: "ES256", hash: crypto.SHA256, curve: elliptic.P256(), crv: "P-256"})
+	algo.RegisterSignAlgorithm(&ECDSAAlgorithm{name: "ES384", hash: crypto.SHA384, curve: elliptic.P384(), crv: "P-384"})
+	algo.RegisterSignAlgorithm(&ECDSAAlgorithm{name: "ES512", hash: crypto.SHA512, curve: elliptic.P521(), crv: "P-521"})
 }
@@ -77,6 +77,24 @@ func (a *EdDSAAlgorithm) Generate() (algo.DerKeys, error) {
 	}, nil
 }
 
+func (a *EdDSAAlgorithm) PublicKeyToJWK(publicKey []byte) (*algo.JWK, error) {
+	jwk, err := algo.PublicKeyToJWK(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := algo.CheckJWKType(jwk, "OKP", "Ed25519"); err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+func (a *EdDSAAlgorithm) JWKToPublicKey(jwk *algo.JWK) ([]byte, error) {
+	if err := algo.CheckJWKType(jwk, "OKP", "Ed25519"); err != nil {
+		return nil, err
+	}
+	return algo.JWKToPublicKey(jwk)
+}
+
 func init() {
 	algo.RegisterSignAlgorithm(&EdDSAAlgorithm{name: "EdDSA"})
 }
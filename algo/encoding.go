@@ -1,6 +1,8 @@
 package algo
 
 import (
+	"crypto"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
@@ -45,3 +47,16 @@ func PublicKeyToPem(pk []byte, out io.Writer) {
 		log.Fatal(err)
 	}
 }
+
+// PublicKeyFromPrivate returns PKIX DER public key of PKCS8 DER private key
+func PublicKeyFromPrivate(privateKey []byte) ([]byte, error) {
+	parsedKey, err := x509.ParsePKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidKeyType
+	}
+	return x509.MarshalPKIXPublicKey(signer.Public())
+}
@@ -6,3 +6,4 @@ var ErrInvalidKeyType = errors.New("invalid key type")
 var ErrKeyMustBePEMEncoded = errors.New("key must be PEM encoded")
 var ErrHashUnavailable = errors.New("hash function not available")
 var ErrInvalidSignature = errors.New("invalid signature")
+var ErrInvalidJWK = errors.New("invalid JWK")
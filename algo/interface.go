@@ -24,6 +24,14 @@ type SignAlgorithm interface {
 	  Sign the data. Private key should be in PKCS8 DER format.
 	*/
 	Sign(privateKey []byte, data []byte) ([]byte, error)
+	/*
+	  Convert PKIX DER public key to JWK.
+	*/
+	PublicKeyToJWK(publicKey []byte) (*JWK, error)
+	/*
+	  Convert JWK to PKIX DER public key. Return error if key type doesn't match the algorithm.
+	*/
+	JWKToPublicKey(jwk *JWK) ([]byte, error)
 }
 
 var signAlgorithms = make(map[string]SignAlgorithm)
@@ -43,3 +51,19 @@ func GetSignAlgorithmNames() []string {
 	}
 	return keys
 }
+
+// AddressAlgorithm is implemented by algorithms which keys can be registered by address derived from public key
+type AddressAlgorithm interface {
+	/*
+	  Decode address string to the form stored instead of public key.
+	*/
+	ParseAddress(address string) ([]byte, error)
+	/*
+	  Return address of PKIX DER public key or stored address.
+	*/
+	Address(key []byte) (string, error)
+	/*
+	  Return true if stored key is address, not public key.
+	*/
+	IsAddress(key []byte) bool
+}
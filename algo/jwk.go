@@ -0,0 +1,163 @@
+package algo
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+// JWK is RFC 7517 JSON Web Key with public key members only
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// PublicKeyToJWK converts RSA, EC with NIST curve or Ed25519 PKIX DER public key to JWK
+func PublicKeyToJWK(publicKey []byte) (*JWK, error) {
+	parsedKey, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	switch key := parsedKey.(type) {
+	case *rsa.PublicKey:
+		return &JWK{Kty: "RSA", N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return &JWK{Kty: "EC", Crv: key.Curve.Params().Name, X: b64(key.X.FillBytes(make([]byte, size))), Y: b64(key.Y.FillBytes(make([]byte, size)))}, nil
+	case ed25519.PublicKey:
+		return &JWK{Kty: "OKP", Crv: "Ed25519", X: b64(key)}, nil
+	default:
+		return nil, ErrInvalidKeyType
+	}
+}
+
+// CheckJWKType returns ErrInvalidKeyType if key type or curve doesn't match
+func CheckJWKType(jwk *JWK, kty string, crv string) error {
+	if jwk.Kty != kty || jwk.Crv != crv {
+		return ErrInvalidKeyType
+	}
+	return nil
+}
+
+func decodeB64(s string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, ErrInvalidJWK
+	}
+	return data, nil
+}
+
+// ECPublicKeyFromJWK returns EC public key on the curve from x and y members
+func ECPublicKeyFromJWK(jwk *JWK, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
+	x, err := decodeB64(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeB64(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(x) != size || len(y) != size {
+		return nil, ErrInvalidJWK
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, ErrInvalidJWK
+	}
+	return key, nil
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// JWKToPublicKey converts RSA, EC with NIST curve or Ed25519 OKP JWK to PKIX DER public key
+func JWKToPublicKey(jwk *JWK) ([]byte, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeB64(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeB64(jwk.E)
+		if err != nil || len(e) > 4 {
+			return nil, ErrInvalidJWK
+		}
+		return x509.MarshalPKIXPublicKey(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())})
+	case "EC":
+		curve, ok := jwkCurves[jwk.Crv]
+		if !ok {
+			return nil, ErrInvalidKeyType
+		}
+		key, err := ECPublicKeyFromJWK(jwk, curve)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKIXPublicKey(key)
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, ErrInvalidKeyType
+		}
+		x, err := decodeB64(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidJWK
+		}
+		return x509.MarshalPKIXPublicKey(ed25519.PublicKey(x))
+	default:
+		return nil, ErrInvalidKeyType
+	}
+}
+
+// Thumbprint returns RFC 7638 SHA-256 thumbprint of the key
+func (k *JWK) Thumbprint() string {
+	// required members only, in lexicographic order
+	var members any
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
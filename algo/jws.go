@@ -0,0 +1,98 @@
+package algo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidJWS = errors.New("invalid JWS")
+
+// JWSHeader is protected header of compact JWS, Alg is algorithm name
+type JWSHeader struct {
+	Alg  string   `json:"alg"`
+	Typ  string   `json:"typ,omitempty"`
+	Kid  string   `json:"kid,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+}
+
+// SignJWS creates compact JWS of the payload, ECDSA signatures are encoded as r||s
+func SignJWS(alg SignAlgorithm, privateKey []byte, header JWSHeader, payload []byte) (string, error) {
+	header.Alg = alg.Name()
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64(headerJson) + "." + b64(payload)
+	signature, err := alg.Sign(privateKey, []byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	if keySize, ok := ECDSAKeySize(alg.Name()); ok {
+		if signature, err = ECDSASignatureToRaw(signature, keySize); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + b64(signature), nil
+}
+
+// JWS is decoded compact JWS
+type JWS struct {
+	Header       JWSHeader
+	Payload      []byte
+	signingInput []byte
+	signature    []byte
+}
+
+// ParseJWS decodes compact JWS without verifying the signature
+func ParseJWS(token string) (*JWS, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWS
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidJWS
+	}
+	var header JWSHeader
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return nil, ErrInvalidJWS
+	}
+	// no extensions are supported
+	if len(header.Crit) > 0 {
+		return nil, ErrInvalidJWS
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidJWS
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) == 0 {
+		return nil, ErrInvalidJWS
+	}
+	return &JWS{
+		Header:       header,
+		Payload:      payload,
+		signingInput: []byte(parts[0] + "." + parts[1]),
+		signature:    signature,
+	}, nil
+}
+
+// Verify validates signature with PKIX DER public key, header alg must be the algorithm name
+func (j *JWS) Verify(alg SignAlgorithm, publicKey []byte) error {
+	if j.Header.Alg != alg.Name() {
+		return ErrInvalidJWS
+	}
+	signature := j.signature
+	if keySize, ok := ECDSAKeySize(alg.Name()); ok {
+		if len(signature) != 2*keySize {
+			return ErrInvalidSignature
+		}
+		var err error
+		if signature, err = ECDSASignatureFromRaw(signature); err != nil {
+			return err
+		}
+	}
+	return alg.ValidateSignature(publicKey, signature, j.signingInput)
+}
@@ -0,0 +1,57 @@
+package algo
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+const DEFAULT_MIN_RSA_BITS = 2048
+
+var ErrUnsupportedKeySize = errors.New("unsupported key size")
+
+// KeySizeGenerator is implemented by algorithms with configurable key size
+type KeySizeGenerator interface {
+	/*
+	  Generate keypair of given size in bits in DER format.
+	  Return ErrUnsupportedKeySize if the size is not supported.
+	*/
+	GenerateSize(bits int) (DerKeys, error)
+}
+
+// KeyPolicy defines requirements for imported public keys
+type KeyPolicy struct {
+	// minimum RSA modulus size in bits, DEFAULT_MIN_RSA_BITS if 0
+	MinRSABits int
+	// JWK names of allowed curves, e.g. P-256 or Ed25519, any curve if empty
+	AllowedCurves []string
+}
+
+/*
+Check the PKIX DER public key is a key of the algorithm and satisfies the policy.
+*/
+func (p *KeyPolicy) Check(alg SignAlgorithm, publicKey []byte) error {
+	jwk, err := alg.PublicKeyToJWK(publicKey)
+	if err != nil {
+		return err
+	}
+	if jwk.Kty == "RSA" {
+		minBits := p.MinRSABits
+		if minBits == 0 {
+			minBits = DEFAULT_MIN_RSA_BITS
+		}
+		n, err := decodeB64(jwk.N)
+		if err != nil {
+			return err
+		}
+		if bits := new(big.Int).SetBytes(n).BitLen(); bits < minBits {
+			return fmt.Errorf("RSA key size %d is less than %d bits", bits, minBits)
+		}
+		return nil
+	}
+	if len(p.AllowedCurves) > 0 && !slices.Contains(p.AllowedCurves, jwk.Crv) {
+		return fmt.Errorf("curve '%s' is not allowed", jwk.Crv)
+	}
+	return nil
+}
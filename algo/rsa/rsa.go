@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"slices"
 
 	"github.com/jaspeen/apikeyman/algo"
 )
@@ -12,6 +13,8 @@ import (
 type RSAAlgorithm struct {
 	name string
 	hash crypto.Hash
+	// RSASSA-PSS with salt length equal to hash size instead of PKCS1 v1.5
+	pss bool
 }
 
 func (a *RSAAlgorithm) Name() string {
@@ -41,6 +44,10 @@ func (a *RSAAlgorithm) Sign(privateKey []byte, data []byte) ([]byte, error) {
 	hasher := a.hash.New()
 	hasher.Write(data)
 
+	if a.pss {
+		return rsa.SignPSS(rand.Reader, rsaKey, a.hash, hasher.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	}
+
 	// Sign the string and return the encoded bytes
 	if sigBytes, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, a.hash, hasher.Sum(nil)); err == nil {
 		return sigBytes, nil
@@ -72,6 +79,10 @@ func (a *RSAAlgorithm) ValidateSignature(publicKey []byte, signature []byte, dat
 	hasher := a.hash.New()
 	hasher.Write(data)
 
+	if a.pss {
+		return rsa.VerifyPSS(rsaKey, a.hash, hasher.Sum(nil), signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	}
+
 	// Verify the signature
 	if err := rsa.VerifyPKCS1v15(rsaKey, a.hash, hasher.Sum(nil), signature); err != nil {
 		return err
@@ -80,8 +91,23 @@ func (a *RSAAlgorithm) ValidateSignature(publicKey []byte, signature []byte, dat
 	return nil
 }
 
+// key sizes in bits supported by GenerateSize
+var KEY_SIZES = []int{2048, 3072, 4096}
+
+const DEFAULT_KEY_SIZE = 2048
+
 func (a *RSAAlgorithm) Generate() (algo.DerKeys, error) {
-	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	return a.GenerateSize(DEFAULT_KEY_SIZE)
+}
+
+func (a *RSAAlgorithm) GenerateSize(bits int) (algo.DerKeys, error) {
+	if !slices.Contains(KEY_SIZES, bits) {
+		return algo.DerKeys{}, algo.ErrUnsupportedKeySize
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return algo.DerKeys{}, err
+	}
 
 	derPublicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
 	if err != nil {
@@ -98,7 +124,28 @@ func (a *RSAAlgorithm) Generate() (algo.DerKeys, error) {
 	}, nil
 }
 
+func (a *RSAAlgorithm) PublicKeyToJWK(publicKey []byte) (*algo.JWK, error) {
+	jwk, err := algo.PublicKeyToJWK(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := algo.CheckJWKType(jwk, "RSA", ""); err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+func (a *RSAAlgorithm) JWKToPublicKey(jwk *algo.JWK) ([]byte, error) {
+	if err := algo.CheckJWKType(jwk, "RSA", ""); err != nil {
+		return nil, err
+	}
+	return algo.JWKToPublicKey(jwk)
+}
+
 func init() {
 	algo.RegisterSignAlgorithm(&RSAAlgorithm{name: "RS256", hash: crypto.SHA256})
 	algo.RegisterSignAlgorithm(&RSAAlgorithm{name: "RS512", hash: crypto.SHA512})
+	algo.RegisterSignAlgorithm(&RSAAlgorithm{name: "PS256", hash: crypto.SHA256, pss: true})
+	algo.RegisterSignAlgorithm(&RSAAlgorithm{name: "PS384", hash: crypto.SHA384, pss: true})
+	algo.RegisterSignAlgorithm(&RSAAlgorithm{name: "PS512", hash: crypto.SHA512, pss: true})
 }
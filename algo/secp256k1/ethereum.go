@@ -0,0 +1,173 @@
+package secp256k1
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/dustinxie/ecc"
+	"github.com/jaspeen/apikeyman/algo"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	ETHEREUM_ALG = "ETH"
+	// size of address, last bytes of Keccak-256 hash of the public key
+	ADDRESS_SIZE = 20
+	// r||s||v
+	RECOVERABLE_SIGNATURE_SIZE = 65
+)
+
+var ErrInvalidAddress = errors.New("invalid ethereum address")
+
+// half of the curve order, signatures with bigger s are rejected as in EIP-2
+var halfOrder = new(big.Int).Rsh(ecc.P256k1().Params().N, 1)
+
+/*
+EthereumAlgorithm is Ethereum personal_sign: recoverable secp256k1 signature r||s||v
+over Keccak-256 hash of EIP-191 prefixed message. Keys may be stored as PKIX public key or as 20 bytes address.
+*/
+type EthereumAlgorithm struct {
+	Secp256k1Algorithm
+}
+
+func (a *EthereumAlgorithm) Name() string {
+	return ETHEREUM_ALG
+}
+
+func keccak256(data ...[]byte) []byte {
+	hasher := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		hasher.Write(d)
+	}
+	return hasher.Sum(nil)
+}
+
+// PersonalMessageHash returns Keccak-256 hash of EIP-191 version 0x45 message, as signed by personal_sign
+func PersonalMessageHash(data []byte) []byte {
+	prefix := "\x19Ethereum Signed Message:\n" + strconv.Itoa(len(data))
+	return keccak256([]byte(prefix), data)
+}
+
+// PublicKeyAddress returns address of the public key
+func PublicKeyAddress(key *ecdsa.PublicKey) []byte {
+	point := elliptic.Marshal(key.Curve, key.X, key.Y)
+	return keccak256(point[1:])[32-ADDRESS_SIZE:]
+}
+
+func (a *EthereumAlgorithm) Sign(privateKey []byte, data []byte) ([]byte, error) {
+	key, err := ParsePKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := ecc.SignEthereum(PersonalMessageHash(data), key)
+	if err != nil {
+		return nil, err
+	}
+	// wallets return v as 27 or 28
+	signature[RECOVERABLE_SIGNATURE_SIZE-1] += 27
+	return signature, nil
+}
+
+// RecoverAddress returns address of the key which made r||s||v signature of the hash, v may be 0, 1, 27 or 28
+func RecoverAddress(hash []byte, signature []byte) ([]byte, error) {
+	if len(signature) != RECOVERABLE_SIGNATURE_SIZE {
+		return nil, algo.ErrInvalidSignature
+	}
+	sig := make([]byte, RECOVERABLE_SIGNATURE_SIZE)
+	copy(sig, signature)
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	if sig[64] > 1 || new(big.Int).SetBytes(sig[32:64]).Cmp(halfOrder) > 0 {
+		return nil, algo.ErrInvalidSignature
+	}
+	point, err := ecc.RecoverEthereum(hash, sig)
+	if err != nil {
+		return nil, algo.ErrInvalidSignature
+	}
+	return keccak256(point[1:])[32-ADDRESS_SIZE:], nil
+}
+
+func (a *EthereumAlgorithm) keyAddress(key []byte) ([]byte, error) {
+	if a.IsAddress(key) {
+		return key, nil
+	}
+	publicKey, err := ParsePKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return PublicKeyAddress(publicKey), nil
+}
+
+func (a *EthereumAlgorithm) ValidateSignature(publicKey []byte, signature []byte, data []byte) error {
+	expected, err := a.keyAddress(publicKey)
+	if err != nil {
+		return err
+	}
+	address, err := RecoverAddress(PersonalMessageHash(data), signature)
+	if err != nil {
+		return err
+	}
+	if string(address) != string(expected) {
+		return algo.ErrInvalidSignature
+	}
+	return nil
+}
+
+func (a *EthereumAlgorithm) IsAddress(key []byte) bool {
+	return len(key) == ADDRESS_SIZE
+}
+
+// ParseAddress decodes 0x prefixed hex address, mixed case address must have valid EIP-55 checksum
+func (a *EthereumAlgorithm) ParseAddress(address string) ([]byte, error) {
+	hexAddress, ok := strings.CutPrefix(address, "0x")
+	if !ok || len(hexAddress) != 2*ADDRESS_SIZE {
+		return nil, ErrInvalidAddress
+	}
+	decoded, err := hex.DecodeString(hexAddress)
+	if err != nil {
+		return nil, ErrInvalidAddress
+	}
+	if hexAddress != strings.ToLower(hexAddress) && hexAddress != strings.ToUpper(hexAddress) &&
+		FormatAddress(decoded) != address {
+		return nil, ErrInvalidAddress
+	}
+	return decoded, nil
+}
+
+func (a *EthereumAlgorithm) Address(key []byte) (string, error) {
+	address, err := a.keyAddress(key)
+	if err != nil {
+		return "", err
+	}
+	return FormatAddress(address), nil
+}
+
+// FormatAddress returns 0x prefixed hex address with EIP-55 checksum
+func FormatAddress(address []byte) string {
+	lower := hex.EncodeToString(address)
+	hash := keccak256([]byte(lower))
+	result := []byte(lower)
+	for i, c := range result {
+		nibble := hash[i/2] >> 4
+		if i%2 == 1 {
+			nibble = hash[i/2] & 0x0f
+		}
+		if c >= 'a' && nibble >= 8 {
+			result[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(result)
+}
+
+func (a *EthereumAlgorithm) PublicKeyToJWK(publicKey []byte) (*algo.JWK, error) {
+	if a.IsAddress(publicKey) {
+		return nil, algo.ErrInvalidKeyType
+	}
+	return a.Secp256k1Algorithm.PublicKeyToJWK(publicKey)
+}
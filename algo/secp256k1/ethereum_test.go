@@ -0,0 +1,95 @@
+package secp256k1_test
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/dustinxie/ecc"
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/algo/secp256k1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// web3.eth.accounts.sign("Some data", "0x4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318")
+const (
+	ethAddress   = "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+	ethMessage   = "Some data"
+	ethHash      = "1da44b586eb0729ff70a73c326926f6ed5a25f5b056e7f47fbc6e58d86871655"
+	ethSignature = "b91467e570a6466aa9e9876cbcd013baba02900b8979d43fe208a4a4f339f5fd6007e74cd82e037b800186422fc2da167c747ef045e5d18a5f5d4300f8e1a0291c"
+)
+
+func TestEthereumPersonalSign(t *testing.T) {
+	assert.Equal(t, ethHash, hex.EncodeToString(secp256k1.PersonalMessageHash([]byte(ethMessage))))
+
+	alg := algo.GetSignAlgorithm(secp256k1.ETHEREUM_ALG).(*secp256k1.EthereumAlgorithm)
+	address, err := alg.ParseAddress(ethAddress)
+	require.Nil(t, err)
+	signature, _ := hex.DecodeString(ethSignature)
+	assert.Nil(t, alg.ValidateSignature(address, signature, []byte(ethMessage)))
+	assert.NotNil(t, alg.ValidateSignature(address, signature, []byte("Other data")))
+
+	// v as recovery id
+	signature[64] -= 27
+	assert.Nil(t, alg.ValidateSignature(address, signature, []byte(ethMessage)))
+	signature[64] = 2
+	assert.NotNil(t, alg.ValidateSignature(address, signature, []byte(ethMessage)))
+	assert.NotNil(t, alg.ValidateSignature(address, signature[:64], []byte(ethMessage)))
+}
+
+func TestEthereumHighS(t *testing.T) {
+	alg := algo.GetSignAlgorithm(secp256k1.ETHEREUM_ALG)
+	address, err := alg.(algo.AddressAlgorithm).ParseAddress(ethAddress)
+	require.Nil(t, err)
+	signature, _ := hex.DecodeString(ethSignature)
+	// (r, N-s, v^1) recovers the same key but is rejected as in EIP-2
+	n := ecc.P256k1().Params().N
+	new(big.Int).Sub(n, new(big.Int).SetBytes(signature[32:64])).FillBytes(signature[32:64])
+	signature[64] ^= 1
+	assert.Equal(t, algo.ErrInvalidSignature, alg.ValidateSignature(address, signature, []byte(ethMessage)))
+}
+
+func TestEthereumGenSignVerify(t *testing.T) {
+	alg := algo.GetSignAlgorithm(secp256k1.ETHEREUM_ALG)
+	addressAlg := alg.(algo.AddressAlgorithm)
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	signature, err := alg.Sign(keys.Private, []byte("test data"))
+	require.Nil(t, err)
+	require.Len(t, signature, secp256k1.RECOVERABLE_SIGNATURE_SIZE)
+	assert.Contains(t, []byte{27, 28}, signature[64])
+
+	// public key and its address verify the same signature
+	assert.Nil(t, alg.ValidateSignature(keys.Public, signature, []byte("test data")))
+	address, err := addressAlg.Address(keys.Public)
+	require.Nil(t, err)
+	addressBytes, err := addressAlg.ParseAddress(address)
+	require.Nil(t, err)
+	assert.True(t, addressAlg.IsAddress(addressBytes))
+	assert.Nil(t, alg.ValidateSignature(addressBytes, signature, []byte("test data")))
+
+	// signature of other key
+	otherKeys, err := alg.Generate()
+	require.Nil(t, err)
+	assert.NotNil(t, alg.ValidateSignature(otherKeys.Public, signature, []byte("test data")))
+}
+
+func TestParseAddress(t *testing.T) {
+	alg := algo.GetSignAlgorithm(secp256k1.ETHEREUM_ALG).(algo.AddressAlgorithm)
+	for _, address := range []string{ethAddress, "0x2c7536e3605d9c16a7a3d7b1898e529396a65c23", "0x2C7536E3605D9C16A7A3D7B1898E529396A65C23"} {
+		decoded, err := alg.ParseAddress(address)
+		require.Nil(t, err, address)
+		assert.Equal(t, ethAddress, secp256k1.FormatAddress(decoded))
+	}
+	for _, address := range []string{
+		"2c7536E3605D9C16a7a3D7b1898e529396a65c23",
+		"0x2c7536E3605D9C16a7a3D7b1898e529396a65c2",
+		"0x2c7536E3605D9C16a7a3D7b1898e529396a65c2z",
+		// bad checksum
+		"0x2C7536E3605D9C16a7a3D7b1898e529396a65c23",
+	} {
+		_, err := alg.ParseAddress(address)
+		assert.Equal(t, secp256k1.ErrInvalidAddress, err, address)
+	}
+}
@@ -3,11 +3,15 @@ package secp256k1
 import (
 	"crypto"
 	"crypto/rand"
+	"encoding/base64"
 
 	"github.com/dustinxie/ecc"
 	"github.com/jaspeen/apikeyman/algo"
 )
 
+// curve name registered for JOSE in RFC 8812
+const JWK_CURVE = "secp256k1"
+
 type Secp256k1Algorithm struct {
 	hash crypto.Hash
 }
@@ -77,6 +81,32 @@ func (a *Secp256k1Algorithm) ValidateSignature(publicKey []byte, signature []byt
 	return nil
 }
 
+func (a *Secp256k1Algorithm) PublicKeyToJWK(publicKey []byte) (*algo.JWK, error) {
+	key, err := ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return &algo.JWK{
+		Kty: "EC",
+		Crv: JWK_CURVE,
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}, nil
+}
+
+func (a *Secp256k1Algorithm) JWKToPublicKey(jwk *algo.JWK) ([]byte, error) {
+	if err := algo.CheckJWKType(jwk, "EC", JWK_CURVE); err != nil {
+		return nil, err
+	}
+	key, err := algo.ECPublicKeyFromJWK(jwk, ecc.P256k1())
+	if err != nil {
+		return nil, err
+	}
+	return MarshalPKIXPublicKey(key)
+}
+
 func init() {
 	algo.RegisterSignAlgorithm(&Secp256k1Algorithm{hash: crypto.SHA256})
+	algo.RegisterSignAlgorithm(&EthereumAlgorithm{Secp256k1Algorithm{hash: crypto.SHA256}})
 }
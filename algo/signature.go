@@ -0,0 +1,93 @@
+package algo
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var ErrInvalidSignatureEncoding = errors.New("invalid signature encoding")
+
+// ECDSA signatures are encoded as r||s in JOSE and http signatures, value is size of r and s in bytes
+var ecdsaKeySizes = map[string]int{
+	"ES256":  32,
+	"ES384":  48,
+	"ES512":  66,
+	"ES256K": 32,
+}
+
+// ECDSAKeySize returns size of r and s for ECDSA algorithm
+func ECDSAKeySize(alg string) (int, bool) {
+	size, ok := ecdsaKeySizes[alg]
+	return size, ok
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+/*
+Convert ECDSA signature from ASN.1 DER to fixed length r||s used by JOSE and WebCrypto.
+keySize is the curve order size in bytes, e.g. 32 for P-256.
+*/
+func ECDSASignatureToRaw(der []byte, keySize int) ([]byte, error) {
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil {
+		return nil, ErrInvalidSignatureEncoding
+	}
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.BitLen() > keySize*8 || sig.S.BitLen() > keySize*8 {
+		return nil, ErrInvalidSignatureEncoding
+	}
+	raw := make([]byte, 2*keySize)
+	sig.R.FillBytes(raw[:keySize])
+	sig.S.FillBytes(raw[keySize:])
+	return raw, nil
+}
+
+// Convert ECDSA signature from fixed length r||s to ASN.1 DER
+func ECDSASignatureFromRaw(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, ErrInvalidSignatureEncoding
+	}
+	keySize := len(raw) / 2
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(raw[:keySize]),
+		S: new(big.Int).SetBytes(raw[keySize:]),
+	})
+}
+
+// signature encodings, raw is r||s of ECDSA signature, other algorithms have single encoding
+const (
+	SIG_ENCODING_DER = "der"
+	SIG_ENCODING_RAW = "raw"
+)
+
+func ValidateSigEncoding(encoding string) error {
+	if encoding != SIG_ENCODING_DER && encoding != SIG_ENCODING_RAW {
+		return fmt.Errorf("unknown signature encoding '%s', must be '%s' or '%s'", encoding, SIG_ENCODING_DER, SIG_ENCODING_RAW)
+	}
+	return nil
+}
+
+// DecodeSignature converts signature in the encoding to format accepted by ValidateSignature of the algorithm
+func DecodeSignature(alg string, encoding string, signature []byte) ([]byte, error) {
+	keySize, ok := ECDSAKeySize(alg)
+	if !ok || encoding != SIG_ENCODING_RAW {
+		return signature, nil
+	}
+	if len(signature) != 2*keySize {
+		return nil, ErrInvalidSignatureEncoding
+	}
+	return ECDSASignatureFromRaw(signature)
+}
+
+// EncodeSignature converts signature returned by Sign of the algorithm to the encoding
+func EncodeSignature(alg string, encoding string, signature []byte) ([]byte, error) {
+	keySize, ok := ECDSAKeySize(alg)
+	if !ok || encoding != SIG_ENCODING_RAW {
+		return signature, nil
+	}
+	return ECDSASignatureToRaw(signature, keySize)
+}
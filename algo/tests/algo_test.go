@@ -1,6 +1,9 @@
 package tests_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"testing"
 
 	"github.com/jaspeen/apikeyman/algo"
@@ -27,3 +30,145 @@ func TestGenSignVerify(t *testing.T) {
 		})
 	}
 }
+
+func TestECDSASignatureRawEncoding(t *testing.T) {
+	for algName, keySize := range map[string]int{"ES256": 32, "ES256K": 32} {
+		t.Run(algName, func(t *testing.T) {
+			alg := algo.GetSignAlgorithm(algName)
+			keys, err := alg.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testData := []byte("test data")
+			signature, err := alg.Sign(keys.Private, testData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := algo.ECDSASignatureToRaw(signature, keySize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(raw) != 2*keySize {
+				t.Fatalf("unexpected raw signature length %d", len(raw))
+			}
+			der, err := algo.ECDSASignatureFromRaw(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = alg.ValidateSignature(keys.Public, der, testData)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRSAPaddingNotInterchangeable(t *testing.T) {
+	keys, err := algo.GetSignAlgorithm("RS256").Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := []byte("test data")
+	for signer, verifier := range map[string]string{"RS256": "PS256", "PS256": "RS256", "PS384": "PS256"} {
+		signature, err := algo.GetSignAlgorithm(signer).Sign(keys.Private, testData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := algo.GetSignAlgorithm(verifier).ValidateSignature(keys.Public, signature, testData); err == nil {
+			t.Errorf("%s signature is valid for %s", signer, verifier)
+		}
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := algo.GetSignAlgorithm("RS256")
+	policy := algo.KeyPolicy{}
+	if err := policy.Check(rs256, weakKey); err == nil {
+		t.Error("1024 bit RSA key accepted by default policy")
+	}
+	policy.MinRSABits = 1024
+	if err := policy.Check(rs256, weakKey); err != nil {
+		t.Error(err)
+	}
+
+	keys, err := rs256.(algo.KeySizeGenerator).GenerateSize(3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.MinRSABits = 4096
+	if err := policy.Check(rs256, keys.Public); err == nil {
+		t.Error("3072 bit RSA key accepted with 4096 bit minimum")
+	}
+	if _, err := rs256.(algo.KeySizeGenerator).GenerateSize(1024); err != algo.ErrUnsupportedKeySize {
+		t.Errorf("expected ErrUnsupportedKeySize, got %v", err)
+	}
+
+	policy = algo.KeyPolicy{AllowedCurves: []string{"P-256", "Ed25519"}}
+	for algName, allowed := range map[string]bool{"ES256": true, "EdDSA": true, "ES384": false, "ES256K": false} {
+		alg := algo.GetSignAlgorithm(algName)
+		keys, err := alg.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.Check(alg, keys.Public); (err == nil) != allowed {
+			t.Errorf("%s: unexpected policy result %v", algName, err)
+		}
+	}
+
+	// key doesn't parse for the algorithm
+	ecKeys, err := algo.GetSignAlgorithm("ES256").Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algName := range []string{"RS256", "ES384", "ES256K", "EdDSA"} {
+		if err := policy.Check(algo.GetSignAlgorithm(algName), ecKeys.Public); err == nil {
+			t.Errorf("P-256 key accepted for %s", algName)
+		}
+	}
+}
+
+func TestSignatureEncoding(t *testing.T) {
+	rawSizes := map[string]int{"ES256": 64, "ES384": 96, "ES512": 132, "ES256K": 64}
+	for _, algName := range algo.GetSignAlgorithmNames() {
+		t.Run(algName, func(t *testing.T) {
+			alg := algo.GetSignAlgorithm(algName)
+			keys, err := alg.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testData := []byte("test data")
+			signature, err := alg.Sign(keys.Private, testData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := algo.EncodeSignature(algName, algo.SIG_ENCODING_RAW, signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size, ok := rawSizes[algName]; ok && len(raw) != size {
+				t.Errorf("unexpected raw signature length %d", len(raw))
+			}
+			decoded, err := algo.DecodeSignature(algName, algo.SIG_ENCODING_RAW, raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := alg.ValidateSignature(keys.Public, decoded, testData); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	if _, err := algo.DecodeSignature("ES256", algo.SIG_ENCODING_RAW, make([]byte, 63)); err == nil {
+		t.Error("raw signature of wrong length accepted")
+	}
+	if err := algo.ValidateSigEncoding("jose"); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
@@ -0,0 +1,194 @@
+package tests_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/algo"
+	_ "github.com/jaspeen/apikeyman/algo/all"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicKeyToJWK(t *testing.T) {
+	for algName, expected := range map[string]algo.JWK{
+		"ES256": {Kty: "EC", Crv: "P-256"},
+		"RS256": {Kty: "RSA", E: "AQAB"},
+		"EdDSA": {Kty: "OKP", Crv: "Ed25519"},
+	} {
+		t.Run(algName, func(t *testing.T) {
+			keys, err := algo.GetSignAlgorithm(algName).Generate()
+			require.Nil(t, err)
+			jwk, err := algo.PublicKeyToJWK(keys.Public)
+			require.Nil(t, err)
+			assert.Equal(t, expected.Kty, jwk.Kty)
+			assert.Equal(t, expected.Crv, jwk.Crv)
+			if expected.E != "" {
+				assert.Equal(t, expected.E, jwk.E)
+			}
+			publicKey, err := algo.PublicKeyFromPrivate(keys.Private)
+			require.Nil(t, err)
+			assert.Equal(t, keys.Public, publicKey)
+		})
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 7638 section 3.1
+	jwk := algo.JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Alg: "RS256",
+		Kid: "2011-04-29",
+	}
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jwk.Thumbprint())
+}
+
+func TestSignJWS(t *testing.T) {
+	for _, algName := range []string{"ES256", "ES256K", "RS256", "EdDSA"} {
+		t.Run(algName, func(t *testing.T) {
+			alg := algo.GetSignAlgorithm(algName)
+			keys, err := alg.Generate()
+			require.Nil(t, err)
+			token, err := algo.SignJWS(alg, keys.Private, algo.JWSHeader{Typ: "JWT", Kid: "k1"}, []byte(`{"sub":"a"}`))
+			require.Nil(t, err)
+
+			parts := strings.Split(token, ".")
+			require.Len(t, parts, 3)
+			headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+			require.Nil(t, err)
+			var header algo.JWSHeader
+			require.Nil(t, json.Unmarshal(headerJson, &header))
+			assert.Equal(t, algo.JWSHeader{Alg: algName, Typ: "JWT", Kid: "k1"}, header)
+
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			require.Nil(t, err)
+			if keySize, ok := algo.ECDSAKeySize(algName); ok {
+				require.Len(t, signature, 2*keySize)
+				signature, err = algo.ECDSASignatureFromRaw(signature)
+				require.Nil(t, err)
+			}
+			assert.Nil(t, alg.ValidateSignature(keys.Public, signature, []byte(parts[0]+"."+parts[1])))
+		})
+	}
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	for _, algName := range algo.GetSignAlgorithmNames() {
+		t.Run(algName, func(t *testing.T) {
+			alg := algo.GetSignAlgorithm(algName)
+			keys, err := alg.Generate()
+			require.Nil(t, err)
+			jwk, err := alg.PublicKeyToJWK(keys.Public)
+			require.Nil(t, err)
+
+			// through JSON like in API requests
+			data, err := json.Marshal(jwk)
+			require.Nil(t, err)
+			var parsed algo.JWK
+			require.Nil(t, json.Unmarshal(data, &parsed))
+
+			publicKey, err := alg.JWKToPublicKey(&parsed)
+			require.Nil(t, err)
+			assert.Equal(t, keys.Public, publicKey)
+
+			signature, err := alg.Sign(keys.Private, []byte("test data"))
+			require.Nil(t, err)
+			assert.Nil(t, alg.ValidateSignature(publicKey, signature, []byte("test data")))
+		})
+	}
+}
+
+func TestJWKSecp256k1Curve(t *testing.T) {
+	alg := algo.GetSignAlgorithm("ES256K")
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	jwk, err := alg.PublicKeyToJWK(keys.Public)
+	require.Nil(t, err)
+	assert.Equal(t, "EC", jwk.Kty)
+	assert.Equal(t, "secp256k1", jwk.Crv)
+}
+
+func TestJWKToPublicKeyErrors(t *testing.T) {
+	ecKeys, err := algo.GetSignAlgorithm("ES256").Generate()
+	require.Nil(t, err)
+	ecJwk, err := algo.GetSignAlgorithm("ES256").PublicKeyToJWK(ecKeys.Public)
+	require.Nil(t, err)
+
+	t.Run("wrong_algorithm", func(t *testing.T) {
+		for _, algName := range []string{"ES256K", "RS256", "EdDSA"} {
+			_, err := algo.GetSignAlgorithm(algName).JWKToPublicKey(ecJwk)
+			assert.ErrorIs(t, err, algo.ErrInvalidKeyType, algName)
+			_, err = algo.GetSignAlgorithm(algName).PublicKeyToJWK(ecKeys.Public)
+			assert.NotNil(t, err, algName)
+		}
+	})
+
+	t.Run("not_on_curve", func(t *testing.T) {
+		invalid := *ecJwk
+		invalid.X, invalid.Y = invalid.Y, invalid.X
+		_, err := algo.GetSignAlgorithm("ES256").JWKToPublicKey(&invalid)
+		assert.ErrorIs(t, err, algo.ErrInvalidJWK)
+	})
+
+	t.Run("invalid_encoding", func(t *testing.T) {
+		invalid := *ecJwk
+		invalid.X = "not base64url!"
+		_, err := algo.GetSignAlgorithm("ES256").JWKToPublicKey(&invalid)
+		assert.ErrorIs(t, err, algo.ErrInvalidJWK)
+	})
+}
+
+func TestVerifyJWS(t *testing.T) {
+	for _, algName := range algo.GetSignAlgorithmNames() {
+		t.Run(algName, func(t *testing.T) {
+			alg := algo.GetSignAlgorithm(algName)
+			keys, err := alg.Generate()
+			require.Nil(t, err)
+			token, err := algo.SignJWS(alg, keys.Private, algo.JWSHeader{Kid: "1"}, []byte(`{"sub":"a"}`))
+			require.Nil(t, err)
+
+			jws, err := algo.ParseJWS(token)
+			require.Nil(t, err)
+			assert.Equal(t, "1", jws.Header.Kid)
+			assert.Equal(t, `{"sub":"a"}`, string(jws.Payload))
+			assert.Nil(t, jws.Verify(alg, keys.Public))
+
+			otherKeys, err := alg.Generate()
+			require.Nil(t, err)
+			assert.NotNil(t, jws.Verify(alg, otherKeys.Public), "other key")
+
+			parts := strings.Split(token, ".")
+			tampered, err := algo.ParseJWS(parts[0] + "." + b64(`{"sub":"b"}`) + "." + parts[2])
+			require.Nil(t, err)
+			assert.NotNil(t, tampered.Verify(alg, keys.Public), "payload changed")
+		})
+	}
+
+	alg := algo.GetSignAlgorithm("ES256")
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	token, err := algo.SignJWS(alg, keys.Private, algo.JWSHeader{}, []byte(`{}`))
+	require.Nil(t, err)
+	jws, err := algo.ParseJWS(token)
+	require.Nil(t, err)
+	assert.ErrorIs(t, jws.Verify(algo.GetSignAlgorithm("ES256K"), keys.Public), algo.ErrInvalidJWS, "alg mismatch")
+
+	parts := strings.Split(token, ".")
+	for name, invalid := range map[string]string{
+		"parts":        parts[0] + "." + parts[1],
+		"header":       b64("not json") + "." + parts[1] + "." + parts[2],
+		"no_signature": parts[0] + "." + parts[1] + ".",
+		"crit":         b64(`{"alg":"ES256","crit":["exp"]}`) + "." + parts[1] + "." + parts[2],
+	} {
+		_, err := algo.ParseJWS(invalid)
+		assert.ErrorIs(t, err, algo.ErrInvalidJWS, name)
+	}
+}
+
+func b64(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
@@ -3,13 +3,17 @@ package api
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/canonical"
 	"github.com/jaspeen/apikeyman/db/queries"
 	"github.com/jellydator/ttlcache/v3"
 )
@@ -18,6 +22,44 @@ const (
 	API_KEY_DEFAULT_HEADER   = "X-API-KEY"
 	SIGNATURE_DEFAULT_HEADER = "X-Signature"
 	TIMESTAMP_DEFAULT_HEADER = "X-Timestamp"
+	NONCE_DEFAULT_HEADER     = "X-Nonce"
+	// algo.SIG_ENCODING_DER or algo.SIG_ENCODING_RAW, overrides encoding set for the key
+	SIGNATURE_ENCODING_HEADER = "X-Signature-Encoding"
+
+	// scopes the key must have to pass /check and /verify, space separated
+	REQUIRED_SCOPE_HEADER      = "X-Required-Scope"
+	REQUIRED_SCOPE_QUERY_PARAM = "required_scope"
+
+	API_KEY_DEFAULT_QUERY_PARAM   = "apikey"
+	SIGNATURE_DEFAULT_QUERY_PARAM = "signature"
+	TIMESTAMP_DEFAULT_QUERY_PARAM = "timestamp"
+
+	// original request method and uri when /verify is called by proxy
+	FORWARDED_METHOD_HEADER = "X-Forwarded-Method"
+	FORWARDED_URI_HEADER    = "X-Forwarded-Uri"
+	ORIGINAL_URI_HEADER     = "X-Original-URI"
+	FORWARDED_HOST_HEADER   = "X-Forwarded-Host"
+	FORWARDED_PROTO_HEADER  = "X-Forwarded-Proto"
+
+	TIMESTAMP_DEFAULT_EXPIRATION = 5 * time.Minute
+
+	// max length of nonce and client assertion jti, they are stored until timestamp expires
+	MAX_NONCE_LENGTH = 128
+)
+
+// error codes returned in error response body
+const (
+	CODE_TIMESTAMP_INVALID   = "timestamp_invalid"
+	CODE_TIMESTAMP_EXPIRED   = "timestamp_expired"
+	CODE_TIMESTAMP_IN_FUTURE = "timestamp_in_future"
+	CODE_NONCE_REUSED        = "nonce_reused"
+	CODE_NONCE_INVALID       = "nonce_invalid"
+	CODE_SIGNATURE_EXPIRED   = "signature_expired"
+	CODE_INSUFFICIENT_SCOPE  = "insufficient_scope"
+	CODE_REVOKED             = "revoked"
+	CODE_VERSION_CONFLICT    = "version_conflict"
+	CODE_RATE_LIMITED        = "rate_limited"
+	CODE_INVALID_AUDIENCE    = "invalid_audience"
 )
 
 type Config struct {
@@ -27,19 +69,76 @@ type Config struct {
 	SignatureQueryParam  string
 	TimestampHeaderName  string
 	TimestampQueryParam  string
-	TimestampExpiration  time.Duration
+	// max allowed clock skew between timestamp and server time in both directions
+	TimestampExpiration time.Duration
+	NonceHeaderName     string
+	// NONCE_STORE_MEMORY or NONCE_STORE_POSTGRES, memory is used if empty
+	NonceStore string
+	// max number of nonces in memory store, NONCE_MEMORY_DEFAULT_MAX_SIZE if 0
+	NonceMemoryMaxSize uint64
+	// RATE_LIMIT_STORE_MEMORY or RATE_LIMIT_STORE_POSTGRES, memory is used if empty
+	RateLimitStore string
+	// how often key usage is written to database, usage is not tracked if 0
+	UsageFlushInterval time.Duration
+	// also write audit events as JSON lines to stdout
+	AuditStdout bool
+	// canonical.MODE_BODY or canonical.MODE_CANONICAL, used if not set for key
+	SignMode string
+	// headers included in canonical request
+	SignedHeaders        []string
 	DefaultKeyExpiration time.Duration
 	CacheMaxSize         uint64
 	CacheTTL             time.Duration
+	// how long previous secret remains valid after rotation if not specified in request
+	RotationGracePeriod time.Duration
+	// allow management api without authentication, for local development only
+	ManageAuthDisabled bool
+	// common names of client certificates allowed to use management api, certificates are not accepted if empty
+	AdminCertSubjects []string
+	// header with admin user name set by authenticating proxy
+	AdminProxyHeader string
+	// addresses or CIDRs allowed to set AdminProxyHeader
+	TrustedProxies []string
+	// top level extra fields returned by /forwardauth in response headers, field name to header name
+	ForwardAuthExtraHeaders map[string]string
+	// lifetime of issued JWTs, tokens are not issued if 0
+	TokenTTL time.Duration
+	// algorithm of token signing key, TOKEN_DEFAULT_ALG if empty
+	TokenAlg string
+	// PKCS8 DER token signing key, required if TokenTTL is set unless TokenKeyGenerated
+	TokenPrivateKey []byte
+	// generate token signing key on start if TokenPrivateKey is nil, for local development only
+	TokenKeyGenerated bool
+	// iss claim of issued tokens
+	TokenIssuer string
+	// accepted aud of client assertions, client assertions are not accepted if empty
+	ClientAssertionAudience []string
+	// minimum modulus size of imported and generated RSA keys, algo.DEFAULT_MIN_RSA_BITS if 0
+	MinRSAKeyBits int
+	// JWK names of allowed key curves, any supported curve if empty
+	AllowedCurves []string
 }
 
 var ErrUnauthorized = errors.New("Unauthorized")
 var ErrInvalidApiKey = errors.New("Invalid API key")
+var ErrUnknownNonceStore = errors.New("Unknown nonce store")
+var ErrUnknownRateLimitStore = errors.New("Unknown rate limit store")
+var ErrTokenKeyRequired = errors.New("Token signing key is required")
 
 func respondUnauthorized(c *gin.Context) {
 	c.JSON(401, gin.H{"error": "Unauthorized"})
 }
 
+func respondUnauthorizedWithCode(c *gin.Context, code string) {
+	setAuthFailure(c, code)
+	c.JSON(401, errorResponse{Error: "Unauthorized", Code: code})
+}
+
+func respondForbiddenWithCode(c *gin.Context, code string) {
+	setAuthFailure(c, code)
+	c.JSON(403, errorResponse{Error: "Forbidden", Code: code})
+}
+
 func respondInvalidRequest(c *gin.Context) {
 	c.JSON(400, gin.H{"error": "Invalid request"})
 }
@@ -66,6 +165,21 @@ func extractIdAndSecret(apiKey string) (int64, string, error) {
 	return id, parts[1], err
 }
 
+/*
+parseApiKeyRef parses key reference used by management api: numeric id, public "id:" prefix of the key
+or the full key. Secret is nil unless full key is given.
+*/
+func parseApiKeyRef(ref string) (int64, []byte, error) {
+	if id, err := strconv.ParseInt(strings.TrimSuffix(ref, ":"), 10, 64); err == nil {
+		return id, nil, nil
+	}
+	apiKey, err := ParseApiKey(ref)
+	if err != nil {
+		return 0, nil, err
+	}
+	return apiKey.Id, apiKey.Secret, nil
+}
+
 func ParseApiKey(apiKey string) (*ApiKey, error) {
 	id, secret, err := extractIdAndSecret(apiKey)
 	if err != nil {
@@ -82,41 +196,148 @@ type Api struct {
 	Log    *slog.Logger
 	Db     *sql.DB
 	Config Config
-	cache  *ttlcache.Cache[string, *queries.GetApiKeyForVerifyRow]
+	// replay protection is disabled if nil
+	Nonces NonceStore
+	// per key rate limits are not enforced if nil
+	RateLimiter RateLimiter
+	// key usage is not tracked if nil
+	Usage *UsageTracker
+	// audit events are not written if nil
+	Audit AuditSink
+	// queue of auth failure events, written synchronously to Audit if nil
+	authFailureAudit *AsyncAuditSink
+	// JWTs are not issued if nil
+	Tokens *TokenIssuer
+	cache  *ttlcache.Cache[int64, *queries.GetApiKeyForVerifyRow]
+	// metrics are not collected if nil
+	metrics *metrics
 }
 
 func NewApi(log *slog.Logger, db *sql.DB, config Config) (*Api, error) {
-	var cache *ttlcache.Cache[string, *queries.GetApiKeyForVerifyRow]
+	var cache *ttlcache.Cache[int64, *queries.GetApiKeyForVerifyRow]
 	if config.CacheMaxSize > 0 {
 		cache = ttlcache.New(
-			ttlcache.WithTTL[string, *queries.GetApiKeyForVerifyRow](config.CacheTTL),
-			ttlcache.WithCapacity[string, *queries.GetApiKeyForVerifyRow](config.CacheMaxSize),
+			ttlcache.WithTTL[int64, *queries.GetApiKeyForVerifyRow](config.CacheTTL),
+			ttlcache.WithCapacity[int64, *queries.GetApiKeyForVerifyRow](config.CacheMaxSize),
 		)
 	}
-	return &Api{Log: log, Db: db, Config: config, cache: cache}, nil
+	nonces, err := NewNonceStore(config.NonceStore, db, config.NonceMemoryMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	rateLimiter, err := NewRateLimiter(config.RateLimitStore, db)
+	if err != nil {
+		return nil, err
+	}
+	if config.SignMode != "" {
+		if err := canonical.ValidateMode(config.SignMode); err != nil {
+			return nil, fmt.Errorf("invalid sign mode '%s': %w", config.SignMode, err)
+		}
+	}
+	if _, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if config.ManageAuthDisabled {
+		log.Warn("Management api authentication is disabled")
+	}
+	var usage *UsageTracker
+	if config.UsageFlushInterval > 0 && db != nil {
+		usage = NewUsageTracker(db, config.UsageFlushInterval)
+	}
+	var tokens *TokenIssuer
+	if config.TokenTTL > 0 {
+		if config.TokenPrivateKey == nil {
+			// replicas would publish different keys
+			if !config.TokenKeyGenerated {
+				return nil, ErrTokenKeyRequired
+			}
+			log.Warn("Token signing key is generated, tokens can't be verified after restart or across replicas")
+		}
+		tokens, err = NewTokenIssuer(config.TokenAlg, config.TokenPrivateKey, config.TokenIssuer, config.TokenTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var auditStdout io.Writer
+	if config.AuditStdout {
+		auditStdout = os.Stdout
+	}
+	audit := NewAuditSink(db, auditStdout)
+	var authFailureAudit *AsyncAuditSink
+	if audit != nil {
+		authFailureAudit = NewAsyncAuditSink(audit, AUTH_FAILURE_AUDIT_QUEUE_SIZE)
+	}
+	return &Api{Log: log, Db: db, Config: config, Nonces: nonces, RateLimiter: rateLimiter, Usage: usage,
+		Audit: audit, authFailureAudit: authFailureAudit, Tokens: tokens, cache: cache,
+		metrics: newMetrics(db, cache)}, nil
+}
+
+// Close stops background work of the api, flushing pending key usages and audit events
+func (a *Api) Close() {
+	if a.Usage != nil {
+		a.Usage.Stop()
+	}
+	if a.authFailureAudit != nil {
+		a.authFailureAudit.Stop()
+	}
+}
+
+// evictCachedKey drops cached verification data for the key, so changes
+// like revocation are visible on the next request to this instance.
+func (a *Api) evictCachedKey(id int64) {
+	if a.cache != nil {
+		a.cache.Delete(id)
+	}
+}
+
+// setTrustedProxies makes router take client ip from forwarded headers only if they are set by configured proxies
+func (a *Api) setTrustedProxies(router *gin.Engine) {
+	// client ip is used for audit, key usage and rate limits
+	if err := router.SetTrustedProxies(a.Config.TrustedProxies); err != nil {
+		slog.Error(fmt.Sprintf("Invalid trusted proxies: %s", err))
+	}
 }
 
 func (a *Api) Routes(prefix string) *gin.Engine {
 	router := gin.Default()
+	a.setTrustedProxies(router)
 	v1 := router.Group(prefix)
 
 	// check api key exist and not expired
-	v1.POST("/check", a.Check)
+	v1.POST("/check", a.metrics.instrument("check"), a.auditAuthFailures, a.Check)
 
 	// check api key and validate body signature
 	// only for POST, PUT, PATCH
-	v1.Match([]string{"POST", "PUT", "PATCH"}, "/verify", a.Verify)
+	v1.Match([]string{"POST", "PUT", "PATCH"}, "/verify", a.metrics.instrument("verify"), a.auditAuthFailures, a.Verify)
 
 	// similar to verify, but it will considered as valid if no signature is present
-	v1.Match([]string{"POST", "PUT", "PATCH"}, "/checkorverify", a.CheckOrVerify)
+	v1.Match([]string{"POST", "PUT", "PATCH"}, "/checkorverify", a.metrics.instrument("checkorverify"), a.auditAuthFailures, a.CheckOrVerify)
+
+	// exchange api key for short-lived JWT and public keys to verify it
+	v1.POST("/token", a.metrics.instrument("token"), a.auditAuthFailures, a.Token)
+	v1.GET("/.well-known/jwks.json", a.JWKS)
 
-	manage := v1.Group("/apikeys")
+	// checkorverify for original request of nginx auth_request and Traefik ForwardAuth
+	v1.Any("/forwardauth", a.forwardAuth())
+
+	manage := v1.Group("/apikeys", a.auditAuthFailures, a.RequireAdmin)
 	// create new api key
 	manage.POST("", a.CreateApiKey)
 	// list all api keys filtering by sub, exp and alg
 	manage.POST("/search", a.ListApiKeys)
 	// get api key by id
 	manage.GET("/:apikey", a.GetApiKey)
+	// update api key metadata by id
+	manage.PATCH("/:apikey", a.UpdateApiKey)
+	// revoke api key by id
+	manage.DELETE("/:apikey", a.RevokeApiKey)
+	// issue new secret keeping previous one valid for grace period
+	manage.POST("/:apikey/rotate", a.RotateApiKey)
+	// public key of api key as JWK Set
+	manage.GET("/:apikey/jwks", a.GetApiKeyJWKS)
+
+	// audit trail of management and failed authentication events
+	v1.GET("/audit", a.auditAuthFailures, a.RequireAdmin, a.ListAuditEvents)
 
 	// health and metrics
 	health := v1.Group("/health")
@@ -1,9 +1,12 @@
 package api_test
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +14,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -19,6 +23,7 @@ import (
 	"github.com/jaspeen/apikeyman/algo"
 	_ "github.com/jaspeen/apikeyman/algo/all"
 	"github.com/jaspeen/apikeyman/api"
+	"github.com/jaspeen/apikeyman/canonical"
 	"github.com/jaspeen/apikeyman/db/migrations"
 	_ "github.com/lib/pq"
 	"github.com/ory/dockertest/v3"
@@ -33,6 +38,15 @@ func clenupDb() {
 	if err != nil {
 		log.Fatalf("Could not cleanup database: %s", err)
 	}
+	_, err = db.Exec("DELETE FROM nonce")
+	if err != nil {
+		log.Fatalf("Could not cleanup database: %s", err)
+	}
+	_, err = db.Exec("DELETE FROM rate_limit")
+	if err != nil {
+		log.Fatalf("Could not cleanup database: %s", err)
+	}
+	// audit_event is append-only and not cleaned, tests filter events by key id
 }
 
 func TestMain(m *testing.M) {
@@ -92,7 +106,7 @@ func TestMain(m *testing.M) {
 }
 
 func createRouter() *gin.Engine {
-	api := api.Api{Db: db, Log: slog.Default(), Config: api.Config{
+	api := api.Api{Db: db, Log: slog.Default(), Nonces: api.NewMemoryNonceStore(0), Audit: api.NewPostgresAuditSink(db), Config: api.Config{
 		ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
 		ApiKeyQueryParamName: "apikey",
 		SignatureHeaderName:  api.SIGNATURE_DEFAULT_HEADER,
@@ -101,6 +115,7 @@ func createRouter() *gin.Engine {
 		TimestampQueryParam:  "timestamp",
 		TimestampExpiration:  5 * time.Minute,
 		DefaultKeyExpiration: 24 * time.Hour,
+		ManageAuthDisabled:   true,
 	}}
 	return api.Routes("/")
 }
@@ -226,6 +241,30 @@ func TestCreateApiKey(t *testing.T) {
 		assert.Truef(t, res.Exp.After(time.Now().Add(23*time.Hour)) && res.Exp.Before(time.Now().Add(25*time.Hour)), "exp should be default 24h")
 	})
 
+	// get api key by id without secret
+	t.Run("get by id", func(t *testing.T) {
+		id := strings.Split(resp.ApiKey, ":")[0]
+		for _, ref := range []string{id, id + ":"} {
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/apikeys/"+ref, nil)
+			router.ServeHTTP(w, req)
+			require.Equal(t, 200, w.Code)
+
+			var res api.ApiKeyResponse
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.Nil(t, err)
+			assert.Equal(t, "testsub", res.Sub)
+		}
+
+		// full key with wrong secret
+		wrongKey := api.ApiKey{Secret: algo.GenerateSecret()}
+		wrongKey.Id, _ = strconv.ParseInt(id, 10, 64)
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/apikeys/"+wrongKey.String(), nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 404, w.Code)
+	})
+
 	// list api keys
 	t.Run("list", func(t *testing.T) {
 		w = httptest.NewRecorder()
@@ -279,6 +318,86 @@ func TestListApiKeysEmpty(t *testing.T) {
 	require.Len(t, res, 2)
 }
 
+func TestSearchApiKeys(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"sub": "users:%d", "name": "key%d", "exp_sec": %d, "extra": {"tier": "%s"}}`,
+			i, i, 3600*(5-i), map[bool]string{true: "pro", false: "free"}[i%2 == 0])
+		req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "service_a", "alg": "ES256"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	search := func(body string) ([]api.ApiKeyResponse, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/apikeys/search", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var res []api.ApiKeyResponse
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res, w.Header().Get(api.NEXT_CURSOR_HEADER)
+	}
+	subs := func(keys []api.ApiKeyResponse) []string {
+		var res []string
+		for _, k := range keys {
+			res = append(res, k.Sub)
+		}
+		return res
+	}
+
+	res, _ := search(`{"sub_prefix": "users:"}`)
+	assert.Len(t, res, 5)
+	res, _ = search(`{"sub_prefix": "users_"}`)
+	assert.Len(t, res, 0)
+	res, _ = search(`{"name": "key3"}`)
+	assert.Equal(t, []string{"users:3"}, subs(res))
+	res, _ = search(`{"alg": "ES256"}`)
+	assert.Equal(t, []string{"service_a"}, subs(res))
+	res, _ = search(`{"extra": {"tier": "pro"}}`)
+	assert.Equal(t, []string{"users:0", "users:2", "users:4"}, subs(res))
+	res, _ = search(fmt.Sprintf(`{"sub_prefix": "users:", "exp_before": "%s"}`, time.Now().Add(150*time.Minute).Format(time.RFC3339)))
+	assert.Equal(t, []string{"users:3", "users:4"}, subs(res))
+
+	// page through keys sorted by expiration
+	var all []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		var page []api.ApiKeyResponse
+		page, cursor = search(fmt.Sprintf(`{"sub_prefix": "users:", "sort_by": "exp", "limit": 2, "cursor": "%s"}`, cursor))
+		assert.LessOrEqual(t, len(page), 2)
+		all = append(all, subs(page)...)
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"users:4", "users:3", "users:2", "users:1", "users:0"}, all)
+
+	page, cursor := search(`{"sort_by": "sub", "order": "desc", "limit": 3}`)
+	assert.Equal(t, []string{"users:4", "users:3", "users:2"}, subs(page))
+	page, cursor = search(fmt.Sprintf(`{"sort_by": "sub", "order": "desc", "limit": 3, "cursor": "%s"}`, cursor))
+	assert.Equal(t, []string{"users:1", "users:0", "service_a"}, subs(page))
+	assert.Equal(t, "", cursor)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/apikeys/search", strings.NewReader(`{"limit": 100000}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
 func TestExpiration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
@@ -327,3 +446,866 @@ func TestExpiration(t *testing.T) {
 	router.ServeHTTP(w, req)
 	require.Equal(t, 401, w.Code)
 }
+
+func TestScopes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "scopes": ["orders:read", "orders:write"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey string `json:"apikey"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+
+	check := func(query string, header string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check"+query, nil)
+		req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+		if header != "" {
+			req.Header.Set(api.REQUIRED_SCOPE_HEADER, header)
+		}
+		router.ServeHTTP(w, req)
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	code, body := check("", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, []interface{}{"orders:read", "orders:write"}, body["scopes"])
+
+	code, _ = check("?required_scope=orders:write", "")
+	assert.Equal(t, 200, code)
+	code, _ = check("", "orders:read orders:write")
+	assert.Equal(t, 200, code)
+
+	code, body = check("?required_scope=orders:delete", "")
+	assert.Equal(t, 403, code)
+	assert.Equal(t, api.CODE_INSUFFICIENT_SCOPE, body["code"])
+	code, _ = check("?required_scope=orders:write", "users:read")
+	assert.Equal(t, 403, code)
+
+	// invalid scope is rejected on creation
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "scopes": ["orders write"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	for name, limiter := range map[string]api.RateLimiter{
+		"memory":   api.NewMemoryRateLimiter(),
+		"postgres": api.NewPostgresRateLimiter(db),
+	} {
+		t.Run(name, func(t *testing.T) {
+			clenupDb()
+			a := api.Api{Db: db, Log: slog.Default(), RateLimiter: limiter, Config: api.Config{
+				ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+				DefaultKeyExpiration: 24 * time.Hour,
+				ManageAuthDisabled:   true,
+			}}
+			router := a.Routes("/")
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "rate_limit": 0.1, "rate_burst": 2}`))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			require.Equal(t, 200, w.Code)
+			var resp struct {
+				ApiKey string `json:"apikey"`
+			}
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+			check := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/check", nil)
+				req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			w = check()
+			require.Equal(t, 200, w.Code)
+			assert.Equal(t, "2", w.Header().Get(api.RATE_LIMIT_LIMIT_HEADER))
+			assert.Equal(t, "1", w.Header().Get(api.RATE_LIMIT_REMAINING_HEADER))
+			require.Equal(t, 200, check().Code)
+
+			w = check()
+			require.Equal(t, 429, w.Code)
+			assert.Equal(t, "10", w.Header().Get(api.RETRY_AFTER_HEADER))
+			assert.Equal(t, "0", w.Header().Get(api.RATE_LIMIT_REMAINING_HEADER))
+
+			// burst without rate is rejected
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "rate_burst": 2}`))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, 400, w.Code)
+		})
+	}
+}
+
+func TestPostgresRateLimiterCleanup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	limiter := api.NewPostgresRateLimiter(db)
+	limit := api.RateLimit{Rate: 1, Burst: 10}
+	_, err := limiter.Take(context.Background(), 1, limit)
+	require.Nil(t, err)
+	_, err = db.Exec("UPDATE rate_limit SET updated_at = NOW() - interval '2 hours' WHERE apikey_id = 1")
+	require.Nil(t, err)
+
+	limiter.CleanupInterval = 0
+	_, err = limiter.Take(context.Background(), 2, limit)
+	require.Nil(t, err)
+	count := func() int {
+		var n int
+		require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM rate_limit").Scan(&n))
+		return n
+	}
+	// idle bucket is deleted in background
+	assert.Eventually(t, func() bool { return count() == 1 }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestUsage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	usage := api.NewUsageTracker(db, time.Hour)
+	defer usage.Stop()
+	a := api.Api{Db: db, Log: slog.Default(), Usage: usage, Config: api.Config{
+		ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+		DefaultKeyExpiration: 24 * time.Hour,
+		ManageAuthDisabled:   true,
+	}}
+	router := a.Routes("/")
+
+	create := func(sub string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "`+sub+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		var resp struct {
+			ApiKey string `json:"apikey"`
+		}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.ApiKey
+	}
+	used := create("used")
+	create("unused")
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.Header.Set(api.API_KEY_DEFAULT_HEADER, used)
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+	}
+	require.Nil(t, usage.Flush(context.Background()))
+
+	apiKey, err := api.ParseApiKey(used)
+	require.Nil(t, err)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/apikeys/%d", apiKey.Id), nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var key api.ApiKeyResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &key))
+	assert.Equal(t, int64(3), key.UsageCount)
+	require.NotNil(t, key.LastUsedAt)
+	assert.WithinDuration(t, time.Now(), *key.LastUsedAt, time.Minute)
+	assert.NotEmpty(t, key.LastUsedIp)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/apikeys/search", strings.NewReader(`{"unused_days": 90}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var keys []api.ApiKeyResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &keys))
+	require.Len(t, keys, 1)
+	assert.Equal(t, "unused", keys[0].Sub)
+	assert.Nil(t, keys[0].LastUsedAt)
+	assert.Equal(t, int64(0), keys[0].UsageCount)
+}
+
+func TestAudit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "name": "key"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey string `json:"apikey"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	apiKey, err := api.ParseApiKey(resp.ApiKey)
+	require.Nil(t, err)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PATCH", fmt.Sprintf("/apikeys/%d", apiKey.Id), strings.NewReader(`{"name": "renamed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/check", nil)
+	req.Header.Set(api.API_KEY_DEFAULT_HEADER, (&api.ApiKey{Id: apiKey.Id, Secret: []byte("wrong")}).String())
+	router.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/apikeys/%d", apiKey.Id), strings.NewReader(`{"reason": "leaked"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 204, w.Code)
+
+	list := func(query string) ([]api.AuditEvent, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/audit?"+query, nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var res []api.AuditEvent
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res, w.Header().Get(api.NEXT_CURSOR_HEADER)
+	}
+	eventNames := func(events []api.AuditEvent) []string {
+		var res []string
+		for _, e := range events {
+			res = append(res, e.Event)
+		}
+		return res
+	}
+
+	events, cursor := list(fmt.Sprintf("apikey_id=%d", apiKey.Id))
+	assert.Empty(t, cursor)
+	assert.Equal(t, []string{api.AUDIT_KEY_REVOKED, api.AUDIT_AUTH_FAILED, api.AUDIT_KEY_UPDATED, api.AUDIT_KEY_CREATED}, eventNames(events))
+	assert.Equal(t, "leaked", events[0].Reason)
+	assert.Equal(t, api.REASON_INVALID_SECRET, events[1].Reason)
+	assert.JSONEq(t, `{"name": "renamed", "version": 2}`, string(events[2].Details))
+
+	events, cursor = list(fmt.Sprintf("apikey_id=%d&limit=3", apiKey.Id))
+	assert.Len(t, events, 3)
+	require.NotEmpty(t, cursor)
+	events, cursor = list(fmt.Sprintf("apikey_id=%d&limit=3&cursor=%s", apiKey.Id, cursor))
+	assert.Equal(t, []string{api.AUDIT_KEY_CREATED}, eventNames(events))
+	assert.Empty(t, cursor)
+
+	events, _ = list(fmt.Sprintf("apikey_id=%d&event=%s", apiKey.Id, api.AUDIT_AUTH_FAILED))
+	assert.Len(t, events, 1)
+
+	// audit trail can't be changed
+	_, err = db.Exec("DELETE FROM audit_event")
+	assert.NotNil(t, err)
+	_, err = db.Exec("TRUNCATE audit_event")
+	assert.NotNil(t, err)
+}
+
+type failingAuditSink struct{}
+
+func (failingAuditSink) Write(ctx context.Context, event *api.AuditEvent) error {
+	return errors.New("audit unavailable")
+}
+
+func TestAuditFailure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	a := api.Api{Db: db, Log: slog.Default(), Nonces: api.NewMemoryNonceStore(0), Config: api.Config{
+		ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+		DefaultKeyExpiration: 24 * time.Hour,
+		ManageAuthDisabled:   true,
+	}}
+	router := a.Routes("/")
+
+	create := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "audited"}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	count := func() int {
+		var n int
+		require.Nil(t, db.QueryRow("SELECT count(*) FROM apikey WHERE sub = 'audited'").Scan(&n))
+		return n
+	}
+
+	// database event is rolled back with the key if another sink fails
+	a.Audit = api.MultiAuditSink{api.NewPostgresAuditSink(db), failingAuditSink{}}
+	assert.Equal(t, 500, create())
+	assert.Equal(t, 0, count())
+	var events int
+	require.Nil(t, db.QueryRow("SELECT count(*) FROM audit_event WHERE details->>'sub' = 'audited'").Scan(&events))
+	assert.Equal(t, 0, events)
+
+	a.Audit = failingAuditSink{}
+	assert.Equal(t, 500, create())
+	assert.Equal(t, 0, count())
+
+	a.Audit = api.NewPostgresAuditSink(db)
+	assert.Equal(t, 200, create())
+	assert.Equal(t, 1, count())
+}
+
+func TestRevokeApiKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	// use cache to make sure revocation evicts cached key
+	a, err := api.NewApi(slog.Default(), db, api.Config{
+		ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+		ApiKeyQueryParamName: "apikey",
+		DefaultKeyExpiration: 24 * time.Hour,
+		CacheMaxSize:         100,
+		CacheTTL:             time.Hour,
+		ManageAuthDisabled:   true,
+	})
+	require.Nil(t, err)
+	router := a.Routes("/")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "name": "test"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey string `json:"apikey"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+	id := strings.Split(resp.ApiKey, ":")[0]
+
+	// populate cache
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/check", nil)
+	req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	// revoked_by is not accepted from body
+	req, _ = http.NewRequest("DELETE", "/apikeys/"+id, strings.NewReader(`{"revoked_by": "admin", "reason": "leaked"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 204, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/check", nil)
+	req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+
+	// second revoke is not found
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/apikeys/"+id, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/apikeys/"+resp.ApiKey, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var res api.ApiKeyResponse
+	err = json.Unmarshal(w.Body.Bytes(), &res)
+	require.Nil(t, err)
+	require.NotNil(t, res.RevokedAt)
+	// no caller identity with disabled authentication
+	assert.Equal(t, "", res.RevokedBy)
+	assert.Equal(t, "leaked", res.Reason)
+}
+
+func TestUpdateApiKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	// use cache to make sure update evicts cached key
+	a, err := api.NewApi(slog.Default(), db, api.Config{
+		ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+		DefaultKeyExpiration: 24 * time.Hour,
+		CacheMaxSize:         100,
+		CacheTTL:             time.Hour,
+		ManageAuthDisabled:   true,
+	})
+	require.Nil(t, err)
+	router := a.Routes("/")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "name": "test", "extra": {"tier": "free"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey string `json:"apikey"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+	id := strings.Split(resp.ApiKey, ":")[0]
+
+	check := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		var checkResp struct {
+			Extra json.RawMessage `json:"extra"`
+		}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &checkResp))
+		return string(checkResp.Extra)
+	}
+	update := func(body string) (int, api.ApiKeyResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", "/apikeys/"+id, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var keyResp api.ApiKeyResponse
+		_ = json.Unmarshal(w.Body.Bytes(), &keyResp)
+		return w.Code, keyResp
+	}
+
+	// populate cache
+	assert.Equal(t, `{"tier": "free"}`, check())
+
+	code, keyResp := update(`{"extra": {"tier": "pro"}, "name": "renamed", "exp_sec": 3600, "version": 1}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, int64(2), keyResp.Version)
+	assert.Equal(t, "renamed", keyResp.Name)
+	assert.NotNil(t, keyResp.UpdatedAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), keyResp.Exp, time.Minute)
+	assert.Equal(t, `{"tier": "pro"}`, check())
+
+	// stale version
+	code, _ = update(`{"name": "other", "version": 1}`)
+	assert.Equal(t, 409, code)
+
+	// omitted fields are unchanged, null removes extra
+	code, keyResp = update(`{"extra": null}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, "renamed", keyResp.Name)
+	assert.Equal(t, int64(3), keyResp.Version)
+	assert.Equal(t, "", check())
+
+	code, _ = update(`{"exp_sec": -1}`)
+	assert.Equal(t, 400, code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PATCH", "/apikeys/999999", strings.NewReader(`{"name": "x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestImportJWK(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	alg := algo.GetSignAlgorithm("ES256K")
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	jwk, err := alg.PublicKeyToJWK(keys.Public)
+	require.Nil(t, err)
+	jwk.Alg = "ES256K"
+	body, err := json.Marshal(map[string]any{"sub": "testsub", "publickey": jwk})
+	require.Nil(t, err)
+
+	// alg is taken from JWK
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey       string    `json:"apikey"`
+		PublicKeyJWK *algo.JWK `json:"publickey_jwk"`
+		PrivateKey   string    `json:"privatekey"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Empty(t, resp.PrivateKey)
+	id := strings.Split(resp.ApiKey, ":")[0]
+	require.NotNil(t, resp.PublicKeyJWK)
+	assert.Equal(t, id, resp.PublicKeyJWK.Kid)
+	assert.Equal(t, jwk.X, resp.PublicKeyJWK.X)
+
+	// imported key verifies signatures
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+	req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+	timestampStr := fmt.Sprintf("%d", time.Now().Unix())
+	req.Header.Set(api.TIMESTAMP_DEFAULT_HEADER, timestampStr)
+	signatureBytes, err := alg.Sign(keys.Private, append([]byte("testdata"), []byte(timestampStr)...))
+	require.Nil(t, err)
+	req.Header.Set(api.SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signatureBytes))
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	getJWKS := func() algo.JWKS {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/apikeys/"+id+"/jwks", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		var jwks algo.JWKS
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+		return jwks
+	}
+	jwks := getJWKS()
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, *resp.PublicKeyJWK, jwks.Keys[0])
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/apikeys/"+id, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var keyResp api.ApiKeyResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &keyResp))
+	assert.Equal(t, resp.PublicKeyJWK, keyResp.KeyJWK)
+
+	// JWK doesn't match alg
+	w = httptest.NewRecorder()
+	body, _ = json.Marshal(map[string]any{"sub": "testsub", "alg": "ES256", "publickey": jwk})
+	req, _ = http.NewRequest("POST", "/apikeys", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	// revoked key is not published
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/apikeys/"+id, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 204, w.Code)
+	assert.Empty(t, getJWKS().Keys)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/apikeys/999999/jwks", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestRegisterEthereumAddress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	alg := algo.GetSignAlgorithm("ETH")
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	address, err := alg.(algo.AddressAlgorithm).Address(keys.Public)
+	require.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	body, _ := json.Marshal(map[string]any{"sub": "testsub", "alg": "ETH", "address": address})
+	req, _ := http.NewRequest("POST", "/apikeys", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey       string    `json:"apikey"`
+		Address      string    `json:"address"`
+		PublicKey    string    `json:"publickey"`
+		PublicKeyJWK *algo.JWK `json:"publickey_jwk"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, address, resp.Address)
+	assert.Empty(t, resp.PublicKey)
+	assert.Nil(t, resp.PublicKeyJWK)
+	id := strings.Split(resp.ApiKey, ":")[0]
+
+	// signer is recovered from signature
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+	req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+	timestampStr := fmt.Sprintf("%d", time.Now().Unix())
+	req.Header.Set(api.TIMESTAMP_DEFAULT_HEADER, timestampStr)
+	signatureBytes, err := alg.Sign(keys.Private, append([]byte("testdata"), []byte(timestampStr)...))
+	require.Nil(t, err)
+	req.Header.Set(api.SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signatureBytes))
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/apikeys/"+id, nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var keyResp api.ApiKeyResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &keyResp))
+	assert.Equal(t, address, keyResp.Address)
+	assert.Nil(t, keyResp.KeyJWK)
+}
+
+func TestRotateApiKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "name": "test"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey string `json:"apikey"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+	oldKey := resp.ApiKey
+	id := strings.Split(oldKey, ":")[0]
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/apikeys/"+id+"/rotate", strings.NewReader(`{"grace_sec": 2}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var rotateResp struct {
+		ApiKey      string    `json:"apikey"`
+		PreviousExp time.Time `json:"previous_exp"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &rotateResp)
+	require.Nil(t, err)
+	require.NotEqual(t, oldKey, rotateResp.ApiKey)
+	require.True(t, strings.HasPrefix(rotateResp.ApiKey, id+":"))
+
+	check := func(key string) (int, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.Header.Set(api.API_KEY_DEFAULT_HEADER, key)
+		router.ServeHTTP(w, req)
+		var checkResp struct {
+			MatchedSecret string `json:"matched_secret"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &checkResp)
+		return w.Code, checkResp.MatchedSecret
+	}
+
+	code, matched := check(rotateResp.ApiKey)
+	require.Equal(t, 200, code)
+	assert.Equal(t, api.SECRET_CURRENT, matched)
+
+	code, matched = check(oldKey)
+	require.Equal(t, 200, code)
+	assert.Equal(t, api.SECRET_PREVIOUS, matched)
+
+	// wait for grace period to end
+	time.Sleep(2 * time.Second)
+
+	code, _ = check(oldKey)
+	require.Equal(t, 401, code)
+	code, _ = check(rotateResp.ApiKey)
+	require.Equal(t, 200, code)
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	router := createRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "alg": "ES256", "name": "test"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey     string `json:"apikey"`
+		PrivateKey string `json:"privatekey"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+	privateKeyBytes, err := algo.Base64ToKey(resp.PrivateKey)
+	require.Nil(t, err)
+
+	verify := func(timestampStr string) (int, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+		req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+		req.Header.Set(api.TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		signatureBytes, err := algo.GetSignAlgorithm("ES256").Sign(privateKeyBytes, append([]byte("testdata"), []byte(timestampStr)...))
+		require.Nil(t, err)
+		req.Header.Set(api.SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signatureBytes))
+		router.ServeHTTP(w, req)
+		var errResp struct {
+			Code string `json:"code"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &errResp)
+		return w.Code, errResp.Code
+	}
+
+	code, _ := verify(fmt.Sprintf("%d", time.Now().UnixMilli()))
+	assert.Equal(t, 200, code)
+
+	code, _ = verify(time.Now().Format(time.RFC3339))
+	assert.Equal(t, 200, code)
+
+	code, errCode := verify(fmt.Sprintf("%d", time.Now().Add(-10*time.Minute).Unix()))
+	assert.Equal(t, 401, code)
+	assert.Equal(t, api.CODE_TIMESTAMP_EXPIRED, errCode)
+
+	code, errCode = verify(fmt.Sprintf("%d", time.Now().Add(10*time.Minute).Unix()))
+	assert.Equal(t, 401, code)
+	assert.Equal(t, api.CODE_TIMESTAMP_IN_FUTURE, errCode)
+
+	code, errCode = verify("yesterday")
+	assert.Equal(t, 401, code)
+	assert.Equal(t, api.CODE_TIMESTAMP_INVALID, errCode)
+}
+
+func TestVerifyNonce(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+
+	for name, nonces := range map[string]api.NonceStore{
+		"memory":   api.NewMemoryNonceStore(0),
+		"postgres": api.NewPostgresNonceStore(db),
+	} {
+		t.Run(name, func(t *testing.T) {
+			a := api.Api{Db: db, Log: slog.Default(), Nonces: nonces, Config: api.Config{
+				ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+				TimestampExpiration:  5 * time.Minute,
+				DefaultKeyExpiration: 24 * time.Hour,
+				ManageAuthDisabled:   true,
+			}}
+			router := a.Routes("/")
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "alg": "ES256", "name": "test"}`))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			require.Equal(t, 200, w.Code)
+			var resp struct {
+				ApiKey     string `json:"apikey"`
+				PrivateKey string `json:"privatekey"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			require.Nil(t, err)
+			privateKeyBytes, err := algo.Base64ToKey(resp.PrivateKey)
+			require.Nil(t, err)
+
+			timestampStr := fmt.Sprintf("%d", time.Now().Unix())
+			verify := func(nonce string) (int, string) {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+				req.Header.Set(api.API_KEY_DEFAULT_HEADER, resp.ApiKey)
+				req.Header.Set(api.TIMESTAMP_DEFAULT_HEADER, timestampStr)
+				req.Header.Set(api.NONCE_DEFAULT_HEADER, nonce)
+				signatureBytes, err := algo.GetSignAlgorithm("ES256").Sign(privateKeyBytes, []byte("testdata"+timestampStr+"\n"+nonce+"\n"))
+				require.Nil(t, err)
+				req.Header.Set(api.SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signatureBytes))
+				router.ServeHTTP(w, req)
+				var errResp struct {
+					Code string `json:"code"`
+				}
+				_ = json.Unmarshal(w.Body.Bytes(), &errResp)
+				return w.Code, errResp.Code
+			}
+
+			code, _ := verify("nonce1")
+			require.Equal(t, 200, code)
+
+			code, errCode := verify("nonce1")
+			require.Equal(t, 401, code)
+			assert.Equal(t, api.CODE_NONCE_REUSED, errCode)
+
+			code, _ = verify("nonce2")
+			require.Equal(t, 200, code)
+		})
+	}
+}
+
+func TestVerifyCanonical(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	clenupDb()
+	a := api.Api{Db: db, Log: slog.Default(), Config: api.Config{
+		ApiKeyHeaderName:     api.API_KEY_DEFAULT_HEADER,
+		ApiKeyQueryParamName: api.API_KEY_DEFAULT_QUERY_PARAM,
+		TimestampExpiration:  5 * time.Minute,
+		DefaultKeyExpiration: 24 * time.Hour,
+		SignedHeaders:        []string{"Content-Type"},
+		ManageAuthDisabled:   true,
+		TrustedProxies:       []string{"10.0.0.1"},
+	}}
+	router := a.Routes("/")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/apikeys", strings.NewReader(`{"sub": "testsub", "alg": "ES256", "sign_mode": "canonical"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp struct {
+		ApiKey     string `json:"apikey"`
+		PrivateKey string `json:"privatekey"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+	privateKeyBytes, err := algo.Base64ToKey(resp.PrivateKey)
+	require.Nil(t, err)
+
+	timestampStr := fmt.Sprintf("%d", time.Now().Unix())
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	canonicalReq := canonical.Request{
+		Method:        "POST",
+		URI:           "/orders?b=1&a=2",
+		Header:        header,
+		SignedHeaders: []string{"Content-Type"},
+		Body:          []byte("testdata"),
+		Timestamp:     timestampStr,
+	}
+	data, err := canonicalReq.Build()
+	require.Nil(t, err)
+	signatureBytes, err := algo.GetSignAlgorithm("ES256").Sign(privateKeyBytes, data)
+	require.Nil(t, err)
+
+	verify := func(method string, uri string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/verify?apikey="+resp.ApiKey, strings.NewReader("testdata"))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set(api.FORWARDED_METHOD_HEADER, method)
+		req.Header.Set(api.FORWARDED_URI_HEADER, uri)
+		req.Header.Set(api.TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		req.Header.Set(api.SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signatureBytes))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, verify("POST", "/orders?a=2&b=1"))
+	assert.Equal(t, 401, verify("PUT", "/orders?a=2&b=1"))
+	assert.Equal(t, 401, verify("POST", "/admin?a=2&b=1"))
+	assert.Equal(t, 401, verify("POST", "/orders?a=3&b=1"))
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaspeen/apikeyman/algo"
+)
+
+// max exp - iat of client assertion, jti is remembered until exp
+const CLIENT_ASSERTION_MAX_LIFETIME = time.Hour
+
+// audience is aud claim, single string or array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type assertionClaims struct {
+	Iat *float64 `json:"iat"`
+	Exp *float64 `json:"exp"`
+	Jti string   `json:"jti"`
+	Aud audience `json:"aud"`
+}
+
+// clientAssertion returns compact JWS from 'Authorization: Bearer' header or empty string
+func clientAssertion(c *gin.Context) string {
+	scheme, token, found := strings.Cut(c.Request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.Count(token, ".") != 2 {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+/*
+isClientAssertion returns true if request is authenticated with JWT signed by key's private key.
+Bearer token sent along with API key, e.g. user JWT forwarded by client, is not an assertion,
+and assertions are not accepted at all if Config.ClientAssertionAudience is empty.
+*/
+func (a *Api) isClientAssertion(c *gin.Context) bool {
+	return len(a.Config.ClientAssertionAudience) > 0 && a.apiKeyString(c) == "" && clientAssertion(c) != ""
+}
+
+/*
+verifyClientAssertion validates JWT signed with key's private key like RFC 7523 client assertion.
+Key is looked up by kid header, alg must match key algorithm, iat, exp, jti and aud claims are required.
+No API key secret is required.
+*/
+func (a *Api) verifyClientAssertion(c *gin.Context) {
+	jws, err := algo.ParseJWS(clientAssertion(c))
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed to parse client assertion: %s", err))
+		setAuthFailure(c, REASON_INVALID_KEY)
+		respondUnauthorized(c)
+		return
+	}
+
+	id, err := strconv.ParseInt(jws.Header.Kid, 10, 64)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Invalid kid: %s", jws.Header.Kid))
+		setAuthFailure(c, REASON_INVALID_KEY)
+		respondUnauthorized(c)
+		return
+	}
+	c.Set(AUDIT_APIKEY_ID_CONTEXT_KEY, id)
+
+	row, err := a.getApiKeyForVerify(c.Request.Context(), id)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed to load api key: %s", err))
+		setAuthFailure(c, REASON_UNKNOWN_KEY)
+		respondUnauthorized(c)
+		return
+	}
+	apiKeyData := &apiKeyData{GetApiKeyForVerifyRow: row}
+	c.Set(ALG_CONTEXT_KEY, string(row.Alg.AlgType))
+
+	algName := string(apiKeyData.Alg.AlgType)
+	alg := algo.GetSignAlgorithm(algName)
+	if alg == nil {
+		slog.Debug(fmt.Sprintf("Key has no signature algorithm: %d", id))
+		respondUnauthorized(c)
+		return
+	}
+	if jws.Header.Alg != algName {
+		slog.Debug(fmt.Sprintf("Algorithm mismatch: %s, key algorithm: %s", jws.Header.Alg, algName))
+		respondUnauthorized(c)
+		return
+	}
+
+	var claims assertionClaims
+	if err := json.Unmarshal(jws.Payload, &claims); err != nil {
+		slog.Debug(fmt.Sprintf("Invalid client assertion claims: %s", err))
+		respondUnauthorized(c)
+		return
+	}
+	if claims.Iat == nil || claims.Exp == nil {
+		slog.Debug("Client assertion iat and exp are required")
+		respondUnauthorizedWithCode(c, CODE_TIMESTAMP_INVALID)
+		return
+	}
+	now := time.Now()
+	iat := time.Unix(int64(*claims.Iat), 0)
+	exp := time.Unix(int64(*claims.Exp), 0)
+	if code := a.checkTimestamp(iat, now); code != "" {
+		slog.Debug(fmt.Sprintf("Client assertion iat out of range: %d, %s", iat.Unix(), code))
+		respondUnauthorizedWithCode(c, code)
+		return
+	}
+	if exp.Sub(iat) > CLIENT_ASSERTION_MAX_LIFETIME {
+		slog.Debug(fmt.Sprintf("Client assertion lifetime is too long: %s", exp.Sub(iat)))
+		respondUnauthorizedWithCode(c, CODE_TIMESTAMP_INVALID)
+		return
+	}
+	if !now.Before(exp) {
+		respondUnauthorizedWithCode(c, CODE_SIGNATURE_EXPIRED)
+		return
+	}
+	if claims.Jti == "" {
+		slog.Debug("Client assertion jti is required")
+		respondUnauthorized(c)
+		return
+	}
+	if len(claims.Jti) > MAX_NONCE_LENGTH {
+		slog.Debug(fmt.Sprintf("Client assertion jti is too long: %d", len(claims.Jti)))
+		respondUnauthorizedWithCode(c, CODE_NONCE_INVALID)
+		return
+	}
+	accepted := a.Config.ClientAssertionAudience
+	if !slices.ContainsFunc(claims.Aud, func(aud string) bool { return slices.Contains(accepted, aud) }) {
+		slog.Debug(fmt.Sprintf("Client assertion audience %v, accepted %v", []string(claims.Aud), accepted))
+		respondUnauthorizedWithCode(c, CODE_INVALID_AUDIENCE)
+		return
+	}
+
+	if err := jws.Verify(alg, apiKeyData.Key); err != nil {
+		slog.Debug(fmt.Sprintf("Failed to validate client assertion signature: %s", err))
+		setAuthFailure(c, REASON_INVALID_SIGNATURE)
+		respondUnauthorized(c)
+		return
+	}
+
+	// limit only after signature is valid, kid alone must not be enough to exhaust the limit
+	if err := a.takeRateLimit(c, row); err != nil {
+		respondAuthError(c, err)
+		return
+	}
+
+	if a.Nonces != nil {
+		ok, err := a.Nonces.Use(c.Request.Context(), apiKeyData.ID, claims.Jti, time.Until(exp))
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to check jti: %s", err))
+			respondInternalServerError(c)
+			return
+		}
+		if !ok {
+			slog.Debug(fmt.Sprintf("Client assertion jti reused: %s", claims.Jti))
+			respondUnauthorizedWithCode(c, CODE_NONCE_REUSED)
+			return
+		}
+	}
+
+	verified := true
+	a.respondAuthorized(c, apiKeyData, &verified)
+}
@@ -0,0 +1,399 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaspeen/apikeyman/db"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/sqlc-dev/pqtype"
+)
+
+const (
+	AUDIT_KEY_CREATED = "key_created"
+	AUDIT_KEY_UPDATED = "key_updated"
+	AUDIT_KEY_REVOKED = "key_revoked"
+	AUDIT_KEY_ROTATED = "key_rotated"
+	AUDIT_AUTH_FAILED = "auth_failed"
+
+	// auth failure reasons in addition to error codes returned in response body
+	REASON_MISSING_KEY       = "missing_key"
+	REASON_INVALID_KEY       = "invalid_key"
+	REASON_UNKNOWN_KEY       = "unknown_key"
+	REASON_INVALID_SECRET    = "invalid_secret"
+	REASON_INVALID_SIGNATURE = "invalid_signature"
+	REASON_NOT_ADMIN         = "not_admin"
+
+	// gin context keys for audit of failed authentication
+	AUDIT_APIKEY_ID_CONTEXT_KEY = "audit_apikey_id"
+	AUDIT_REASON_CONTEXT_KEY    = "audit_reason"
+
+	AUDIT_DEFAULT_LIMIT = 100
+	AUDIT_MAX_LIMIT     = 1000
+
+	// auth failure events waiting to be written, more are dropped
+	AUTH_FAILURE_AUDIT_QUEUE_SIZE = 1000
+)
+
+type AuditEvent struct {
+	Id       int64           `json:"id,omitempty"`
+	Time     time.Time       `json:"time"`
+	Event    string          `json:"event"`
+	ApiKeyId int64           `json:"apikey_id,omitempty"`
+	Actor    string          `json:"actor,omitempty"`
+	Ip       string          `json:"ip,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Details  json.RawMessage `json:"details,omitempty"`
+}
+
+// AuditSink stores audit events
+type AuditSink interface {
+	Write(ctx context.Context, event *AuditEvent) error
+}
+
+// TxAuditSink can store audit events in the transaction of the audited change
+type TxAuditSink interface {
+	WriteTx(ctx context.Context, tx queries.DBTX, event *AuditEvent) error
+}
+
+// PostgresAuditSink appends events to audit_event table, setting event id
+type PostgresAuditSink struct {
+	Db *sql.DB
+}
+
+func NewPostgresAuditSink(sqlDb *sql.DB) *PostgresAuditSink {
+	return &PostgresAuditSink{Db: sqlDb}
+}
+
+func (s *PostgresAuditSink) Write(ctx context.Context, event *AuditEvent) error {
+	return s.WriteTx(ctx, s.Db, event)
+}
+
+func (s *PostgresAuditSink) WriteTx(ctx context.Context, tx queries.DBTX, event *AuditEvent) error {
+	id, err := db.Queries.InsertAuditEvent(ctx, tx, queries.InsertAuditEventParams{
+		CreatedAt: event.Time,
+		Event:     event.Event,
+		ApikeyID:  sql.NullInt64{Int64: event.ApiKeyId, Valid: event.ApiKeyId != 0},
+		Actor:     sql.NullString{String: event.Actor, Valid: event.Actor != ""},
+		Ip:        sql.NullString{String: event.Ip, Valid: event.Ip != ""},
+		Reason:    sql.NullString{String: event.Reason, Valid: event.Reason != ""},
+		Details:   pqtype.NullRawMessage{RawMessage: event.Details, Valid: event.Details != nil},
+	})
+	if err != nil {
+		return err
+	}
+	event.Id = id
+	return nil
+}
+
+// JsonLinesAuditSink writes events as JSON lines, e.g. to stdout for log shipping
+type JsonLinesAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJsonLinesAuditSink(w io.Writer) *JsonLinesAuditSink {
+	return &JsonLinesAuditSink{w: w}
+}
+
+func (s *JsonLinesAuditSink) Write(ctx context.Context, event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// MultiAuditSink writes events to all sinks in order
+type MultiAuditSink []AuditSink
+
+func (s MultiAuditSink) Write(ctx context.Context, event *AuditEvent) error {
+	var errs []error
+	for _, sink := range s {
+		if err := sink.Write(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriteTx writes event to database sinks in tx and to the others directly, stopping on first error
+func (s MultiAuditSink) WriteTx(ctx context.Context, tx queries.DBTX, event *AuditEvent) error {
+	for _, sink := range s {
+		if err := writeAuditTx(ctx, sink, tx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAuditTx(ctx context.Context, sink AuditSink, tx queries.DBTX, event *AuditEvent) error {
+	if txSink, ok := sink.(TxAuditSink); ok {
+		return txSink.WriteTx(ctx, tx, event)
+	}
+	return sink.Write(ctx, event)
+}
+
+// NewAuditSink writes events to database if available and to w if not nil
+func NewAuditSink(sqlDb *sql.DB, w io.Writer) AuditSink {
+	var sinks MultiAuditSink
+	if sqlDb != nil {
+		sinks = append(sinks, NewPostgresAuditSink(sqlDb))
+	}
+	if w != nil {
+		sinks = append(sinks, NewJsonLinesAuditSink(w))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return sinks
+}
+
+/*
+AsyncAuditSink writes events to sink in background through bounded queue, so bursts of
+events don't slow down requests. Events are dropped if the queue is full.
+*/
+type AsyncAuditSink struct {
+	sink    AuditSink
+	events  chan *AuditEvent
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewAsyncAuditSink(sink AuditSink, size int) *AsyncAuditSink {
+	s := &AsyncAuditSink{
+		sink:   sink,
+		events: make(chan *AuditEvent, size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write enqueues event without waiting for it to be written
+func (s *AsyncAuditSink) Write(ctx context.Context, event *AuditEvent) error {
+	select {
+	case s.events <- event:
+	default:
+		s.dropped.Add(1)
+	}
+	return nil
+}
+
+// Stop stops background writing and writes queued events
+func (s *AsyncAuditSink) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *AsyncAuditSink) run() {
+	defer close(s.done)
+	for {
+		select {
+		case e := <-s.events:
+			s.write(e)
+		case <-s.stop:
+			for {
+				select {
+				case e := <-s.events:
+					s.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *AsyncAuditSink) write(e *AuditEvent) {
+	if err := s.sink.Write(context.Background(), e); err != nil {
+		slog.Error(fmt.Sprintf("Failed to write audit event: %s", err))
+	}
+	if dropped := s.dropped.Swap(0); dropped > 0 {
+		slog.Warn("Audit events dropped, queue is full", "count", dropped)
+	}
+}
+
+// audit writes event for the request, failures are logged and don't fail the request
+func (a *Api) audit(c *gin.Context, event string, apiKeyId int64, reason string, details any) {
+	if a.Audit == nil {
+		return
+	}
+	if err := a.Audit.Write(c.Request.Context(), newAuditEvent(c, event, apiKeyId, reason, details)); err != nil {
+		slog.Error(fmt.Sprintf("Failed to write audit event: %s", err))
+	}
+}
+
+/*
+auditTx writes event for the change made in tx. Database sinks write it in tx, so the event is
+committed together with the change. Error is returned if any sink fails, the change must be rolled back then.
+*/
+func (a *Api) auditTx(c *gin.Context, tx queries.DBTX, event string, apiKeyId int64, reason string, details any) error {
+	if a.Audit == nil {
+		return nil
+	}
+	err := writeAuditTx(c.Request.Context(), a.Audit, tx, newAuditEvent(c, event, apiKeyId, reason, details))
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	return nil
+}
+
+func newAuditEvent(c *gin.Context, event string, apiKeyId int64, reason string, details any) *AuditEvent {
+	e := &AuditEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		ApiKeyId: apiKeyId,
+		Actor:    actor(c),
+		Ip:       c.ClientIP(),
+		Reason:   reason,
+	}
+	if details != nil {
+		data, err := json.Marshal(details)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to marshal audit event details: %s", err))
+		} else {
+			e.Details = data
+		}
+	}
+	return e
+}
+
+// setAuthFailure remembers why authentication failed for audit
+func setAuthFailure(c *gin.Context, reason string) {
+	c.Set(AUDIT_REASON_CONTEXT_KEY, reason)
+}
+
+/*
+auditAuthFailures is a middleware writing auth_failed event if request is rejected with 401, 403 or 429.
+Anonymous clients can produce these at high rate, so events are queued to authFailureAudit if set.
+*/
+func (a *Api) auditAuthFailures(c *gin.Context) {
+	c.Next()
+	status := c.Writer.Status()
+	if status != 401 && status != 403 && status != 429 {
+		return
+	}
+	reason := c.GetString(AUDIT_REASON_CONTEXT_KEY)
+	if reason == "" {
+		reason = outcome(status)
+	}
+	if a.authFailureAudit == nil {
+		a.audit(c, AUDIT_AUTH_FAILED, c.GetInt64(AUDIT_APIKEY_ID_CONTEXT_KEY), reason, nil)
+		return
+	}
+	a.authFailureAudit.Write(context.Background(), newAuditEvent(c, AUDIT_AUTH_FAILED, c.GetInt64(AUDIT_APIKEY_ID_CONTEXT_KEY), reason, nil))
+}
+
+type listAuditEventsRequest struct {
+	Event    string     `form:"event"`
+	ApiKeyId int64      `form:"apikey_id"`
+	Actor    string     `form:"actor"`
+	Ip       string     `form:"ip"`
+	Since    *time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until    *time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	// id of the last event of the previous page
+	Cursor string `form:"cursor"`
+	Limit  int    `form:"limit"`
+}
+
+func (p *listAuditEventsRequest) Validate() error {
+	if p.Limit < 0 || p.Limit > AUDIT_MAX_LIMIT {
+		return fmt.Errorf("'limit' must be between 0 and %d", AUDIT_MAX_LIMIT)
+	}
+	if p.Cursor != "" {
+		if _, err := strconv.ParseInt(p.Cursor, 10, 64); err != nil {
+			return errors.New("invalid 'cursor'")
+		}
+	}
+	return nil
+}
+
+func (p *listAuditEventsRequest) searchParams() queries.SearchAuditEventsParams {
+	params := queries.SearchAuditEventsParams{
+		Event:    sql.NullString{String: p.Event, Valid: p.Event != ""},
+		ApikeyID: sql.NullInt64{Int64: p.ApiKeyId, Valid: p.ApiKeyId != 0},
+		Actor:    sql.NullString{String: p.Actor, Valid: p.Actor != ""},
+		Ip:       sql.NullString{String: p.Ip, Valid: p.Ip != ""},
+		PageSize: AUDIT_DEFAULT_LIMIT,
+	}
+	if p.Since != nil {
+		params.Since = sql.NullTime{Time: *p.Since, Valid: true}
+	}
+	if p.Until != nil {
+		params.Until = sql.NullTime{Time: *p.Until, Valid: true}
+	}
+	if p.Cursor != "" {
+		cursor, _ := strconv.ParseInt(p.Cursor, 10, 64)
+		params.CursorID = sql.NullInt64{Int64: cursor, Valid: true}
+	}
+	if p.Limit > 0 {
+		params.PageSize = int32(p.Limit)
+	}
+	return params
+}
+
+func newAuditEventResponse(e *queries.AuditEvent) AuditEvent {
+	return AuditEvent{
+		Id:       e.ID,
+		Time:     e.CreatedAt,
+		Event:    e.Event,
+		ApiKeyId: e.ApikeyID.Int64,
+		Actor:    e.Actor.String,
+		Ip:       e.Ip.String,
+		Reason:   e.Reason.String,
+		Details:  e.Details.RawMessage,
+	}
+}
+
+// ListAuditEvents returns events newest first, X-Next-Cursor header is set if there are more
+func (a *Api) ListAuditEvents(c *gin.Context) {
+	var req listAuditEventsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		slog.Debug(fmt.Sprintf("Failed to bind audit query: %s", err))
+		respondInvalidRequest(c)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		c.JSON(400, errorResponse{Error: err.Error()})
+		return
+	}
+
+	params := req.searchParams()
+	pageSize := params.PageSize
+	// fetch one more to know if there is next page
+	params.PageSize++
+
+	events, err := db.Queries.SearchAuditEvents(c.Request.Context(), a.Db, params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to search audit events: %s", err))
+		respondInternalServerError(c)
+		return
+	}
+
+	if len(events) > int(pageSize) {
+		events = events[:pageSize]
+		c.Header(NEXT_CURSOR_HEADER, strconv.FormatInt(events[len(events)-1].ID, 10))
+	}
+
+	res := make([]AuditEvent, 0, len(events))
+	for i := range events {
+		res = append(res, newAuditEventResponse(&events[i]))
+	}
+	c.JSON(200, res)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditAuthFailures(t *testing.T) {
+	a := newTestApi(t, Config{})
+	var out bytes.Buffer
+	a.Audit = NewJsonLinesAuditSink(&out)
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:     1,
+		Scopes: []string{"read"},
+	})
+	router := a.Routes("/")
+
+	check := func(apiKey string, scope string) *AuditEvent {
+		out.Reset()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if apiKey != "" {
+			req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		}
+		if scope != "" {
+			req.Header.Set(REQUIRED_SCOPE_HEADER, scope)
+		}
+		router.ServeHTTP(w, req)
+		if out.Len() == 0 {
+			return nil
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.Len(t, lines, 1)
+		var event AuditEvent
+		require.Nil(t, json.Unmarshal([]byte(lines[0]), &event))
+		return &event
+	}
+
+	assert.Nil(t, check(apiKey, ""))
+
+	event := check((&ApiKey{Id: 1, Secret: algo.GenerateSecret()}).String(), "")
+	require.NotNil(t, event)
+	assert.Equal(t, AUDIT_AUTH_FAILED, event.Event)
+	assert.Equal(t, REASON_INVALID_SECRET, event.Reason)
+	assert.Equal(t, int64(1), event.ApiKeyId)
+	assert.Equal(t, "10.0.0.1", event.Ip)
+
+	event = check(apiKey, "write")
+	require.NotNil(t, event)
+	assert.Equal(t, CODE_INSUFFICIENT_SCOPE, event.Reason)
+
+	event = check("", "")
+	require.NotNil(t, event)
+	assert.Equal(t, REASON_MISSING_KEY, event.Reason)
+	assert.Equal(t, int64(0), event.ApiKeyId)
+
+	event = check("invalid", "")
+	require.NotNil(t, event)
+	assert.Equal(t, REASON_INVALID_KEY, event.Reason)
+}
+
+func TestAuditClientIp(t *testing.T) {
+	a := newTestApi(t, Config{TrustedProxies: []string{"10.0.0.1"}})
+	var out bytes.Buffer
+	a.Audit = NewJsonLinesAuditSink(&out)
+	router := a.Routes("/")
+
+	ip := func(remoteAddr string) string {
+		out.Reset()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		router.ServeHTTP(w, req)
+		var event AuditEvent
+		require.Nil(t, json.Unmarshal(out.Bytes(), &event))
+		return event.Ip
+	}
+
+	assert.Equal(t, "1.2.3.4", ip("10.0.0.1:1234"))
+	// forwarded header of untrusted client is ignored
+	assert.Equal(t, "10.0.0.2", ip("10.0.0.2:1234"))
+}
+
+// blockingAuditSink records events, blocking until released
+type blockingAuditSink struct {
+	started chan struct{}
+	release chan struct{}
+	events  []*AuditEvent
+}
+
+func (s *blockingAuditSink) Write(ctx context.Context, event *AuditEvent) error {
+	if len(s.events) == 0 {
+		close(s.started)
+		<-s.release
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestAsyncAuditSink(t *testing.T) {
+	sink := &blockingAuditSink{started: make(chan struct{}), release: make(chan struct{})}
+	async := NewAsyncAuditSink(sink, 2)
+
+	assert.Nil(t, async.Write(context.Background(), &AuditEvent{Reason: "1"}))
+	<-sink.started
+	// first event is being written, two are queued and the rest are dropped
+	for _, reason := range []string{"2", "3", "4", "5"} {
+		assert.Nil(t, async.Write(context.Background(), &AuditEvent{Reason: reason}))
+	}
+	assert.Equal(t, int64(2), async.dropped.Load())
+
+	close(sink.release)
+	async.Stop()
+	require.Len(t, sink.events, 3)
+	for i, reason := range []string{"1", "2", "3"} {
+		assert.Equal(t, reason, sink.events[i].Reason)
+	}
+}
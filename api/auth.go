@@ -0,0 +1,129 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ROLE_ADMIN = "admin"
+
+	// gin context key for authenticated management api caller
+	ACTOR_CONTEXT_KEY = "actor"
+)
+
+var ErrForbidden = errors.New("Forbidden")
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// single address
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s': %w", cidr, err)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+// isTrustedProxy checks the address against Config.TrustedProxies, the same proxies gin trusts for client ip
+func (a *Api) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	// validated by NewApi
+	trustedProxies, _ := parseTrustedProxies(a.Config.TrustedProxies)
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+authenticateAdmin returns actor name for management api caller. Accepted credentials in order:
+  - client certificate verified by configured client CA with common name from Config.AdminCertSubjects
+  - Config.AdminProxyHeader set by proxy from Config.TrustedProxies
+  - API key with admin role
+*/
+func (a *Api) authenticateAdmin(c *gin.Context) (string, error) {
+	if tlsState := c.Request.TLS; tlsState != nil && len(tlsState.VerifiedChains) > 0 && len(tlsState.VerifiedChains[0]) > 0 {
+		cn := tlsState.VerifiedChains[0][0].Subject.CommonName
+		// client CA may issue certificates for other purposes, so only listed subjects are admins
+		for _, subject := range a.Config.AdminCertSubjects {
+			if subject == cn {
+				return "cert:" + cn, nil
+			}
+		}
+	}
+
+	if a.Config.AdminProxyHeader != "" {
+		if user := c.Request.Header.Get(a.Config.AdminProxyHeader); user != "" {
+			// header must be set by the proxy itself, not by a client behind it
+			if a.isTrustedProxy(c.RemoteIP()) {
+				return "proxy:" + user, nil
+			}
+			slog.Warn("Admin header from untrusted address", "addr", c.RemoteIP())
+		}
+	}
+
+	apiKeyData, err := a.checkAndGetApiKeyData(c)
+	if err != nil {
+		if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrRateLimiterFailed) {
+			return "", err
+		}
+		return "", ErrUnauthorized
+	}
+	if apiKeyData.Role.String != ROLE_ADMIN {
+		setAuthFailure(c, REASON_NOT_ADMIN)
+		return "", ErrForbidden
+	}
+	return "apikey:" + strconv.FormatInt(apiKeyData.ID, 10), nil
+}
+
+// RequireAdmin is a middleware protecting management api
+func (a *Api) RequireAdmin(c *gin.Context) {
+	if a.Config.ManageAuthDisabled {
+		c.Next()
+		return
+	}
+	actor, err := a.authenticateAdmin(c)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Management api authentication failed: %s", err))
+		if errors.Is(err, ErrForbidden) {
+			c.AbortWithStatusJSON(403, errorResponse{Error: "Forbidden"})
+		} else if errors.Is(err, ErrRateLimited) {
+			setAuthFailure(c, CODE_RATE_LIMITED)
+			c.AbortWithStatusJSON(429, errorResponse{Error: "Too many requests", Code: CODE_RATE_LIMITED})
+		} else if errors.Is(err, ErrRateLimiterFailed) {
+			c.AbortWithStatusJSON(500, errorResponse{Error: "Internal server error"})
+		} else {
+			c.AbortWithStatusJSON(401, errorResponse{Error: "Unauthorized"})
+		}
+		return
+	}
+	c.Set(ACTOR_CONTEXT_KEY, actor)
+	c.Next()
+}
+
+// actor returns authenticated management api caller or empty string if auth is disabled
+func actor(c *gin.Context) string {
+	return c.GetString(ACTOR_CONTEXT_KEY)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	a := newTestApi(t, Config{
+		AdminProxyHeader: "X-Admin-User",
+		TrustedProxies:   []string{"10.0.0.0/8", "127.0.0.1"},
+	})
+	adminKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:   1,
+		Role: sql.NullString{String: ROLE_ADMIN, Valid: true},
+	})
+	userKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{ID: 2})
+
+	router := a.Routes("/")
+	get := func(remoteAddr string, headers map[string]string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/apikeys/notanumber", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// passing auth reaches handler which rejects invalid key with 400
+	assert.Equal(t, 401, get("127.0.0.1:1234", nil))
+	assert.Equal(t, 401, get("127.0.0.1:1234", map[string]string{API_KEY_DEFAULT_HEADER: "1:invalid"}))
+	assert.Equal(t, 403, get("127.0.0.1:1234", map[string]string{API_KEY_DEFAULT_HEADER: userKey}))
+	assert.Equal(t, 400, get("127.0.0.1:1234", map[string]string{API_KEY_DEFAULT_HEADER: adminKey}))
+	assert.Equal(t, 400, get("10.1.2.3:1234", map[string]string{"X-Admin-User": "alice"}))
+	assert.Equal(t, 401, get("192.168.1.1:1234", map[string]string{"X-Admin-User": "alice"}))
+	// forwarded address of the client is not the proxy
+	assert.Equal(t, 401, get("192.168.1.1:1234", map[string]string{"X-Admin-User": "alice", "X-Forwarded-For": "10.1.2.3"}))
+
+	a.Config.ManageAuthDisabled = true
+	assert.Equal(t, 400, get("192.168.1.1:1234", nil))
+}
+
+func TestRequireAdminCert(t *testing.T) {
+	a := newTestApi(t, Config{})
+	router := a.Routes("/")
+	get := func(cn string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/apikeys/notanumber", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// no certificate is admin without subjects
+	assert.Equal(t, 401, get("ops"))
+
+	a.Config.AdminCertSubjects = []string{"ops"}
+	assert.Equal(t, 400, get("ops"))
+	assert.Equal(t, 401, get("service_a"))
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1", "192.168.0.1"})
+	require.Nil(t, err)
+	require.Len(t, nets, 3)
+	assert.Equal(t, "192.168.0.1/32", nets[2].String())
+	assert.Equal(t, "::1/128", nets[1].String())
+
+	_, err = parseTrustedProxies([]string{"notanip"})
+	assert.NotNil(t, err)
+}
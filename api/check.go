@@ -1,112 +1,416 @@
 package api
 
 import (
+	"context"
 	"crypto/subtle"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/canonical"
 	"github.com/jaspeen/apikeyman/db"
 	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/jaspeen/apikeyman/httpsig"
 	"github.com/jellydator/ttlcache/v3"
 )
 
-func (a *Api) checkAndGetApiKeyData(c *gin.Context) (*queries.GetApiKeyForVerifyRow, error) {
-	var apiKeyString string
+const (
+	SECRET_CURRENT  = "current"
+	SECRET_PREVIOUS = "previous"
+)
+
+type apiKeyData struct {
+	*queries.GetApiKeyForVerifyRow
+	// which secret matched: SECRET_CURRENT or SECRET_PREVIOUS during rotation grace period
+	MatchedSecret string
+}
 
-	if apiKeyString = c.Query(a.Config.ApiKeyQueryParamName); apiKeyString == "" {
-		apiKeyString = c.Request.Header.Get(a.Config.ApiKeyHeaderName)
+// matchSecret compares secret hash with current and, during rotation grace period, previous secret hash
+func matchSecret(secretHash []byte, sec []byte, prevSec []byte, prevSecExp sql.NullTime) (string, bool) {
+	if subtle.ConstantTimeCompare(secretHash, sec) == 1 {
+		return SECRET_CURRENT, true
 	}
+	if prevSec != nil && prevSecExp.Valid && time.Now().Before(prevSecExp.Time) &&
+		subtle.ConstantTimeCompare(secretHash, prevSec) == 1 {
+		return SECRET_PREVIOUS, true
+	}
+	return "", false
+}
 
-	if apiKeyString == "" {
-		return nil, ErrUnauthorized
+// apiKeyString returns API key from query parameter or header, empty if not present
+func (a *Api) apiKeyString(c *gin.Context) string {
+	if apiKeyString := c.Query(a.Config.ApiKeyQueryParamName); apiKeyString != "" {
+		return apiKeyString
 	}
+	return c.Request.Header.Get(a.Config.ApiKeyHeaderName)
+}
 
-	if a.cache != nil {
-		var cached = a.cache.Get(apiKeyString)
-		if cached != nil && !cached.IsExpired() {
-			return cached.Value(), nil
-		}
+func (a *Api) checkAndGetApiKeyData(c *gin.Context) (*apiKeyData, error) {
+	apiKeyString := a.apiKeyString(c)
+	if apiKeyString == "" {
+		setAuthFailure(c, REASON_MISSING_KEY)
+		return nil, ErrUnauthorized
 	}
 
 	apiKey, err := ParseApiKey(apiKeyString)
 
 	if err != nil {
+		setAuthFailure(c, REASON_INVALID_KEY)
 		return nil, err
 	}
+	c.Set(AUDIT_APIKEY_ID_CONTEXT_KEY, apiKey.Id)
 
 	secretHash := algo.HashSecret(apiKey.Secret)
 
-	apiKeyData, err := db.Queries.GetApiKeyForVerify(c.Request.Context(), a.Db, apiKey.Id)
-
+	row, err := a.getApiKeyForVerify(c.Request.Context(), apiKey.Id)
 	if err != nil {
+		setAuthFailure(c, REASON_UNKNOWN_KEY)
 		return nil, err
 	}
 
-	if subtle.ConstantTimeCompare(secretHash, apiKeyData.Sec) != 1 {
+	c.Set(ALG_CONTEXT_KEY, string(row.Alg.AlgType))
+
+	matched, ok := matchSecret(secretHash, row.Sec, row.PrevSec, row.PrevSecExp)
+	if !ok {
+		setAuthFailure(c, REASON_INVALID_SECRET)
 		return nil, ErrUnauthorized
 	}
 
+	if err := a.takeRateLimit(c, row); err != nil {
+		return nil, err
+	}
+
+	return &apiKeyData{GetApiKeyForVerifyRow: row, MatchedSecret: matched}, nil
+}
+
+// getApiKeyForVerify loads active key by id without checking secret
+func (a *Api) getApiKeyForVerify(ctx context.Context, id int64) (*queries.GetApiKeyForVerifyRow, error) {
+	// cache is keyed by id so revocation can evict the entry without knowing the secret
 	if a.cache != nil {
-		a.cache.Set(apiKeyString, &apiKeyData, ttlcache.DefaultTTL)
+		var cached = a.cache.Get(id)
+		if cached != nil && !cached.IsExpired() {
+			return cached.Value(), nil
+		}
 	}
 
-	return &apiKeyData, nil
+	row, err := db.Queries.GetApiKeyForVerify(ctx, a.Db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.cache != nil {
+		a.cache.Set(id, &row, ttlcache.DefaultTTL)
+	}
+
+	return &row, nil
 }
 
 type checkResponse struct {
-	Id       string          `json:"id"`
-	Sub      string          `json:"sub"`
-	Extra    json.RawMessage `json:"extra,omitempty"`
-	Verified *bool           `json:"verified,omitempty"`
+	Id            string          `json:"id"`
+	Sub           string          `json:"sub"`
+	Extra         json.RawMessage `json:"extra,omitempty"`
+	Verified      *bool           `json:"verified,omitempty"`
+	MatchedSecret string          `json:"matched_secret,omitempty"`
+	Scopes        []string        `json:"scopes,omitempty"`
+	// short-lived JWT if requested with issue_token
+	Token string `json:"token,omitempty"`
+}
+
+func newCheckResponse(apiKeyData *apiKeyData, verified *bool) checkResponse {
+	return checkResponse{
+		Id:            strconv.Itoa(int(apiKeyData.ID)),
+		Sub:           apiKeyData.Sub.String,
+		Extra:         apiKeyData.Extra.RawMessage,
+		Verified:      verified,
+		MatchedSecret: apiKeyData.MatchedSecret,
+		Scopes:        apiKeyData.Scopes,
+	}
+}
+
+// requiredScopes returns scopes requested by caller in query param and header
+func requiredScopes(c *gin.Context) []string {
+	var res []string
+	for _, v := range c.QueryArray(REQUIRED_SCOPE_QUERY_PARAM) {
+		res = append(res, strings.Fields(v)...)
+	}
+	for _, v := range c.Request.Header.Values(REQUIRED_SCOPE_HEADER) {
+		res = append(res, strings.Fields(v)...)
+	}
+	return res
+}
+
+// missingScope returns first required scope the key doesn't have or empty string
+func missingScope(required []string, scopes []string) string {
+	for _, r := range required {
+		if !slices.Contains(scopes, r) {
+			return r
+		}
+	}
+	return ""
+}
+
+// respondAuthorized returns check response and records key usage if key has all required scopes and 403 otherwise
+func (a *Api) respondAuthorized(c *gin.Context, apiKeyData *apiKeyData, verified *bool) {
+	if scope := missingScope(requiredScopes(c), apiKeyData.Scopes); scope != "" {
+		slog.Debug(fmt.Sprintf("Key %d has no required scope: %s", apiKeyData.ID, scope))
+		respondForbiddenWithCode(c, CODE_INSUFFICIENT_SCOPE)
+		return
+	}
+	if a.Usage != nil {
+		a.Usage.Record(apiKeyData.ID, c.ClientIP())
+	}
+	if c.GetBool(TOKEN_RESPONSE_CONTEXT_KEY) {
+		a.respondToken(c, apiKeyData)
+		return
+	}
+	resp := newCheckResponse(apiKeyData, verified)
+	if tokenRequested(c) {
+		token, ok := a.issueToken(c, apiKeyData)
+		if !ok {
+			return
+		}
+		resp.Token = token
+	}
+	c.JSON(200, resp)
 }
 
 func (a *Api) Check(c *gin.Context) {
 	apiKeyData, err := a.checkAndGetApiKeyData(c)
 	if err != nil {
-		respondUnauthorized(c)
+		respondAuthError(c, err)
 	} else {
-		c.JSON(200, checkResponse{Id: strconv.Itoa(int(apiKeyData.ID)), Sub: apiKeyData.Sub.String, Extra: apiKeyData.Extra.RawMessage})
+		a.respondAuthorized(c, apiKeyData, nil)
+	}
+}
+
+// timestamps bigger than this are considered to be in milliseconds, in seconds it is year 5138
+const maxUnixSecondsTimestamp = 1e11
+
+// parseTimestamp accepts unix time in seconds or milliseconds and RFC3339 strings
+func parseTimestamp(timestampStr string) (time.Time, error) {
+	if i, err := strconv.ParseInt(timestampStr, 10, 64); err == nil {
+		if i > maxUnixSecondsTimestamp || i < -maxUnixSecondsTimestamp {
+			return time.UnixMilli(i), nil
+		}
+		return time.Unix(i, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, timestampStr)
+}
+
+// checkTimestamp returns error code if timestamp differs from now more than configured expiration in any direction
+func (a *Api) checkTimestamp(timestamp time.Time, now time.Time) string {
+	expiration := a.timestampExpiration()
+	if now.Sub(timestamp) > expiration {
+		return CODE_TIMESTAMP_EXPIRED
+	}
+	if timestamp.Sub(now) > expiration {
+		return CODE_TIMESTAMP_IN_FUTURE
+	}
+	return ""
+}
+
+func (a *Api) timestampExpiration() time.Duration {
+	if a.Config.TimestampExpiration <= 0 {
+		return TIMESTAMP_DEFAULT_EXPIRATION
+	}
+	return a.Config.TimestampExpiration
+}
+
+// useNonce returns false if nonce was already used with the key while timestamp is still valid
+func (a *Api) useNonce(ctx context.Context, apiKeyId int64, nonce string, timestamp time.Time) (bool, error) {
+	if a.Nonces == nil {
+		return true, nil
+	}
+	// the request can't be replayed after its timestamp expires, so no need to remember nonce longer
+	ttl := time.Until(timestamp.Add(a.timestampExpiration()))
+	if ttl <= 0 {
+		return true, nil
 	}
+	return a.Nonces.Use(ctx, apiKeyId, nonce, ttl)
+}
+
+func (a *Api) getSignature(c *gin.Context) string {
+	if a.Config.SignatureQueryParam != "" {
+		if signature := c.Query(a.Config.SignatureQueryParam); signature != "" {
+			return signature
+		}
+	}
+	return c.Request.Header.Get(headerNameOrDefault(a.Config.SignatureHeaderName, SIGNATURE_DEFAULT_HEADER))
+}
+
+func (a *Api) getTimestamp(c *gin.Context) string {
+	if a.Config.TimestampQueryParam != "" {
+		if timestamp := c.Query(a.Config.TimestampQueryParam); timestamp != "" {
+			return timestamp
+		}
+	}
+	return c.Request.Header.Get(headerNameOrDefault(a.Config.TimestampHeaderName, TIMESTAMP_DEFAULT_HEADER))
+}
+
+func (a *Api) signMode(apiKeyData *apiKeyData) string {
+	if apiKeyData.SignMode.Valid {
+		return apiKeyData.SignMode.String
+	}
+	if a.Config.SignMode != "" {
+		return a.Config.SignMode
+	}
+	return canonical.MODE_BODY
+}
+
+// sigEncoding returns signature encoding from request header or key, DER by default
+func sigEncoding(c *gin.Context, apiKeyData *apiKeyData) (string, error) {
+	if encoding := c.Request.Header.Get(SIGNATURE_ENCODING_HEADER); encoding != "" {
+		return encoding, algo.ValidateSigEncoding(encoding)
+	}
+	if apiKeyData.SigEncoding.Valid {
+		return apiKeyData.SigEncoding.String, nil
+	}
+	return algo.SIG_ENCODING_DER, nil
+}
+
+// context key marking forwarded headers of the request as set by trusted source, e.g. restored from ext_authz attributes
+type trustedForwardedHeadersKey struct{}
+
+// forwardedHeadersTrusted returns true if original request headers are set by trusted proxy, not by client
+func (a *Api) forwardedHeadersTrusted(c *gin.Context) bool {
+	if trusted, _ := c.Request.Context().Value(trustedForwardedHeadersKey{}).(bool); trusted {
+		return true
+	}
+	return a.isTrustedProxy(c.RemoteIP())
+}
+
+/*
+originalRequest describes the request being authenticated, taking method, uri, host and scheme from proxy headers
+if they are set by trusted proxy. Otherwise client could present signature of one request for another.
+*/
+func (a *Api) originalRequest(c *gin.Context) *httpsig.Message {
+	trusted := a.forwardedHeadersTrusted(c)
+	forwarded := func(name string) string {
+		if !trusted {
+			return ""
+		}
+		return c.Request.Header.Get(name)
+	}
+	method := forwarded(FORWARDED_METHOD_HEADER)
+	if method == "" {
+		method = c.Request.Method
+	}
+	uri := forwarded(FORWARDED_URI_HEADER)
+	if uri == "" {
+		uri = forwarded(ORIGINAL_URI_HEADER)
+	}
+	if uri == "" {
+		uri = c.Request.URL.RequestURI()
+	}
+	host := forwarded(FORWARDED_HOST_HEADER)
+	if host == "" {
+		host = c.Request.Host
+	}
+	scheme := forwarded(FORWARDED_PROTO_HEADER)
+	if scheme == "" {
+		scheme = "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+	}
+	header := c.Request.Header.Clone()
+	header.Set("Host", host)
+
+	return &httpsig.Message{
+		Method:    method,
+		Scheme:    scheme,
+		Authority: host,
+		URI:       uri,
+		Header:    header,
+	}
+}
+
+func (a *Api) canonicalRequest(c *gin.Context, body []byte, timestamp string, nonce string) *canonical.Request {
+	original := a.originalRequest(c)
+	return &canonical.Request{
+		Method:            original.Method,
+		URI:               original.URI,
+		Header:            original.Header,
+		SignedHeaders:     a.Config.SignedHeaders,
+		Body:              body,
+		Timestamp:         timestamp,
+		Nonce:             nonce,
+		IgnoreQueryParams: []string{a.Config.ApiKeyQueryParamName, a.Config.SignatureQueryParam, a.Config.TimestampQueryParam},
+	}
+}
+
+func headerNameOrDefault(name string, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+/*
+bodySignedData returns data signed in body mode: body || timestamp, or body || timestamp || "\n" || nonce || "\n"
+if nonce is used. Header values can't contain new lines and timestamp can't end with one, so nonce can't be
+moved into the timestamp to replay the request without nonce.
+*/
+func bodySignedData(body []byte, timestamp string, nonce string) []byte {
+	data := append(body, timestamp...)
+	if nonce != "" {
+		data = append(data, '\n')
+		data = append(data, nonce...)
+		data = append(data, '\n')
+	}
+	return data
 }
 
 func (a *Api) verifyInternal(c *gin.Context, okIfNoSignature bool) {
+	if isHttpMessageSignature(c) {
+		a.verifyHttpMessageSignature(c)
+		return
+	}
+	if a.isClientAssertion(c) {
+		a.verifyClientAssertion(c)
+		return
+	}
+
 	apiKeyData, err := a.checkAndGetApiKeyData(c)
 	if err != nil {
 		slog.Debug(fmt.Sprintf("Failed to load api key: %s", err))
-		respondUnauthorized(c)
+		respondAuthError(c, err)
 		return
 	}
 
-	signature := c.Request.Header.Get(SIGNATURE_DEFAULT_HEADER)
+	signature := a.getSignature(c)
 	if signature == "" {
 		slog.Debug("Signature is empty")
 		if okIfNoSignature {
 			verified := false
-			c.JSON(200, checkResponse{Id: strconv.Itoa(int(apiKeyData.ID)), Sub: apiKeyData.Sub.String, Extra: apiKeyData.Extra.RawMessage, Verified: &verified})
+			a.respondAuthorized(c, apiKeyData, &verified)
 		} else {
 			respondUnauthorized(c)
 		}
 		return
 	}
-	timestampStr := c.Request.Header.Get(TIMESTAMP_DEFAULT_HEADER)
+	timestampStr := a.getTimestamp(c)
 
-	i, err := strconv.ParseInt(timestampStr, 10, 64)
+	timestamp, err := parseTimestamp(timestampStr)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Invalid timestamp: %s", timestampStr))
-		respondUnauthorized(c)
+		slog.Debug(fmt.Sprintf("Invalid timestamp: %s", timestampStr))
+		respondUnauthorizedWithCode(c, CODE_TIMESTAMP_INVALID)
 		return
 	}
-	timestamp := time.Unix(i, 0)
 
-	if time.Since(timestamp) > 5*time.Minute {
-		slog.Error(fmt.Sprintf("Expired timestamp: %s", timestampStr))
-		respondUnauthorized(c)
+	if code := a.checkTimestamp(timestamp, time.Now()); code != "" {
+		slog.Debug(fmt.Sprintf("Timestamp out of range: %s, %s", timestampStr, code))
+		respondUnauthorizedWithCode(c, code)
 		return
 	}
 
@@ -123,11 +427,29 @@ func (a *Api) verifyInternal(c *gin.Context, okIfNoSignature bool) {
 		return
 	}
 
-	dataToValidate := append(data, []byte(timestampStr)...)
+	nonce := c.Request.Header.Get(headerNameOrDefault(a.Config.NonceHeaderName, NONCE_DEFAULT_HEADER))
+	if len(nonce) > MAX_NONCE_LENGTH {
+		slog.Debug(fmt.Sprintf("Nonce is too long: %d", len(nonce)))
+		respondUnauthorizedWithCode(c, CODE_NONCE_INVALID)
+		return
+	}
+
+	signMode := a.signMode(apiKeyData)
+	var dataToValidate []byte
+	if signMode == canonical.MODE_CANONICAL {
+		dataToValidate, err = a.canonicalRequest(c, data, timestampStr, nonce).Build()
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Failed to build canonical request: %s", err))
+			respondInvalidRequest(c)
+			return
+		}
+	} else {
+		dataToValidate = bodySignedData(data, timestampStr, nonce)
+	}
 
 	if a.Log.Enabled(c.Request.Context(), slog.LevelDebug) {
 		a.Log.Debug("validate", "data", string(dataToValidate),
-			"signature", signature, "timestamp", timestampStr,
+			"signature", signature, "timestamp", timestampStr, "nonce", nonce, "mode", signMode,
 			"alg", apiKeyData.Alg.AlgType, "key", algo.KeyToBase64(apiKeyData.Key))
 	}
 
@@ -137,15 +459,41 @@ func (a *Api) verifyInternal(c *gin.Context, okIfNoSignature bool) {
 		return
 	}
 
-	err = alg.ValidateSignature(apiKeyData.Key, signatureBytes, dataToValidate)
+	encoding, err := sigEncoding(c, apiKeyData)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Invalid signature encoding: %s", err))
+		respondInvalidRequest(c)
+		return
+	}
+	signatureBytes, err = algo.DecodeSignature(alg.Name(), encoding, signatureBytes)
+	if err == nil {
+		err = alg.ValidateSignature(apiKeyData.Key, signatureBytes, dataToValidate)
+	}
 
 	if err != nil {
 		slog.Debug(fmt.Sprintf("Failed to validate signature: %s", err))
+		setAuthFailure(c, REASON_INVALID_SIGNATURE)
 		respondUnauthorized(c)
 		return
 	}
+
+	// check nonce only after signature is valid, so it can't be burned by someone without the private key
+	if nonce != "" {
+		ok, err := a.useNonce(c.Request.Context(), apiKeyData.ID, nonce, timestamp)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to check nonce: %s", err))
+			respondInternalServerError(c)
+			return
+		}
+		if !ok {
+			slog.Debug(fmt.Sprintf("Nonce reused: %s", nonce))
+			respondUnauthorizedWithCode(c, CODE_NONCE_REUSED)
+			return
+		}
+	}
+
 	verified := true
-	c.JSON(200, checkResponse{Id: strconv.Itoa(int(apiKeyData.ID)), Sub: apiKeyData.Sub.String, Extra: apiKeyData.Extra.RawMessage, Verified: &verified})
+	a.respondAuthorized(c, apiKeyData, &verified)
 }
 
 func (a *Api) Verify(c *gin.Context) {
@@ -155,3 +503,21 @@ func (a *Api) Verify(c *gin.Context) {
 func (a *Api) CheckOrVerify(c *gin.Context) {
 	a.verifyInternal(c, true)
 }
+
+/*
+newAuthorizer returns engine handling request to any path like /checkorverify, so original request
+can be replayed through it with the same key check, signature verification, rate limits, scopes, metrics and audit.
+*/
+func (a *Api) newAuthorizer(endpoint string) *gin.Engine {
+	router := gin.New()
+	a.setTrustedProxies(router)
+	router.Use(gin.Recovery())
+	router.Any("/*path", a.metrics.instrument(endpoint), a.auditAuthFailures, a.CheckOrVerify)
+	return router
+}
+
+func authorize(authorizer *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	authorizer.ServeHTTP(w, req)
+	return w
+}
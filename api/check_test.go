@@ -0,0 +1,227 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/canonical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+
+	ts, err := parseTimestamp(strconv.FormatInt(now.Unix(), 10))
+	require.Nil(t, err)
+	assert.Equal(t, now.Unix(), ts.Unix())
+
+	ts, err = parseTimestamp(strconv.FormatInt(now.UnixMilli(), 10))
+	require.Nil(t, err)
+	assert.Equal(t, now.UnixMilli(), ts.UnixMilli())
+
+	ts, err = parseTimestamp(now.Format(time.RFC3339Nano))
+	require.Nil(t, err)
+	assert.True(t, now.Equal(ts))
+
+	_, err = parseTimestamp("yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestSignModeConfig(t *testing.T) {
+	for _, mode := range []string{"", canonical.MODE_BODY, canonical.MODE_CANONICAL} {
+		_, err := NewApi(slog.Default(), nil, Config{SignMode: mode})
+		assert.Nil(t, err, mode)
+	}
+
+	_, err := NewApi(slog.Default(), nil, Config{SignMode: "canonnical"})
+	assert.ErrorIs(t, err, canonical.ErrUnknownMode)
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	a := Api{Config: Config{TimestampExpiration: time.Minute}}
+	now := time.Now()
+
+	assert.Equal(t, "", a.checkTimestamp(now, now))
+	assert.Equal(t, "", a.checkTimestamp(now.Add(-59*time.Second), now))
+	assert.Equal(t, "", a.checkTimestamp(now.Add(59*time.Second), now))
+	assert.Equal(t, CODE_TIMESTAMP_EXPIRED, a.checkTimestamp(now.Add(-61*time.Second), now))
+	assert.Equal(t, CODE_TIMESTAMP_IN_FUTURE, a.checkTimestamp(now.Add(61*time.Second), now))
+
+	// default is used if not configured
+	a = Api{}
+	assert.Equal(t, "", a.checkTimestamp(now.Add(-4*time.Minute), now))
+	assert.Equal(t, CODE_TIMESTAMP_EXPIRED, a.checkTimestamp(now.Add(-6*time.Minute), now))
+}
+
+func TestMissingScope(t *testing.T) {
+	scopes := []string{"orders:read", "orders:write"}
+	assert.Equal(t, "", missingScope(nil, scopes))
+	assert.Equal(t, "", missingScope([]string{"orders:write"}, scopes))
+	assert.Equal(t, "users:read", missingScope([]string{"orders:read", "users:read"}, scopes))
+	assert.Equal(t, "orders:read", missingScope([]string{"orders:read"}, nil))
+}
+
+func TestVerifySigEncoding(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 7, "ES384")
+	row := a.cache.Get(7).Value()
+	router := a.Routes("/")
+
+	alg := algo.GetSignAlgorithm("ES384")
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+	der, err := alg.Sign(keys.Private, []byte("testdata"+timestampStr))
+	require.Nil(t, err)
+	raw, err := algo.EncodeSignature("ES384", algo.SIG_ENCODING_RAW, der)
+	require.Nil(t, err)
+	require.Len(t, raw, 96)
+
+	verify := func(signature []byte, encoding string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		req.Header.Set(TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		req.Header.Set(SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signature))
+		if encoding != "" {
+			req.Header.Set(SIGNATURE_ENCODING_HEADER, encoding)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, verify(der, ""))
+	assert.Equal(t, 401, verify(raw, ""))
+	assert.Equal(t, 200, verify(raw, algo.SIG_ENCODING_RAW))
+	assert.Equal(t, 401, verify(der, algo.SIG_ENCODING_RAW))
+	assert.Equal(t, 400, verify(raw, "jose"))
+
+	// encoding set for the key, header overrides it
+	row.SigEncoding = sql.NullString{String: algo.SIG_ENCODING_RAW, Valid: true}
+	assert.Equal(t, 200, verify(raw, ""))
+	assert.Equal(t, 401, verify(der, ""))
+	assert.Equal(t, 200, verify(der, algo.SIG_ENCODING_DER))
+}
+
+func TestVerifyNonceLength(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 7, "ES256")
+	router := a.Routes("/")
+
+	verify := func(nonce string) *httptest.ResponseRecorder {
+		timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+		signature, err := algo.GetSignAlgorithm("ES256").Sign(keys.Private, bodySignedData([]byte("testdata"), timestampStr, nonce))
+		require.Nil(t, err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		req.Header.Set(TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		req.Header.Set(NONCE_DEFAULT_HEADER, nonce)
+		req.Header.Set(SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signature))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, verify(strings.Repeat("n", MAX_NONCE_LENGTH)).Code)
+	w := verify(strings.Repeat("n", MAX_NONCE_LENGTH+1))
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), CODE_NONCE_INVALID)
+}
+
+func TestVerifyNonceInTimestamp(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 7, "ES256")
+	router := a.Routes("/")
+
+	verify := func(timestampStr string, nonce string, signature []byte) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		req.Header.Set(TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		if nonce != "" {
+			req.Header.Set(NONCE_DEFAULT_HEADER, nonce)
+		}
+		req.Header.Set(SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signature))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := algo.GetSignAlgorithm("ES256").Sign(keys.Private, bodySignedData([]byte("testdata"), timestampStr, "123"))
+	require.Nil(t, err)
+	assert.Equal(t, 200, verify(timestampStr, "123", signature))
+	assert.Equal(t, 401, verify(timestampStr, "123", signature), "nonce reused")
+	// the same instant in milliseconds without nonce
+	assert.Equal(t, 401, verify(timestampStr+"123", "", signature))
+
+	// nonce appended without delimiter is not accepted
+	signature, err = algo.GetSignAlgorithm("ES256").Sign(keys.Private, []byte("testdata"+timestampStr+"456"))
+	require.Nil(t, err)
+	assert.Equal(t, 401, verify(timestampStr, "456", signature))
+}
+
+func TestVerifyForwardedHeadersFromUntrustedPeer(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 7, "ES256")
+	row := a.cache.Get(7).Value()
+	row.SignMode = sql.NullString{String: canonical.MODE_CANONICAL, Valid: true}
+	a.Config.TrustedProxies = []string{"10.0.0.1"}
+	router := a.Routes("/")
+
+	// signature made for POST /orders
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+	data, err := (&canonical.Request{Method: "POST", URI: "/orders", Header: http.Header{}, Timestamp: timestampStr}).Build()
+	require.Nil(t, err)
+	signature, err := algo.GetSignAlgorithm("ES256").Sign(keys.Private, data)
+	require.Nil(t, err)
+
+	verify := func(remoteAddr string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/verify", strings.NewReader(""))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		req.Header.Set(TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		req.Header.Set(SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signature))
+		req.Header.Set(FORWARDED_METHOD_HEADER, "POST")
+		req.Header.Set(FORWARDED_URI_HEADER, "/orders")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, verify("10.0.0.1:1234"))
+	// client can't present the signature for PUT /verify
+	assert.Equal(t, 401, verify("10.0.0.2:1234"))
+}
+
+func TestVerifyEthereumAddress(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 8, "ETH")
+	alg := algo.GetSignAlgorithm("ETH")
+	address, err := keyAddress("ETH", keys.Public)
+	require.Nil(t, err)
+	row := a.cache.Get(8).Value()
+	// key registered by address
+	row.Key, err = alg.(algo.AddressAlgorithm).ParseAddress(address)
+	require.Nil(t, err)
+	router := a.Routes("/")
+
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+	verify := func(privateKey []byte) int {
+		signature, err := alg.Sign(privateKey, []byte("testdata"+timestampStr))
+		require.Nil(t, err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/verify", strings.NewReader("testdata"))
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		req.Header.Set(TIMESTAMP_DEFAULT_HEADER, timestampStr)
+		req.Header.Set(SIGNATURE_DEFAULT_HEADER, base64.StdEncoding.EncodeToString(signature))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, verify(keys.Private))
+	otherKeys, err := alg.Generate()
+	require.Nil(t, err)
+	assert.Equal(t, 401, verify(otherKeys.Private))
+}
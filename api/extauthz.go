@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gin-gonic/gin"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// headers added to the request forwarded upstream when key is valid
+	EXT_AUTHZ_SUB_HEADER    = "x-auth-sub"
+	EXT_AUTHZ_KEY_ID_HEADER = "x-auth-key-id"
+	EXT_AUTHZ_EXTRA_HEADER  = "x-auth-extra"
+)
+
+// ExtAuthzServer implements Envoy ext_authz gRPC Authorization service
+type ExtAuthzServer struct {
+	authv3.UnimplementedAuthorizationServer
+	authorizer *gin.Engine
+}
+
+func NewExtAuthzServer(a *Api) *ExtAuthzServer {
+	return &ExtAuthzServer{authorizer: a.newAuthorizer("extauthz")}
+}
+
+// NewExtAuthzGrpcServer creates grpc server with ext_authz service registered
+func NewExtAuthzGrpcServer(a *Api, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	authv3.RegisterAuthorizationServer(server, NewExtAuthzServer(a))
+	return server
+}
+
+// toHttpRequest restores original request from ext_authz attributes
+func toHttpRequest(ctx context.Context, attrs *authv3.AttributeContext) (*http.Request, error) {
+	httpAttrs := attrs.GetRequest().GetHttp()
+	if httpAttrs == nil {
+		return nil, fmt.Errorf("no http request attributes")
+	}
+	body := httpAttrs.GetRawBody()
+	if body == nil {
+		body = []byte(httpAttrs.GetBody())
+	}
+	scheme := httpAttrs.GetScheme()
+	if scheme == "" {
+		scheme = "http"
+	}
+	// forwarded headers below are set from attributes
+	ctx = context.WithValue(ctx, trustedForwardedHeadersKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, httpAttrs.GetMethod(),
+		scheme+"://"+httpAttrs.GetHost()+httpAttrs.GetPath(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range httpAttrs.GetHeaders() {
+		// pseudo headers like :path are available as attributes
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	// original request is known from attributes, client must not be able to override it with forwarded headers
+	for _, name := range []string{FORWARDED_METHOD_HEADER, FORWARDED_URI_HEADER, ORIGINAL_URI_HEADER, FORWARDED_HOST_HEADER, FORWARDED_PROTO_HEADER} {
+		req.Header.Del(name)
+	}
+	req.Header.Set(FORWARDED_METHOD_HEADER, httpAttrs.GetMethod())
+	req.Header.Set(FORWARDED_URI_HEADER, httpAttrs.GetPath())
+	req.Header.Set(FORWARDED_HOST_HEADER, httpAttrs.GetHost())
+	req.Header.Set(FORWARDED_PROTO_HEADER, scheme)
+	req.Host = httpAttrs.GetHost()
+	if addr := attrs.GetSource().GetAddress().GetSocketAddress(); addr != nil {
+		req.RemoteAddr = net.JoinHostPort(addr.GetAddress(), strconv.Itoa(int(addr.GetPortValue())))
+	}
+	return req, nil
+}
+
+func headerOption(name string, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: name, Value: value},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
+
+func deniedResponse(status int, rpcCode codes.Code, header http.Header, body string) *authv3.CheckResponse {
+	var headers []*corev3.HeaderValueOption
+	for _, name := range []string{"Content-Type", RATE_LIMIT_LIMIT_HEADER, RATE_LIMIT_REMAINING_HEADER, RATE_LIMIT_RESET_HEADER, RETRY_AFTER_HEADER} {
+		if value := header.Get(name); value != "" {
+			headers = append(headers, headerOption(name, value))
+		}
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(rpcCode)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode(status)},
+			Headers: headers,
+			Body:    body,
+		}},
+	}
+}
+
+func (s *ExtAuthzServer) Check(ctx context.Context, checkRequest *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	req, err := toHttpRequest(ctx, checkRequest.GetAttributes())
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Invalid ext_authz request: %s", err))
+		return deniedResponse(400, codes.InvalidArgument, http.Header{}, ""), nil
+	}
+
+	w := authorize(s.authorizer, req)
+
+	switch {
+	case w.Code == 200:
+		var resp checkResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			return nil, grpcstatus.Errorf(codes.Internal, "invalid check response: %s", err)
+		}
+		headers := []*corev3.HeaderValueOption{
+			headerOption(EXT_AUTHZ_SUB_HEADER, resp.Sub),
+			headerOption(EXT_AUTHZ_KEY_ID_HEADER, resp.Id),
+		}
+		// client must not be able to pass own extra to upstream
+		var headersToRemove []string
+		var extra bytes.Buffer
+		if len(resp.Extra) > 0 && json.Compact(&extra, resp.Extra) == nil {
+			headers = append(headers, headerOption(EXT_AUTHZ_EXTRA_HEADER, extra.String()))
+		} else {
+			headersToRemove = append(headersToRemove, EXT_AUTHZ_EXTRA_HEADER)
+		}
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{
+				Headers:         headers,
+				HeadersToRemove: headersToRemove,
+			}},
+		}, nil
+	case w.Code == 401:
+		return deniedResponse(w.Code, codes.Unauthenticated, w.Header(), w.Body.String()), nil
+	case w.Code == 403:
+		return deniedResponse(w.Code, codes.PermissionDenied, w.Header(), w.Body.String()), nil
+	case w.Code == 429:
+		return deniedResponse(w.Code, codes.ResourceExhausted, w.Header(), w.Body.String()), nil
+	case w.Code < 500:
+		return deniedResponse(w.Code, codes.InvalidArgument, w.Header(), w.Body.String()), nil
+	default:
+		// let envoy apply its failure mode
+		return nil, grpcstatus.Error(codes.Internal, "authorization failed")
+	}
+}
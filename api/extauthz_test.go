@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/canonical"
+	"github.com/sqlc-dev/pqtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestExtAuthzCheck(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 7, "ES256")
+	row := a.cache.Get(7).Value()
+	row.Sub.String, row.Sub.Valid = "service_a", true
+	row.Extra = pqtype.NullRawMessage{RawMessage: []byte(`{"tier": "pro"}`), Valid: true}
+	server := NewExtAuthzServer(a)
+
+	check := func(headers map[string]string, body string) *authv3.CheckResponse {
+		resp, err := server.Check(context.Background(), &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+				SocketAddress: &corev3.SocketAddress{Address: "10.0.0.1", PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 1234}},
+			}}},
+			Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+				Method:  "POST",
+				Host:    "example.com",
+				Path:    "/orders?id=1",
+				Scheme:  "https",
+				Headers: headers,
+				Body:    body,
+			}},
+		}})
+		require.Nil(t, err)
+		return resp
+	}
+
+	resp := check(map[string]string{"x-api-key": apiKey, "x-auth-extra": "spoofed"}, "")
+	require.Equal(t, int32(codes.OK), resp.Status.Code)
+	headers := map[string]string{}
+	for _, h := range resp.GetOkResponse().Headers {
+		headers[h.Header.Key] = h.Header.Value
+	}
+	assert.Equal(t, "service_a", headers[EXT_AUTHZ_SUB_HEADER])
+	assert.Equal(t, "7", headers[EXT_AUTHZ_KEY_ID_HEADER])
+	assert.Equal(t, `{"tier":"pro"}`, headers[EXT_AUTHZ_EXTRA_HEADER])
+
+	resp = check(map[string]string{"x-api-key": (&ApiKey{Id: 7, Secret: algo.GenerateSecret()}).String()}, "")
+	require.Equal(t, int32(codes.Unauthenticated), resp.Status.Code)
+	assert.EqualValues(t, 401, resp.GetDeniedResponse().Status.Code)
+
+	resp = check(map[string]string{"x-api-key": apiKey, "x-required-scope": "admin"}, "")
+	require.Equal(t, int32(codes.PermissionDenied), resp.Status.Code)
+	assert.EqualValues(t, 403, resp.GetDeniedResponse().Status.Code)
+
+	// body signature
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := algo.GetSignAlgorithm("ES256").Sign(keys.Private, []byte(`{"amount": 1}`+timestamp))
+	require.Nil(t, err)
+	signed := map[string]string{
+		"x-api-key":   apiKey,
+		"x-signature": base64.StdEncoding.EncodeToString(signature),
+		"x-timestamp": timestamp,
+	}
+	resp = check(signed, `{"amount": 1}`)
+	require.Equal(t, int32(codes.OK), resp.Status.Code)
+
+	resp = check(signed, `{"amount": 1000}`)
+	require.Equal(t, int32(codes.Unauthenticated), resp.Status.Code)
+}
+
+func TestExtAuthzForgedForwardedHeaders(t *testing.T) {
+	a, keys, apiKey := newApiWithCachedKey(t, 7, "ES256")
+	row := a.cache.Get(7).Value()
+	row.SignMode = sql.NullString{String: canonical.MODE_CANONICAL, Valid: true}
+	server := NewExtAuthzServer(a)
+
+	// signature made for POST /orders
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	data, err := (&canonical.Request{Method: "POST", URI: "/orders", Header: http.Header{}, Timestamp: timestamp}).Build()
+	require.Nil(t, err)
+	signature, err := algo.GetSignAlgorithm("ES256").Sign(keys.Private, data)
+	require.Nil(t, err)
+
+	check := func(method string, path string, headers map[string]string) *authv3.CheckResponse {
+		headers["x-api-key"] = apiKey
+		headers["x-signature"] = base64.StdEncoding.EncodeToString(signature)
+		headers["x-timestamp"] = timestamp
+		resp, err := server.Check(context.Background(), &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+				Method:  method,
+				Host:    "example.com",
+				Path:    path,
+				Scheme:  "https",
+				Headers: headers,
+			}},
+		}})
+		require.Nil(t, err)
+		return resp
+	}
+
+	require.Equal(t, int32(codes.OK), check("POST", "/orders", map[string]string{}).Status.Code)
+
+	resp := check("PUT", "/admin", map[string]string{
+		"x-forwarded-method": "POST",
+		"x-forwarded-uri":    "/orders",
+		"x-original-uri":     "/orders",
+	})
+	require.Equal(t, int32(codes.Unauthenticated), resp.Status.Code)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// response headers copied by proxy to the upstream request
+	FORWARD_AUTH_SUBJECT_HEADER = "X-Auth-Subject"
+	FORWARD_AUTH_KEY_ID_HEADER  = "X-Auth-Key-Id"
+)
+
+// extraHeaderValues returns header values for configured top level extra fields, non string values are compact JSON
+func extraHeaderValues(extra json.RawMessage, headers map[string]string) map[string]string {
+	res := make(map[string]string)
+	if len(extra) == 0 || len(headers) == 0 {
+		return res
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(extra, &fields); err != nil {
+		return res
+	}
+	for field, header := range headers {
+		raw, ok := fields[field]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			res[header] = s
+			continue
+		}
+		if compact, err := json.Marshal(raw); err == nil {
+			res[header] = string(compact)
+		}
+	}
+	return res
+}
+
+/*
+forwardAuth returns handler for nginx auth_request and Traefik ForwardAuth subrequests.
+Original request is taken from X-Forwarded-Method and X-Forwarded-Uri or X-Original-URI headers
+set by proxy from Config.TrustedProxies and checked like /checkorverify. Response has no body, only status and headers.
+*/
+func (a *Api) forwardAuth() gin.HandlerFunc {
+	authorizer := a.newAuthorizer("forwardauth")
+	return func(c *gin.Context) {
+		original, err := url.ParseRequestURI(a.originalRequest(c).URI)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Invalid original uri: %s", err))
+			c.Status(400)
+			return
+		}
+		// api key and signature may be passed in original query
+		req := c.Request.Clone(c.Request.Context())
+		req.URL = original
+
+		w := authorize(authorizer, req)
+
+		for _, name := range []string{RATE_LIMIT_LIMIT_HEADER, RATE_LIMIT_REMAINING_HEADER, RATE_LIMIT_RESET_HEADER, RETRY_AFTER_HEADER} {
+			if value := w.Header().Get(name); value != "" {
+				c.Header(name, value)
+			}
+		}
+		if w.Code != 200 {
+			c.Status(w.Code)
+			return
+		}
+		var resp checkResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			slog.Error(fmt.Sprintf("Invalid check response: %s", err))
+			c.Status(500)
+			return
+		}
+		c.Header(FORWARD_AUTH_SUBJECT_HEADER, resp.Sub)
+		c.Header(FORWARD_AUTH_KEY_ID_HEADER, resp.Id)
+		for header, value := range extraHeaderValues(resp.Extra, a.Config.ForwardAuthExtraHeaders) {
+			c.Header(header, value)
+		}
+		c.Status(200)
+	}
+}
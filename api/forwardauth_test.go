@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/sqlc-dev/pqtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardAuth(t *testing.T) {
+	a := newTestApi(t, Config{
+		ApiKeyQueryParamName:    API_KEY_DEFAULT_QUERY_PARAM,
+		ForwardAuthExtraHeaders: map[string]string{"tier": "X-Auth-Tier", "limits": "X-Auth-Limits"},
+		TrustedProxies:          []string{"10.0.0.1"},
+	})
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:    1,
+		Sub:   sql.NullString{String: "service_a", Valid: true},
+		Extra: pqtype.NullRawMessage{RawMessage: []byte(`{"tier": "pro", "limits": {"rps": 10}}`), Valid: true},
+	})
+	router := a.Routes("/")
+
+	forwardAuth := func(header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/forwardauth", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for name, values := range header {
+			req.Header.Set(name, values[0])
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := forwardAuth(http.Header{
+		API_KEY_DEFAULT_HEADER:  {apiKey},
+		FORWARDED_METHOD_HEADER: {"POST"},
+		FORWARDED_URI_HEADER:    {"/orders?id=1"},
+	})
+	require.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, "service_a", w.Header().Get(FORWARD_AUTH_SUBJECT_HEADER))
+	assert.Equal(t, "1", w.Header().Get(FORWARD_AUTH_KEY_ID_HEADER))
+	assert.Equal(t, "pro", w.Header().Get("X-Auth-Tier"))
+	assert.Equal(t, `{"rps":10}`, w.Header().Get("X-Auth-Limits"))
+
+	// key in original query as nginx passes it in X-Original-URI
+	w = forwardAuth(http.Header{ORIGINAL_URI_HEADER: {"/orders?apikey=" + url.QueryEscape(apiKey)}})
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "service_a", w.Header().Get(FORWARD_AUTH_SUBJECT_HEADER))
+
+	w = forwardAuth(http.Header{API_KEY_DEFAULT_HEADER: {(&ApiKey{Id: 1, Secret: algo.GenerateSecret()}).String()}})
+	require.Equal(t, 401, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Empty(t, w.Header().Get(FORWARD_AUTH_SUBJECT_HEADER))
+
+	w = forwardAuth(http.Header{API_KEY_DEFAULT_HEADER: {apiKey}, REQUIRED_SCOPE_HEADER: {"admin"}})
+	require.Equal(t, 403, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestForwardAuthSpoofedClientIp(t *testing.T) {
+	a := newTestApi(t, Config{})
+	var out bytes.Buffer
+	a.Audit = NewJsonLinesAuditSink(&out)
+	router := a.Routes("/")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/forwardauth", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set(FORWARDED_URI_HEADER, "/orders")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+
+	var event AuditEvent
+	require.Nil(t, json.Unmarshal(out.Bytes(), &event))
+	assert.Equal(t, "10.0.0.2", event.Ip)
+}
+
+func TestExtraHeaderValues(t *testing.T) {
+	headers := map[string]string{"tier": "X-Tier", "n": "X-N", "missing": "X-Missing", "empty": "X-Empty"}
+	assert.Equal(t, map[string]string{"X-Tier": "pro", "X-N": "1"},
+		extraHeaderValues([]byte(`{"tier": "pro", "n": 1, "empty": null}`), headers))
+	assert.Empty(t, extraHeaderValues([]byte(`[1]`), headers))
+	assert.Empty(t, extraHeaderValues(nil, headers))
+}
@@ -17,6 +17,7 @@ func (a *Api) HealthReadiness(c *gin.Context) {
 	}
 }
 
+// HealthMetrics returns metrics in Prometheus text format
 func (a *Api) HealthMetrics(c *gin.Context) {
-	c.JSON(200, gin.H{})
+	a.metrics.serve(c)
 }
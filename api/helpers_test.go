@@ -0,0 +1,77 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/algo"
+	_ "github.com/jaspeen/apikeyman/algo/all"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/jaspeen/apikeyman/httpsig"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestApi creates api without database, keys are loaded only from cache, see cacheKey
+func newTestApi(t *testing.T, config Config) *Api {
+	if config.ApiKeyHeaderName == "" {
+		config.ApiKeyHeaderName = API_KEY_DEFAULT_HEADER
+	}
+	if config.TimestampExpiration == 0 {
+		config.TimestampExpiration = time.Minute
+	}
+	config.CacheMaxSize = 10
+	config.CacheTTL = time.Hour
+	a, err := NewApi(slog.Default(), nil, config)
+	require.Nil(t, err)
+	return a
+}
+
+// cacheKey puts key with generated secret into cache and returns API key string
+func cacheKey(a *Api, row *queries.GetApiKeyForVerifyRow) string {
+	secret := algo.GenerateSecret()
+	row.Sec = algo.HashSecret(secret)
+	a.cache.Set(row.ID, row, ttlcache.DefaultTTL)
+	return (&ApiKey{Id: row.ID, Secret: secret}).String()
+}
+
+// newApiWithCachedKey creates test api with generated key pair of the algorithm in cache
+func newApiWithCachedKey(t *testing.T, id int64, algName string) (*Api, algo.DerKeys, string) {
+	a := newTestApi(t, Config{})
+	keys, err := algo.GetSignAlgorithm(algName).Generate()
+	require.Nil(t, err)
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:  id,
+		Key: keys.Public,
+		Alg: queries.NullAlgType{AlgType: queries.AlgType(algName), Valid: true},
+	})
+	return a, keys, apiKey
+}
+
+func signHttpMessage(t *testing.T, algName string, privateKey []byte, req *http.Request, body string, components []string, params httpsig.Params) {
+	if body != "" {
+		req.Header.Set(httpsig.CONTENT_DIGEST_HEADER, httpsig.ContentDigest([]byte(body)))
+	}
+	input := httpsig.NewSignatureInput(components, params)
+	base, err := httpsig.SignatureBase(&httpsig.Message{
+		Method:    req.Header.Get(FORWARDED_METHOD_HEADER),
+		Scheme:    "http",
+		Authority: req.Host,
+		URI:       req.Header.Get(FORWARDED_URI_HEADER),
+		Header:    req.Header,
+	}, input)
+	require.Nil(t, err)
+	alg := algo.GetSignAlgorithm(algName)
+	signature, err := alg.Sign(privateKey, base)
+	require.Nil(t, err)
+	if keySize, ok := httpsig.ECDSAKeySize(algName); ok {
+		signature, err = algo.ECDSASignatureToRaw(signature, keySize)
+		require.Nil(t, err)
+	}
+	sigInput, sig, err := httpsig.FormatHeaders("sig1", input, signature)
+	require.Nil(t, err)
+	req.Header.Set(httpsig.SIGNATURE_INPUT_HEADER, sigInput)
+	req.Header.Set(httpsig.SIGNATURE_HEADER, sig)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/httpsig"
+)
+
+// isHttpMessageSignature returns true if request is signed according to RFC 9421
+func isHttpMessageSignature(c *gin.Context) bool {
+	return c.Request.Header.Get(httpsig.SIGNATURE_INPUT_HEADER) != ""
+}
+
+// verifyHttpMessageSignature validates RFC 9421 signature. Key is looked up by keyid parameter, no API key secret is required.
+func (a *Api) verifyHttpMessageSignature(c *gin.Context) {
+	sigs, err := httpsig.ParseSignatures(
+		c.Request.Header.Get(httpsig.SIGNATURE_INPUT_HEADER),
+		c.Request.Header.Get(httpsig.SIGNATURE_HEADER))
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed to parse http message signature: %s", err))
+		respondUnauthorized(c)
+		return
+	}
+	// only the first signature is verified, others may be added by intermediaries
+	sig := sigs[0]
+
+	id, err := strconv.ParseInt(sig.KeyId(), 10, 64)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Invalid keyid: %s", sig.KeyId()))
+		setAuthFailure(c, REASON_INVALID_KEY)
+		respondUnauthorized(c)
+		return
+	}
+	c.Set(AUDIT_APIKEY_ID_CONTEXT_KEY, id)
+
+	row, err := a.getApiKeyForVerify(c.Request.Context(), id)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed to load api key: %s", err))
+		setAuthFailure(c, REASON_UNKNOWN_KEY)
+		respondUnauthorized(c)
+		return
+	}
+	apiKeyData := &apiKeyData{GetApiKeyForVerifyRow: row}
+	c.Set(ALG_CONTEXT_KEY, string(row.Alg.AlgType))
+
+	algName := string(apiKeyData.Alg.AlgType)
+	alg := algo.GetSignAlgorithm(algName)
+	if alg == nil {
+		slog.Debug(fmt.Sprintf("Key has no signature algorithm: %d", id))
+		respondUnauthorized(c)
+		return
+	}
+	if sig.Alg() != "" {
+		if name, ok := httpsig.AlgorithmName(sig.Alg()); !ok || name != algName {
+			slog.Debug(fmt.Sprintf("Algorithm mismatch: %s, key algorithm: %s", sig.Alg(), algName))
+			respondUnauthorized(c)
+			return
+		}
+	}
+
+	created, ok := sig.Created()
+	if !ok {
+		slog.Debug("Signature created parameter is required")
+		respondUnauthorizedWithCode(c, CODE_TIMESTAMP_INVALID)
+		return
+	}
+	now := time.Now()
+	createdTime := time.Unix(created, 0)
+	if code := a.checkTimestamp(createdTime, now); code != "" {
+		slog.Debug(fmt.Sprintf("Signature created out of range: %d, %s", created, code))
+		respondUnauthorizedWithCode(c, code)
+		return
+	}
+	if expires, ok := sig.Expires(); ok && now.After(time.Unix(expires, 0)) {
+		respondUnauthorizedWithCode(c, CODE_SIGNATURE_EXPIRED)
+		return
+	}
+	if len(sig.Nonce()) > MAX_NONCE_LENGTH {
+		slog.Debug(fmt.Sprintf("Nonce is too long: %d", len(sig.Nonce())))
+		respondUnauthorizedWithCode(c, CODE_NONCE_INVALID)
+		return
+	}
+
+	data, err := c.GetRawData()
+	if err != nil {
+		respondInternalServerError(c)
+		return
+	}
+
+	// signature must bind the request method, target and body
+	if !sig.Covers("@method") || !(sig.Covers("@path") || sig.Covers("@target-uri") || sig.Covers("@request-target")) ||
+		(len(data) > 0 && !sig.Covers("content-digest")) {
+		slog.Debug("Signature doesn't cover required components")
+		respondUnauthorized(c)
+		return
+	}
+
+	if sig.Covers("content-digest") {
+		if err := httpsig.VerifyContentDigest(c.Request.Header.Get(httpsig.CONTENT_DIGEST_HEADER), data); err != nil {
+			slog.Debug(fmt.Sprintf("Failed to verify content digest: %s", err))
+			respondUnauthorized(c)
+			return
+		}
+	}
+
+	base, err := httpsig.SignatureBase(a.originalRequest(c), sig.Input)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed to build signature base: %s", err))
+		respondUnauthorized(c)
+		return
+	}
+
+	if a.Log.Enabled(c.Request.Context(), slog.LevelDebug) {
+		a.Log.Debug("validate http message signature", "base", string(base), "label", sig.Label,
+			"alg", algName, "key", algo.KeyToBase64(apiKeyData.Key))
+	}
+
+	signature := sig.Value
+	if keySize, ok := httpsig.ECDSAKeySize(algName); ok {
+		if len(signature) != 2*keySize {
+			respondUnauthorized(c)
+			return
+		}
+		if signature, err = algo.ECDSASignatureFromRaw(signature); err != nil {
+			respondUnauthorized(c)
+			return
+		}
+	}
+
+	if err := alg.ValidateSignature(apiKeyData.Key, signature, base); err != nil {
+		slog.Debug(fmt.Sprintf("Failed to validate signature: %s", err))
+		setAuthFailure(c, REASON_INVALID_SIGNATURE)
+		respondUnauthorized(c)
+		return
+	}
+
+	// limit only after signature is valid, keyid alone must not be enough to exhaust the limit
+	if err := a.takeRateLimit(c, row); err != nil {
+		respondAuthError(c, err)
+		return
+	}
+
+	if nonce := sig.Nonce(); nonce != "" {
+		ok, err := a.useNonce(c.Request.Context(), apiKeyData.ID, nonce, createdTime)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to check nonce: %s", err))
+			respondInternalServerError(c)
+			return
+		}
+		if !ok {
+			respondUnauthorizedWithCode(c, CODE_NONCE_REUSED)
+			return
+		}
+	}
+
+	verified := true
+	a.respondAuthorized(c, apiKeyData, &verified)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/httpsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHttpMessageSignature(t *testing.T) {
+	for _, algName := range []string{"ES256", "EdDSA", "RS256", "ES256K", "PS512", "ES384"} {
+		t.Run(algName, func(t *testing.T) {
+			a, keys, _ := newApiWithCachedKey(t, 5, algName)
+			a.Config.TrustedProxies = []string{"10.0.0.1"}
+			router := a.Routes("/")
+
+			newRequest := func(method string, uri string, body string, components []string, params httpsig.Params) *http.Request {
+				req, _ := http.NewRequest("POST", "/verify", strings.NewReader(body))
+				req.RemoteAddr = "10.0.0.1:1234"
+				req.Host = "example.com"
+				req.Header.Set(FORWARDED_METHOD_HEADER, "POST")
+				req.Header.Set(FORWARDED_URI_HEADER, "/orders?id=1")
+				signHttpMessage(t, algName, keys.Private, req, body, components, params)
+				// simulate tampering after signing
+				req.Header.Set(FORWARDED_METHOD_HEADER, method)
+				req.Header.Set(FORWARDED_URI_HEADER, uri)
+				return req
+			}
+			params := func(extra ...httpsig.Param) httpsig.Params {
+				return append(httpsig.Params{
+					{Name: "created", Value: time.Now().Unix()},
+					{Name: "keyid", Value: "5"},
+				}, extra...)
+			}
+			components := []string{"@method", "@path", "@query", "@authority"}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "", components, params()))
+			require.Equal(t, 200, w.Code)
+			var resp checkResponse
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "5", resp.Id)
+			assert.True(t, *resp.Verified)
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "body", append(components, "content-digest"), params()))
+			assert.Equal(t, 200, w.Code, "with body")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "body", components, params()))
+			assert.Equal(t, 401, w.Code, "body not covered")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("PUT", "/orders?id=1", "", components, params()))
+			assert.Equal(t, 401, w.Code, "method changed")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/admin?id=1", "", components, params()))
+			assert.Equal(t, 401, w.Code, "path changed")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "", []string{"@authority"}, params()))
+			assert.Equal(t, 401, w.Code, "method not covered")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "", components, httpsig.Params{
+				{Name: "created", Value: time.Now().Add(-2 * time.Minute).Unix()},
+				{Name: "keyid", Value: "5"},
+			}))
+			assert.Equal(t, 401, w.Code, "expired")
+
+			nonce := httpsig.Param{Name: "nonce", Value: "n1"}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "", components, params(nonce)))
+			assert.Equal(t, 200, w.Code, "nonce")
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newRequest("POST", "/orders?id=1", "", components, params(nonce)))
+			assert.Equal(t, 401, w.Code, "nonce reused")
+		})
+	}
+}
+
+func TestHttpMessageSignatureForwardedHeadersFromUntrustedPeer(t *testing.T) {
+	a, keys, _ := newApiWithCachedKey(t, 5, "ES256")
+	a.Config.TrustedProxies = []string{"10.0.0.1"}
+	router := a.Routes("/")
+
+	verify := func(remoteAddr string) int {
+		req, _ := http.NewRequest("POST", "/verify", strings.NewReader(""))
+		req.RemoteAddr = remoteAddr
+		req.Host = "example.com"
+		// signature made for GET /orders, presented directly for POST /verify
+		req.Header.Set(FORWARDED_METHOD_HEADER, "GET")
+		req.Header.Set(FORWARDED_URI_HEADER, "/orders")
+		signHttpMessage(t, "ES256", keys.Private, req, "", []string{"@method", "@path", "@authority"}, httpsig.Params{
+			{Name: "created", Value: time.Now().Unix()},
+			{Name: "keyid", Value: "5"},
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, verify("10.0.0.1:1234"))
+	assert.Equal(t, 401, verify("10.0.0.2:1234"))
+}
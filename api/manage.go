@@ -1,40 +1,165 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/canonical"
 	"github.com/jaspeen/apikeyman/db"
 	"github.com/jaspeen/apikeyman/db/queries"
 	"github.com/sqlc-dev/pqtype"
 )
 
 const MAX_EXTRA_SIZE = 2048
+const MAX_SCOPES = 64
+const MAX_RATE_BURST = 1000000
 
 type createApiKeyRequest struct {
-	Sub       string          `json:"sub"`
-	Alg       string          `json:"alg"`
-	Name      string          `json:"name"`
-	ExpSec    int             `json:"exp_sec"`
-	PublicKey string          `json:"publickey"`
-	Extra     json.RawMessage `json:"extra"`
+	Sub       string         `json:"sub"`
+	Alg       string         `json:"alg"`
+	Name      string         `json:"name"`
+	ExpSec    int            `json:"exp_sec"`
+	PublicKey publicKeyParam `json:"publickey"`
+	// address to register instead of public key for algorithms supporting it
+	Address string `json:"address"`
+	// size in bits of generated key for algorithms supporting it, default size if 0
+	KeySize  int             `json:"key_size"`
+	Extra    json.RawMessage `json:"extra"`
+	SignMode string          `json:"sign_mode"`
+	// encoding of ECDSA signatures, algo.SIG_ENCODING_DER if empty
+	SigEncoding string   `json:"sig_encoding"`
+	Role        string   `json:"role"`
+	Scopes      []string `json:"scopes"`
+	// requests per second, not limited if 0
+	RateLimit float64 `json:"rate_limit"`
+	// max requests in burst, rate_limit rounded up if 0
+	RateBurst int `json:"rate_burst"`
+}
+
+// publicKeyParam is public key to import, either PEM encoded PKIX string or JWK object
+type publicKeyParam struct {
+	Pem string
+	JWK *algo.JWK
+}
+
+func (p *publicKeyParam) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		p.JWK = new(algo.JWK)
+		return json.Unmarshal(data, p.JWK)
+	}
+	return json.Unmarshal(data, &p.Pem)
+}
+
+func (p *publicKeyParam) IsSet() bool {
+	return p.Pem != "" || p.JWK != nil
+}
+
+// Der decodes the key to PKIX DER format and checks it matches the algorithm
+func (p *publicKeyParam) Der(alg algo.SignAlgorithm) ([]byte, error) {
+	if p.JWK != nil {
+		if p.JWK.Alg != "" && p.JWK.Alg != alg.Name() {
+			return nil, fmt.Errorf("JWK 'alg' '%s' doesn't match '%s'", p.JWK.Alg, alg.Name())
+		}
+		return alg.JWKToPublicKey(p.JWK)
+	}
+	block, _ := pem.Decode([]byte(p.Pem))
+	if block == nil {
+		return nil, algo.ErrKeyMustBePEMEncoded
+	}
+	if _, err := alg.PublicKeyToJWK(block.Bytes); err != nil {
+		return nil, err
+	}
+	return block.Bytes, nil
+}
+
+// inTx runs fn in transaction, committed if fn succeeds and rolled back otherwise
+func inTx(ctx context.Context, sqlDb *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := sqlDb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *Api) keyPolicy() *algo.KeyPolicy {
+	return &algo.KeyPolicy{MinRSABits: a.Config.MinRSAKeyBits, AllowedCurves: a.Config.AllowedCurves}
+}
+
+/*
+generateKeys generates keypair of the size if not 0. Without size RSA keys are generated
+with at least Config.MinRSAKeyBits, so the default size is not rejected by key policy.
+*/
+func (a *Api) generateKeys(alg algo.SignAlgorithm, keySize int) (algo.DerKeys, error) {
+	sizeGenerator, ok := alg.(algo.KeySizeGenerator)
+	if !ok {
+		return alg.Generate()
+	}
+	if keySize == 0 && a.Config.MinRSAKeyBits > algo.DEFAULT_MIN_RSA_BITS {
+		keySize = a.Config.MinRSAKeyBits
+	}
+	if keySize == 0 {
+		return alg.Generate()
+	}
+	return sizeGenerator.GenerateSize(keySize)
+}
+
+// keyAddress returns address of the stored key for algorithms supporting it, empty otherwise
+func keyAddress(algName string, key []byte) (string, error) {
+	addressAlg, ok := algo.GetSignAlgorithm(algName).(algo.AddressAlgorithm)
+	if !ok || len(key) == 0 {
+		return "", nil
+	}
+	return addressAlg.Address(key)
+}
+
+// keyJWK returns JWK of the stored public key with key id as 'kid', nil if key has no public key
+func keyJWK(id int64, algName string, publicKey []byte) (*algo.JWK, error) {
+	alg := algo.GetSignAlgorithm(algName)
+	if alg == nil || len(publicKey) == 0 {
+		return nil, nil
+	}
+	if addressAlg, ok := alg.(algo.AddressAlgorithm); ok && addressAlg.IsAddress(publicKey) {
+		return nil, nil
+	}
+	jwk, err := alg.PublicKeyToJWK(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	jwk.Kid = strconv.FormatInt(id, 10)
+	jwk.Alg = algName
+	jwk.Use = "sig"
+	return jwk, nil
 }
 
 func (p *createApiKeyRequest) Validate() error {
 	if p.Sub == "" {
 		return errors.New("sub is required")
 	}
-	if p.PublicKey != "" && p.Alg == "" {
+	if p.PublicKey.IsSet() && p.Alg == "" {
 		return errors.New("'alg' is required to import public key")
 	}
+	if p.KeySize != 0 && (p.Alg == "" || p.PublicKey.IsSet()) {
+		return errors.New("'key_size' requires 'alg' and can't be used with 'publickey'")
+	}
+	if p.Address != "" && (p.Alg == "" || p.PublicKey.IsSet() || p.KeySize != 0) {
+		return errors.New("'address' requires 'alg' and can't be used with 'publickey' or 'key_size'")
+	}
 	if len(p.Sub) > 255 {
 		return errors.New("'sub' exceeds maximum length of 255 characters")
 	}
@@ -45,18 +170,67 @@ func (p *createApiKeyRequest) Validate() error {
 	if p.Extra != nil && len(p.Extra) > MAX_EXTRA_SIZE {
 		return errors.New("extra data exceeds maximum size of 2048 bytes")
 	}
+	if p.SignMode != "" {
+		if err := canonical.ValidateMode(p.SignMode); err != nil {
+			return err
+		}
+	}
+	if p.SigEncoding != "" {
+		if err := algo.ValidateSigEncoding(p.SigEncoding); err != nil {
+			return err
+		}
+	}
+	if p.Role != "" && p.Role != ROLE_ADMIN {
+		return errors.New("'role' must be empty or 'admin'")
+	}
+	if err := validateScopes(p.Scopes); err != nil {
+		return err
+	}
+	if err := validateRateLimit(p.RateLimit, p.RateBurst); err != nil {
+		return err
+	}
+	if p.RateBurst > 0 && p.RateLimit == 0 {
+		return errRateBurstWithoutLimit
+	}
+
+	return nil
+}
 
+func validateRateLimit(rate float64, burst int) error {
+	if rate < 0 {
+		return errors.New("'rate_limit' must not be negative")
+	}
+	if burst < 0 || burst > MAX_RATE_BURST {
+		return errors.New("'rate_burst' must be between 0 and 1000000")
+	}
+	return nil
+}
+
+var errRateBurstWithoutLimit = errors.New("'rate_burst' requires 'rate_limit'")
+
+func validateScopes(scopes []string) error {
+	if len(scopes) > MAX_SCOPES {
+		return errors.New("'scopes' exceeds maximum of 64 items")
+	}
+	for _, scope := range scopes {
+		if scope == "" || len(scope) > 255 || strings.ContainsAny(scope, " \t\r\n") {
+			return fmt.Errorf("invalid scope '%s'", scope)
+		}
+	}
 	return nil
 }
 
 type createApiKeyResponse struct {
-	ApiKey     string `json:"apikey"`
-	PublicKey  string `json:"publickey,omitempty"`
-	PrivateKey string `json:"privatekey,omitempty"`
+	ApiKey       string    `json:"apikey"`
+	PublicKey    string    `json:"publickey,omitempty"`
+	PublicKeyJWK *algo.JWK `json:"publickey_jwk,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	PrivateKey   string    `json:"privatekey,omitempty"`
 }
 
 type errorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
 func extractCreateParams(params *createApiKeyRequest, c *gin.Context) error {
@@ -64,9 +238,52 @@ func extractCreateParams(params *createApiKeyRequest, c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	// algorithm may be given only in imported JWK
+	if params.Alg == "" && params.PublicKey.JWK != nil {
+		params.Alg = params.PublicKey.JWK.Alg
+	}
 	return params.Validate()
 }
 
+// CreateAdminKey creates key with admin role to bootstrap management api access
+func CreateAdminKey(ctx context.Context, sqlDb *sql.DB, sub string, name string, exp time.Duration) (*ApiKey, error) {
+	insertParams := queries.InsertApiKeyParams{
+		Sub:  sql.NullString{String: sub, Valid: true},
+		Name: sql.NullString{String: name, Valid: name != ""},
+		Role: sql.NullString{String: ROLE_ADMIN, Valid: true},
+	}
+	if exp > 0 {
+		insertParams.Exp = sql.NullTime{Time: time.Now().Add(exp), Valid: true}
+	}
+	generatedSecret := algo.GenerateSecret()
+	insertParams.Sec = algo.HashSecret(generatedSecret)
+
+	auditDetails := gin.H{"sub": sub, "name": name, "role": ROLE_ADMIN}
+	if insertParams.Exp.Valid {
+		auditDetails["exp"] = insertParams.Exp.Time
+	}
+	details, _ := json.Marshal(auditDetails)
+	var id int64
+	err := inTx(ctx, sqlDb, func(tx *sql.Tx) error {
+		var err error
+		id, err = db.Queries.InsertApiKey(ctx, tx, insertParams)
+		if err != nil {
+			return err
+		}
+		return NewPostgresAuditSink(sqlDb).WriteTx(ctx, tx, &AuditEvent{
+			Time:     time.Now().UTC(),
+			Event:    AUDIT_KEY_CREATED,
+			ApiKeyId: id,
+			Actor:    "cli",
+			Details:  details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ApiKey{Id: id, Secret: generatedSecret}, nil
+}
+
 func (a *Api) CreateApiKey(c *gin.Context) {
 	var params createApiKeyRequest
 	err := extractCreateParams(&params, c)
@@ -88,6 +305,12 @@ func (a *Api) CreateApiKey(c *gin.Context) {
 	if params.Extra != nil {
 		insertParams.Extra = pqtype.NullRawMessage{RawMessage: params.Extra, Valid: true}
 	}
+	insertParams.SignMode = sql.NullString{String: params.SignMode, Valid: params.SignMode != ""}
+	insertParams.SigEncoding = sql.NullString{String: params.SigEncoding, Valid: params.SigEncoding != ""}
+	insertParams.Role = sql.NullString{String: params.Role, Valid: params.Role != ""}
+	insertParams.Scopes = params.Scopes
+	insertParams.RateLimit = sql.NullFloat64{Float64: params.RateLimit, Valid: params.RateLimit > 0}
+	insertParams.RateBurst = sql.NullInt32{Int32: int32(params.RateBurst), Valid: params.RateBurst > 0}
 
 	// import or generate public key
 	var keys algo.DerKeys
@@ -99,21 +322,48 @@ func (a *Api) CreateApiKey(c *gin.Context) {
 		}
 		insertParams.Alg = queries.NullAlgType{AlgType: queries.AlgType(params.Alg), Valid: true}
 
-		if params.PublicKey == "" {
-			keys, err = alg.Generate()
+		if params.Address != "" {
+			addressAlg, ok := alg.(algo.AddressAlgorithm)
+			if !ok {
+				c.JSON(400, errorResponse{Error: "'address' is not supported for the algorithm"})
+				return
+			}
+			keys.Public, err = addressAlg.ParseAddress(params.Address)
+			if err != nil {
+				slog.Debug(fmt.Sprintf("Failed to decode address: %s", err))
+				c.JSON(400, errorResponse{Error: "Invalid address"})
+				return
+			}
+		} else if !params.PublicKey.IsSet() {
+			if _, ok := alg.(algo.KeySizeGenerator); !ok && params.KeySize != 0 {
+				c.JSON(400, errorResponse{Error: "'key_size' is not supported for the algorithm"})
+				return
+			}
+			keys, err = a.generateKeys(alg, params.KeySize)
+			if errors.Is(err, algo.ErrUnsupportedKeySize) {
+				c.JSON(400, errorResponse{Error: "Unsupported key size"})
+				return
+			}
 			if err != nil {
 				slog.Error(fmt.Sprintf("Failed to generate keypair: %s", err))
 				c.JSON(500, errorResponse{Error: "Internal server error"})
 				return
 			}
 		} else {
-			// decode public key from PEM PKIX format
-			publicKeyBlock, err := pem.Decode([]byte(params.PublicKey))
-			if err != nil || publicKeyBlock == nil {
+			keys.Public, err = params.PublicKey.Der(alg)
+			if err != nil {
+				slog.Debug(fmt.Sprintf("Failed to decode public key: %s", err))
 				c.JSON(400, errorResponse{Error: "Invalid public key"})
 				return
 			}
-			keys.Public = publicKeyBlock.Bytes
+		}
+		// address has no public key to check
+		if params.Address == "" {
+			if err := a.keyPolicy().Check(alg, keys.Public); err != nil {
+				slog.Debug(fmt.Sprintf("Key rejected by policy: %s", err))
+				c.JSON(400, errorResponse{Error: "Key rejected by policy: " + err.Error()})
+				return
+			}
 		}
 		insertParams.Key = keys.Public
 	}
@@ -122,42 +372,224 @@ func (a *Api) CreateApiKey(c *gin.Context) {
 	generatedSecret := algo.GenerateSecret()
 	insertParams.Sec = algo.HashSecret(generatedSecret)
 
-	id, err := db.Queries.InsertApiKey(c.Request.Context(), a.Db, insertParams)
+	var id int64
+	err = inTx(c.Request.Context(), a.Db, func(tx *sql.Tx) error {
+		var err error
+		id, err = db.Queries.InsertApiKey(c.Request.Context(), tx, insertParams)
+		if err != nil {
+			return err
+		}
+		return a.auditTx(c, tx, AUDIT_KEY_CREATED, id, "", gin.H{
+			"sub":        params.Sub,
+			"name":       params.Name,
+			"alg":        params.Alg,
+			"exp":        insertParams.Exp.Time,
+			"role":       params.Role,
+			"scopes":     params.Scopes,
+			"rate_limit": params.RateLimit,
+			"rate_burst": params.RateBurst,
+		})
+	})
 	if err != nil {
 		slog.Error(fmt.Sprintf("Failed to insert api key: %s", err))
 		c.JSON(500, errorResponse{Error: "Internal server error"})
 		return
 	}
 
+	a.metrics.keyCreated(params.Alg)
+
 	apiKey := ApiKey{Id: id, Secret: generatedSecret}
 	encodedPublicKey := base64.StdEncoding.EncodeToString(keys.Public)
 	var encodedPrivateKey string
 	if keys.Private != nil {
 		encodedPrivateKey = base64.StdEncoding.EncodeToString(keys.Private)
 	}
+	publicKeyJWK, err := keyJWK(id, params.Alg, keys.Public)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to encode public key as JWK: %s", err))
+	}
+	address, err := keyAddress(params.Alg, keys.Public)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to encode address: %s", err))
+	}
+	if params.Address != "" {
+		// stored key is the address
+		encodedPublicKey = ""
+	}
 
 	c.JSON(200,
 		createApiKeyResponse{
-			ApiKey:     apiKey.String(),
-			PublicKey:  encodedPublicKey,
-			PrivateKey: encodedPrivateKey,
+			ApiKey:       apiKey.String(),
+			PublicKey:    encodedPublicKey,
+			PublicKeyJWK: publicKeyJWK,
+			Address:      address,
+			PrivateKey:   encodedPrivateKey,
 		})
 }
 
+const (
+	SEARCH_DEFAULT_LIMIT = 100
+	SEARCH_MAX_LIMIT     = 1000
+
+	SORT_BY_ID  = "id"
+	SORT_BY_EXP = "exp"
+	SORT_BY_SUB = "sub"
+
+	// response header with cursor for the next page, absent on the last page
+	NEXT_CURSOR_HEADER = "X-Next-Cursor"
+)
+
 type listApiKeysRequest struct {
-	Sub string `json:"sub"`
+	// exact subject
+	Sub       string     `json:"sub"`
+	SubPrefix string     `json:"sub_prefix"`
+	Name      string     `json:"name"`
+	Alg       string     `json:"alg"`
+	ExpAfter  *time.Time `json:"exp_after"`
+	ExpBefore *time.Time `json:"exp_before"`
+	// keys which extra contains this JSON
+	Extra json.RawMessage `json:"extra"`
+	// keys never used or not used for this number of days
+	UnusedDays int `json:"unused_days"`
+	// SORT_BY_ID if empty
+	SortBy string `json:"sort_by"`
+	// asc or desc
+	Order  string `json:"order"`
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+func (p *listApiKeysRequest) Validate() error {
+	switch p.SortBy {
+	case "", SORT_BY_ID, SORT_BY_EXP, SORT_BY_SUB:
+	default:
+		return fmt.Errorf("unsupported 'sort_by' '%s'", p.SortBy)
+	}
+	if p.Order != "" && p.Order != "asc" && p.Order != "desc" {
+		return errors.New("'order' must be 'asc' or 'desc'")
+	}
+	if p.Limit < 0 || p.Limit > SEARCH_MAX_LIMIT {
+		return errors.New("'limit' must be between 1 and 1000")
+	}
+	if p.Alg != "" && algo.GetSignAlgorithm(p.Alg) == nil {
+		return fmt.Errorf("unsupported 'alg' '%s'", p.Alg)
+	}
+	if p.Extra != nil && !json.Valid(p.Extra) {
+		return errors.New("'extra' is not valid JSON")
+	}
+	if p.UnusedDays < 0 {
+		return errors.New("'unused_days' must not be negative")
+	}
+	return nil
+}
+
+// searchCursor points after the last returned key, it is opaque for clients
+type searchCursor struct {
+	SortBy string     `json:"s"`
+	Desc   bool       `json:"d,omitempty"`
+	Id     int64      `json:"id"`
+	Exp    *time.Time `json:"exp,omitempty"`
+	Sub    string     `json:"sub,omitempty"`
+}
+
+func (c *searchCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c searchCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// escapeLike escapes LIKE pattern special characters
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (p *listApiKeysRequest) searchParams() (queries.SearchApiKeysParams, error) {
+	params := queries.SearchApiKeysParams{
+		Sub:      sql.NullString{String: p.Sub, Valid: p.Sub != ""},
+		Name:     sql.NullString{String: p.Name, Valid: p.Name != ""},
+		Alg:      queries.NullAlgType{AlgType: queries.AlgType(p.Alg), Valid: p.Alg != ""},
+		SortBy:   p.SortBy,
+		SortDesc: p.Order == "desc",
+		PageSize: SEARCH_DEFAULT_LIMIT,
+	}
+	if params.SortBy == "" {
+		params.SortBy = SORT_BY_ID
+	}
+	if p.SubPrefix != "" {
+		params.SubPattern = sql.NullString{String: escapeLike(p.SubPrefix) + "%", Valid: true}
+	}
+	if p.ExpAfter != nil {
+		params.ExpAfter = sql.NullTime{Time: *p.ExpAfter, Valid: true}
+	}
+	if p.ExpBefore != nil {
+		params.ExpBefore = sql.NullTime{Time: *p.ExpBefore, Valid: true}
+	}
+	if p.Extra != nil {
+		params.Extra = pqtype.NullRawMessage{RawMessage: p.Extra, Valid: true}
+	}
+	if p.UnusedDays > 0 {
+		params.UnusedSince = sql.NullTime{Time: time.Now().AddDate(0, 0, -p.UnusedDays), Valid: true}
+	}
+	if p.Limit > 0 {
+		params.PageSize = int32(p.Limit)
+	}
+	if p.Cursor != "" {
+		cursor, err := decodeSearchCursor(p.Cursor)
+		if err != nil {
+			return params, errors.New("invalid 'cursor'")
+		}
+		if cursor.SortBy != params.SortBy || cursor.Desc != params.SortDesc {
+			return params, errors.New("'cursor' doesn't match sort order")
+		}
+		params.CursorID = sql.NullInt64{Int64: cursor.Id, Valid: true}
+		// keys without expiration are sorted last
+		if cursor.Exp != nil {
+			params.CursorExp = sql.NullTime{Time: *cursor.Exp, Valid: true}
+		}
+		params.CursorSub = sql.NullString{String: cursor.Sub, Valid: true}
+	}
+	return params, nil
 }
 
 type ApiKeyResponse struct {
-	Id    int64           `json:"id"`
-	Sub   string          `json:"sub"`
-	Name  string          `json:"name"`
-	Alg   string          `json:"alg"`
-	Key   string          `json:"key"`
-	Exp   time.Time       `json:"exp"`
-	Extra json.RawMessage `json:"extra,omitempty"`
+	Id          int64           `json:"id"`
+	Sub         string          `json:"sub"`
+	Name        string          `json:"name"`
+	Alg         string          `json:"alg"`
+	Key         string          `json:"key"`
+	KeyJWK      *algo.JWK       `json:"publickey_jwk,omitempty"`
+	Address     string          `json:"address,omitempty"`
+	Exp         time.Time       `json:"exp"`
+	Extra       json.RawMessage `json:"extra,omitempty"`
+	RevokedAt   *time.Time      `json:"revoked_at,omitempty"`
+	RevokedBy   string          `json:"revoked_by,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	PreviousExp *time.Time      `json:"previous_exp,omitempty"`
+	SignMode    string          `json:"sign_mode,omitempty"`
+	SigEncoding string          `json:"sig_encoding,omitempty"`
+	Role        string          `json:"role,omitempty"`
+	Scopes      []string        `json:"scopes,omitempty"`
+	Version     int64           `json:"version"`
+	UpdatedAt   *time.Time      `json:"updated_at,omitempty"`
+	RateLimit   float64         `json:"rate_limit,omitempty"`
+	RateBurst   int             `json:"rate_burst,omitempty"`
+	LastUsedAt  *time.Time      `json:"last_used_at,omitempty"`
+	LastUsedIp  string          `json:"last_used_ip,omitempty"`
+	UsageCount  int64           `json:"usage_count"`
 }
 
+// ListApiKeys searches keys page by page, cursor for the next page is returned in NEXT_CURSOR_HEADER
 func (a *Api) ListApiKeys(c *gin.Context) {
 	var req listApiKeysRequest
 	err := c.Bind(&req)
@@ -165,42 +597,59 @@ func (a *Api) ListApiKeys(c *gin.Context) {
 		respondInvalidRequest(c)
 		return
 	}
+	if err := req.Validate(); err != nil {
+		c.JSON(400, errorResponse{Error: err.Error()})
+		return
+	}
+	params, err := req.searchParams()
+	if err != nil {
+		c.JSON(400, errorResponse{Error: err.Error()})
+		return
+	}
+	pageSize := params.PageSize
+	// one more to know if there is next page
+	params.PageSize++
 
-	sub := sql.NullString{String: req.Sub, Valid: req.Sub != ""}
-	var res []ApiKeyResponse = make([]ApiKeyResponse, 0)
-
-	keys, err := db.Queries.SearchApiKeys(c.Request.Context(), a.Db, sub)
+	keys, err := db.Queries.SearchApiKeys(c.Request.Context(), a.Db, params)
 	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to search api keys: %s", err))
 		respondInternalServerError(c)
 		return
 	}
-	for _, key := range keys {
-		res = append(res, ApiKeyResponse{
-			Id:   key.ID,
-			Sub:  key.Sub.String,
-			Name: key.Name.String,
-			Alg:  string(key.Alg.AlgType),
-			Key:  algo.KeyToBase64(key.Key),
-			Exp:  key.Exp.Time,
-		})
+
+	if len(keys) > int(pageSize) {
+		keys = keys[:pageSize]
+		last := keys[len(keys)-1]
+		cursor := searchCursor{SortBy: params.SortBy, Desc: params.SortDesc, Id: last.ID, Sub: last.Sub.String}
+		if last.Exp.Valid {
+			cursor.Exp = &last.Exp.Time
+		}
+		c.Header(NEXT_CURSOR_HEADER, cursor.Encode())
+	}
+
+	var res []ApiKeyResponse = make([]ApiKeyResponse, 0, len(keys))
+	for i := range keys {
+		res = append(res, newApiKeyResponse(&keys[i]))
 	}
 
 	c.JSON(200, res)
 }
 
+// GetApiKey returns key metadata by id. If full key is given, its secret must match.
 func (a *Api) GetApiKey(c *gin.Context) {
-	apiKey, err := ParseApiKey(c.Param("apikey"))
+	id, secret, err := parseApiKeyRef(c.Param("apikey"))
 	if err != nil {
-		a.Log.Error(fmt.Sprintf("Failed to parse api key '%s': %s", c.Param("apikey"), err))
+		// don't log the value, it may contain secret
+		slog.Debug(fmt.Sprintf("Failed to parse api key reference: %s", err))
 		c.JSON(400, errorResponse{Error: "Invalid API key"})
 		return
 	}
 
 	if a.Log.Enabled(c.Request.Context(), slog.LevelDebug) {
-		slog.Debug("get", "id", apiKey.Id)
+		slog.Debug("get", "id", id)
 	}
 
-	key, err := db.Queries.GetApiKey(c.Request.Context(), a.Db, apiKey.Id)
+	key, err := db.Queries.GetApiKey(c.Request.Context(), a.Db, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			c.JSON(404, errorResponse{Error: "API key not found"})
@@ -211,13 +660,404 @@ func (a *Api) GetApiKey(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, ApiKeyResponse{
-		Id:    key.ID,
-		Sub:   key.Sub.String,
-		Name:  key.Name.String,
-		Alg:   string(key.Alg.AlgType),
-		Key:   algo.KeyToBase64(key.Key),
-		Exp:   key.Exp.Time,
-		Extra: key.Extra.RawMessage,
+	if secret != nil {
+		if _, ok := matchSecret(algo.HashSecret(secret), key.Sec, key.PrevSec, key.PrevSecExp); !ok {
+			// same response as missing key, so the endpoint can't be used to probe secrets
+			c.JSON(404, errorResponse{Error: "API key not found"})
+			return
+		}
+	}
+
+	c.JSON(200, newApiKeyResponse(&key))
+}
+
+func newApiKeyResponse(key *queries.Apikey) ApiKeyResponse {
+	var revokedAt *time.Time
+	if key.RevokedAt.Valid {
+		revokedAt = &key.RevokedAt.Time
+	}
+	var previousExp *time.Time
+	if key.PrevSecExp.Valid && key.PrevSecExp.Time.After(time.Now()) {
+		previousExp = &key.PrevSecExp.Time
+	}
+	var updatedAt *time.Time
+	if key.UpdatedAt.Valid {
+		updatedAt = &key.UpdatedAt.Time
+	}
+	var lastUsedAt *time.Time
+	if key.LastUsedAt.Valid {
+		lastUsedAt = &key.LastUsedAt.Time
+	}
+	keyJwk, err := keyJWK(key.ID, string(key.Alg.AlgType), key.Key)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to encode public key of %d as JWK: %s", key.ID, err))
+	}
+	address, err := keyAddress(string(key.Alg.AlgType), key.Key)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to encode address of %d: %s", key.ID, err))
+	}
+
+	return ApiKeyResponse{
+		Id:          key.ID,
+		Sub:         key.Sub.String,
+		Name:        key.Name.String,
+		Alg:         string(key.Alg.AlgType),
+		Key:         algo.KeyToBase64(key.Key),
+		KeyJWK:      keyJwk,
+		Address:     address,
+		Exp:         key.Exp.Time,
+		Extra:       key.Extra.RawMessage,
+		RevokedAt:   revokedAt,
+		RevokedBy:   key.RevokedBy.String,
+		Reason:      key.Reason.String,
+		PreviousExp: previousExp,
+		SignMode:    key.SignMode.String,
+		SigEncoding: key.SigEncoding.String,
+		Role:        key.Role.String,
+		Scopes:      key.Scopes,
+		Version:     key.Version,
+		UpdatedAt:   updatedAt,
+		RateLimit:   key.RateLimit.Float64,
+		RateBurst:   int(key.RateBurst.Int32),
+		LastUsedAt:  lastUsedAt,
+		LastUsedIp:  key.LastUsedIp.String,
+		UsageCount:  key.UsageCount,
+	}
+}
+
+/*
+GetApiKeyJWKS returns public key of the key as JWK Set with key id as 'kid',
+so clients and verifiers can use standard JOSE libraries.
+Set is empty for revoked and expired keys and keys without public key.
+*/
+func (a *Api) GetApiKeyJWKS(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("apikey"), 10, 64)
+	if err != nil {
+		c.JSON(400, errorResponse{Error: "Invalid API key id"})
+		return
+	}
+
+	key, err := db.Queries.GetApiKey(c.Request.Context(), a.Db, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, errorResponse{Error: "API key not found"})
+		} else {
+			slog.Error(fmt.Sprintf("Failed to load api key: %s", err))
+			respondInternalServerError(c)
+		}
+		return
+	}
+
+	jwks := algo.JWKS{Keys: []algo.JWK{}}
+	if !key.RevokedAt.Valid && (!key.Exp.Valid || key.Exp.Time.After(time.Now())) {
+		jwk, err := keyJWK(key.ID, string(key.Alg.AlgType), key.Key)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to encode public key as JWK: %s", err))
+			respondInternalServerError(c)
+			return
+		}
+		if jwk != nil {
+			jwks.Keys = append(jwks.Keys, *jwk)
+		}
+	}
+	c.JSON(200, jwks)
+}
+
+/*
+updateApiKeyRequest changes key metadata, omitted fields are left unchanged.
+"extra": null removes extra data.
+*/
+type updateApiKeyRequest struct {
+	Name   *string         `json:"name"`
+	ExpSec *int            `json:"exp_sec"`
+	Extra  json.RawMessage `json:"extra"`
+	Scopes *[]string       `json:"scopes"`
+	// 0 removes the limit
+	RateLimit *float64 `json:"rate_limit"`
+	RateBurst *int     `json:"rate_burst"`
+	// expected current version, update fails with 409 if key was changed concurrently. Not checked if 0
+	Version int64 `json:"version"`
+}
+
+func (p *updateApiKeyRequest) Validate() error {
+	if p.Name != nil && len(*p.Name) > 255 {
+		return errors.New("'name' exceeds maximum length of 255 characters")
+	}
+	if p.ExpSec != nil && *p.ExpSec <= 0 {
+		return errors.New("'exp_sec' must be positive")
+	}
+	if p.Extra != nil && len(p.Extra) > MAX_EXTRA_SIZE {
+		return errors.New("extra data exceeds maximum size of 2048 bytes")
+	}
+	if p.Scopes != nil {
+		if err := validateScopes(*p.Scopes); err != nil {
+			return err
+		}
+	}
+	var rate float64
+	var burst int
+	if p.RateLimit != nil {
+		rate = *p.RateLimit
+	}
+	if p.RateBurst != nil {
+		burst = *p.RateBurst
+	}
+	if err := validateRateLimit(rate, burst); err != nil {
+		return err
+	}
+	if p.Version < 0 {
+		return errors.New("'version' must not be negative")
+	}
+	return nil
+}
+
+// updateAuditDetails returns new values of the fields present in update request
+func updateAuditDetails(req *updateApiKeyRequest, params *queries.UpdateApiKeyParams, version int64) gin.H {
+	details := gin.H{"version": version}
+	if req.Name != nil {
+		details["name"] = params.Name.String
+	}
+	if req.ExpSec != nil {
+		details["exp"] = params.Exp.Time
+	}
+	if req.Extra != nil {
+		details["extra"] = params.Extra.RawMessage
+	}
+	if req.Scopes != nil {
+		details["scopes"] = params.Scopes
+	}
+	if req.RateLimit != nil {
+		details["rate_limit"] = params.RateLimit.Float64
+	}
+	if req.RateBurst != nil {
+		details["rate_burst"] = int(params.RateBurst.Int32)
+	}
+	return details
+}
+
+func (a *Api) UpdateApiKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("apikey"), 10, 64)
+	if err != nil {
+		c.JSON(400, errorResponse{Error: "Invalid API key id"})
+		return
+	}
+
+	var req updateApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondInvalidRequest(c)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		slog.Debug(fmt.Sprintf("Invalid update request: %s", err))
+		c.JSON(400, errorResponse{Error: err.Error()})
+		return
+	}
+
+	key, err := db.Queries.GetApiKey(c.Request.Context(), a.Db, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, errorResponse{Error: "API key not found"})
+		} else {
+			slog.Error(fmt.Sprintf("Failed to load api key: %s", err))
+			respondInternalServerError(c)
+		}
+		return
+	}
+	if key.RevokedAt.Valid {
+		c.JSON(409, errorResponse{Error: "API key is revoked", Code: CODE_REVOKED})
+		return
+	}
+	if req.Version != 0 && req.Version != key.Version {
+		c.JSON(409, errorResponse{Error: "API key was modified", Code: CODE_VERSION_CONFLICT})
+		return
+	}
+
+	updateParams := queries.UpdateApiKeyParams{
+		ID:        id,
+		Name:      key.Name,
+		Extra:     key.Extra,
+		Exp:       key.Exp,
+		Scopes:    key.Scopes,
+		RateLimit: key.RateLimit,
+		RateBurst: key.RateBurst,
+		Version:   key.Version,
+	}
+	if req.Name != nil {
+		updateParams.Name = sql.NullString{String: *req.Name, Valid: *req.Name != ""}
+	}
+	if req.ExpSec != nil {
+		updateParams.Exp = sql.NullTime{Time: time.Now().Add(time.Second * time.Duration(*req.ExpSec)), Valid: true}
+	}
+	if req.Extra != nil {
+		if string(req.Extra) == "null" {
+			updateParams.Extra = pqtype.NullRawMessage{}
+		} else {
+			updateParams.Extra = pqtype.NullRawMessage{RawMessage: req.Extra, Valid: true}
+		}
+	}
+	if req.Scopes != nil {
+		updateParams.Scopes = *req.Scopes
+	}
+	if req.RateLimit != nil {
+		updateParams.RateLimit = sql.NullFloat64{Float64: *req.RateLimit, Valid: *req.RateLimit > 0}
+	}
+	if req.RateBurst != nil {
+		updateParams.RateBurst = sql.NullInt32{Int32: int32(*req.RateBurst), Valid: *req.RateBurst > 0}
+	}
+	if updateParams.RateBurst.Valid && !updateParams.RateLimit.Valid {
+		c.JSON(400, errorResponse{Error: errRateBurstWithoutLimit.Error()})
+		return
+	}
+
+	// version condition guards against concurrent update between load and update
+	var updated queries.UpdateApiKeyRow
+	err = inTx(c.Request.Context(), a.Db, func(tx *sql.Tx) error {
+		var err error
+		updated, err = db.Queries.UpdateApiKey(c.Request.Context(), tx, updateParams)
+		if err != nil {
+			return err
+		}
+		return a.auditTx(c, tx, AUDIT_KEY_UPDATED, id, "", updateAuditDetails(&req, &updateParams, updated.Version))
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(409, errorResponse{Error: "API key was modified", Code: CODE_VERSION_CONFLICT})
+		} else {
+			slog.Error(fmt.Sprintf("Failed to update api key: %s", err))
+			respondInternalServerError(c)
+		}
+		return
+	}
+
+	a.evictCachedKey(id)
+
+	key.Name = updateParams.Name
+	key.Extra = updateParams.Extra
+	key.Exp = updateParams.Exp
+	key.Scopes = updateParams.Scopes
+	key.RateLimit = updateParams.RateLimit
+	key.RateBurst = updateParams.RateBurst
+	key.Version = updated.Version
+	key.UpdatedAt = updated.UpdatedAt
+	c.JSON(200, newApiKeyResponse(&key))
+}
+
+// revoked_by is always the authenticated caller, so it can't be forged
+type revokeApiKeyRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (p *revokeApiKeyRequest) Validate() error {
+	if len(p.Reason) > 1024 {
+		return errors.New("'reason' exceeds maximum length of 1024 characters")
+	}
+	return nil
+}
+
+func (a *Api) RevokeApiKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("apikey"), 10, 64)
+	if err != nil {
+		c.JSON(400, errorResponse{Error: "Invalid API key id"})
+		return
+	}
+
+	// body is optional
+	var req revokeApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondInvalidRequest(c)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		slog.Debug(fmt.Sprintf("Invalid revoke request: %s", err))
+		respondInvalidRequest(c)
+		return
+	}
+	revokedBy := actor(c)
+
+	err = inTx(c.Request.Context(), a.Db, func(tx *sql.Tx) error {
+		_, err := db.Queries.RevokeApiKey(c.Request.Context(), tx, queries.RevokeApiKeyParams{
+			ID:        id,
+			RevokedBy: sql.NullString{String: revokedBy, Valid: revokedBy != ""},
+			Reason:    sql.NullString{String: req.Reason, Valid: req.Reason != ""},
+		})
+		if err != nil {
+			return err
+		}
+		return a.auditTx(c, tx, AUDIT_KEY_REVOKED, id, req.Reason, gin.H{"revoked_by": revokedBy})
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, errorResponse{Error: "API key not found or already revoked"})
+		} else {
+			slog.Error(fmt.Sprintf("Failed to revoke api key: %s", err))
+			respondInternalServerError(c)
+		}
+		return
+	}
+
+	a.evictCachedKey(id)
+
+	c.Status(204)
+}
+
+type rotateApiKeyRequest struct {
+	// grace period for previous secret in seconds, Config.RotationGracePeriod is used if 0
+	GraceSec int `json:"grace_sec"`
+}
+
+type rotateApiKeyResponse struct {
+	ApiKey      string    `json:"apikey"`
+	PreviousExp time.Time `json:"previous_exp"`
+}
+
+func (a *Api) RotateApiKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("apikey"), 10, 64)
+	if err != nil {
+		c.JSON(400, errorResponse{Error: "Invalid API key id"})
+		return
+	}
+
+	// body is optional
+	var req rotateApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondInvalidRequest(c)
+		return
+	}
+	if req.GraceSec < 0 {
+		c.JSON(400, errorResponse{Error: "'grace_sec' must not be negative"})
+		return
+	}
+
+	grace := a.Config.RotationGracePeriod
+	if req.GraceSec > 0 {
+		grace = time.Duration(req.GraceSec) * time.Second
+	}
+	previousExp := time.Now().Add(grace)
+
+	generatedSecret := algo.GenerateSecret()
+	err = inTx(c.Request.Context(), a.Db, func(tx *sql.Tx) error {
+		_, err := db.Queries.RotateApiKeySecret(c.Request.Context(), tx, queries.RotateApiKeySecretParams{
+			ID:         id,
+			Sec:        algo.HashSecret(generatedSecret),
+			PrevSecExp: sql.NullTime{Time: previousExp, Valid: true},
+		})
+		if err != nil {
+			return err
+		}
+		return a.auditTx(c, tx, AUDIT_KEY_ROTATED, id, "", gin.H{"previous_exp": previousExp})
 	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, errorResponse{Error: "API key not found"})
+		} else {
+			slog.Error(fmt.Sprintf("Failed to rotate api key: %s", err))
+			respondInternalServerError(c)
+		}
+		return
+	}
+
+	a.evictCachedKey(id)
+
+	apiKey := ApiKey{Id: id, Secret: generatedSecret}
+	c.JSON(200, rotateApiKeyResponse{ApiKey: apiKey.String(), PreviousExp: previousExp})
 }
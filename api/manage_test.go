@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseApiKeyRef(t *testing.T) {
+	id, secret, err := parseApiKeyRef("42")
+	require.Nil(t, err)
+	assert.Equal(t, int64(42), id)
+	assert.Nil(t, secret)
+
+	id, secret, err = parseApiKeyRef("42:")
+	require.Nil(t, err)
+	assert.Equal(t, int64(42), id)
+	assert.Nil(t, secret)
+
+	apiKey := ApiKey{Id: 42, Secret: algo.GenerateSecret()}
+	id, secret, err = parseApiKeyRef(apiKey.String())
+	require.Nil(t, err)
+	assert.Equal(t, int64(42), id)
+	assert.Equal(t, apiKey.Secret, secret)
+
+	_, _, err = parseApiKeyRef("notanumber")
+	assert.NotNil(t, err)
+}
+
+func TestSearchParams(t *testing.T) {
+	assert.Equal(t, `users\_ci\%\\`, escapeLike(`users_ci%\`))
+
+	req := listApiKeysRequest{SubPrefix: "users:", SortBy: SORT_BY_EXP, Order: "desc", Limit: 10}
+	require.Nil(t, req.Validate())
+	params, err := req.searchParams()
+	require.Nil(t, err)
+	assert.Equal(t, "users:%", params.SubPattern.String)
+	assert.Equal(t, int32(10), params.PageSize)
+	assert.True(t, params.SortDesc)
+	assert.False(t, params.CursorID.Valid)
+
+	exp := time.Now().UTC().Truncate(time.Second)
+	req.Cursor = (&searchCursor{SortBy: SORT_BY_EXP, Desc: true, Id: 5, Exp: &exp}).Encode()
+	params, err = req.searchParams()
+	require.Nil(t, err)
+	assert.Equal(t, int64(5), params.CursorID.Int64)
+	assert.True(t, exp.Equal(params.CursorExp.Time))
+
+	// cursor from another sort order
+	req.Order = "asc"
+	_, err = req.searchParams()
+	assert.NotNil(t, err)
+
+	req.Cursor = "garbage"
+	_, err = req.searchParams()
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, (&listApiKeysRequest{SortBy: "name"}).Validate())
+	assert.NotNil(t, (&listApiKeysRequest{Limit: SEARCH_MAX_LIMIT + 1}).Validate())
+	assert.NotNil(t, (&listApiKeysRequest{Extra: []byte("{")}).Validate())
+}
+
+func TestPublicKeyParam(t *testing.T) {
+	alg := algo.GetSignAlgorithm("ES256")
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	var publicKeyPem bytes.Buffer
+	algo.PublicKeyToPem(keys.Public, &publicKeyPem)
+	jwk, err := alg.PublicKeyToJWK(keys.Public)
+	require.Nil(t, err)
+
+	var pemReq createApiKeyRequest
+	pemJson, _ := json.Marshal(map[string]any{"sub": "a", "alg": "ES256", "publickey": publicKeyPem.String()})
+	require.Nil(t, json.Unmarshal(pemJson, &pemReq))
+	require.Nil(t, pemReq.Validate())
+	der, err := pemReq.PublicKey.Der(alg)
+	require.Nil(t, err)
+	assert.Equal(t, keys.Public, der)
+
+	var jwkReq createApiKeyRequest
+	jwkJson, _ := json.Marshal(map[string]any{"sub": "a", "alg": "ES256", "publickey": jwk})
+	require.Nil(t, json.Unmarshal(jwkJson, &jwkReq))
+	require.NotNil(t, jwkReq.PublicKey.JWK)
+	der, err = jwkReq.PublicKey.Der(alg)
+	require.Nil(t, err)
+	assert.Equal(t, keys.Public, der)
+
+	// key of another algorithm
+	_, err = jwkReq.PublicKey.Der(algo.GetSignAlgorithm("EdDSA"))
+	assert.NotNil(t, err)
+	_, err = pemReq.PublicKey.Der(algo.GetSignAlgorithm("RS256"))
+	assert.NotNil(t, err)
+
+	jwkReq.PublicKey.JWK.Alg = "ES256K"
+	_, err = jwkReq.PublicKey.Der(alg)
+	assert.NotNil(t, err)
+
+	_, err = (&publicKeyParam{Pem: "garbage"}).Der(alg)
+	assert.NotNil(t, err)
+	assert.False(t, (&publicKeyParam{}).IsSet())
+}
+
+func TestKeyJWK(t *testing.T) {
+	keys, err := algo.GetSignAlgorithm("EdDSA").Generate()
+	require.Nil(t, err)
+	jwk, err := keyJWK(42, "EdDSA", keys.Public)
+	require.Nil(t, err)
+	assert.Equal(t, "42", jwk.Kid)
+	assert.Equal(t, "EdDSA", jwk.Alg)
+	assert.Equal(t, "sig", jwk.Use)
+	assert.Equal(t, "OKP", jwk.Kty)
+
+	// keys without public key
+	jwk, err = keyJWK(42, "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, jwk)
+}
+
+func TestCreateApiKeyKeyPolicy(t *testing.T) {
+	a, err := NewApi(slog.Default(), nil, Config{ManageAuthDisabled: true, AllowedCurves: []string{"P-256"}})
+	require.Nil(t, err)
+	router := a.Routes("/")
+
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	weakDer, err := x509.MarshalPKIXPublicKey(&weakKey.PublicKey)
+	require.Nil(t, err)
+	var weakPem bytes.Buffer
+	algo.PublicKeyToPem(weakDer, &weakPem)
+	es384Keys, err := algo.GetSignAlgorithm("ES384").Generate()
+	require.Nil(t, err)
+	var es384Pem bytes.Buffer
+	algo.PublicKeyToPem(es384Keys.Public, &es384Pem)
+
+	for name, body := range map[string]map[string]any{
+		"weak rsa key":          {"sub": "a", "alg": "RS256", "publickey": weakPem.String()},
+		"curve not allowed":     {"sub": "a", "alg": "ES384", "publickey": es384Pem.String()},
+		"generated not allowed": {"sub": "a", "alg": "ES512"},
+		"key of another alg":    {"sub": "a", "alg": "ES256", "publickey": es384Pem.String()},
+		"unsupported key size":  {"sub": "a", "alg": "RS256", "key_size": 1024},
+		"key size for ec":       {"sub": "a", "alg": "ES256", "key_size": 2048},
+		"key size with import":  {"sub": "a", "alg": "RS256", "key_size": 2048, "publickey": weakPem.String()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, _ := json.Marshal(body)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/apikeys", bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, 400, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestGenerateKeysMinRSABits(t *testing.T) {
+	a, err := NewApi(slog.Default(), nil, Config{MinRSAKeyBits: 3072})
+	require.Nil(t, err)
+	alg := algo.GetSignAlgorithm("RS256")
+
+	keys, err := a.generateKeys(alg, 0)
+	require.Nil(t, err)
+	assert.Nil(t, a.keyPolicy().Check(alg, keys.Public))
+	jwk, err := alg.PublicKeyToJWK(keys.Public)
+	require.Nil(t, err)
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	require.Nil(t, err)
+	assert.Equal(t, 3072, 8*len(n))
+
+	// requested size is still checked by policy
+	keys, err = a.generateKeys(alg, 2048)
+	require.Nil(t, err)
+	assert.NotNil(t, a.keyPolicy().Check(alg, keys.Public))
+}
+
+func TestKeyAddress(t *testing.T) {
+	alg := algo.GetSignAlgorithm("ETH")
+	keys, err := alg.Generate()
+	require.Nil(t, err)
+	address, err := keyAddress("ETH", keys.Public)
+	require.Nil(t, err)
+	addressBytes, err := alg.(algo.AddressAlgorithm).ParseAddress(address)
+	require.Nil(t, err)
+	storedAddress, err := keyAddress("ETH", addressBytes)
+	require.Nil(t, err)
+	assert.Equal(t, address, storedAddress)
+
+	// address has no JWK
+	jwk, err := keyJWK(42, "ETH", addressBytes)
+	assert.Nil(t, err)
+	assert.Nil(t, jwk)
+	jwk, err = keyJWK(42, "ETH", keys.Public)
+	require.Nil(t, err)
+	assert.Equal(t, "secp256k1", jwk.Crv)
+
+	address, err = keyAddress("ES256K", keys.Public)
+	assert.Nil(t, err)
+	assert.Empty(t, address)
+}
+
+func TestCreateApiKeyInvalidAddress(t *testing.T) {
+	a, err := NewApi(slog.Default(), nil, Config{ManageAuthDisabled: true})
+	require.Nil(t, err)
+	router := a.Routes("/")
+
+	address := "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+	for name, body := range map[string]map[string]any{
+		"no alg":          {"sub": "a", "address": address},
+		"not supported":   {"sub": "a", "alg": "ES256K", "address": address},
+		"bad checksum":    {"sub": "a", "alg": "ETH", "address": "0x2C7536E3605D9C16a7a3D7b1898e529396a65c23"},
+		"with key size":   {"sub": "a", "alg": "ETH", "address": address, "key_size": 2048},
+		"with public key": {"sub": "a", "alg": "ETH", "address": address, "publickey": "key"},
+		"not hex":         {"sub": "a", "alg": "ETH", "address": "0xnothex"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, _ := json.Marshal(body)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/apikeys", bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, 400, w.Code, w.Body.String())
+		})
+	}
+}
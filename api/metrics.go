@@ -0,0 +1,145 @@
+package api
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NAMESPACE = "apikeyman"
+
+	OUTCOME_SUCCESS      = "success"
+	OUTCOME_UNAUTHORIZED = "unauthorized"
+	OUTCOME_FORBIDDEN    = "forbidden"
+	OUTCOME_RATE_LIMITED = "rate_limited"
+	OUTCOME_INVALID      = "invalid"
+	OUTCOME_ERROR        = "error"
+
+	// gin context key for algorithm of the key being checked, used as metrics label
+	ALG_CONTEXT_KEY = "alg"
+)
+
+type metrics struct {
+	registry    *prometheus.Registry
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	keysCreated *prometheus.CounterVec
+	handler     gin.HandlerFunc
+}
+
+// noMetricsHandler serves empty registry if api has no metrics
+var noMetricsHandler = gin.WrapH(promhttp.HandlerFor(prometheus.NewRegistry(), promhttp.HandlerOpts{}))
+
+// newMetrics creates registry with api, cache, db pool and runtime metrics
+func newMetrics(db *sql.DB, cache *ttlcache.Cache[int64, *queries.GetApiKeyForVerifyRow]) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "requests_total",
+			Help:      "Check and verify requests by endpoint, outcome and key algorithm",
+		}, []string{"endpoint", "outcome", "alg"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "request_duration_seconds",
+			Help:      "Check and verify request latency",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"endpoint"}),
+		keysCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "keys_created_total",
+			Help:      "Created API keys by algorithm",
+		}, []string{"alg"}),
+	}
+	m.registry.MustRegister(m.requests, m.duration, m.keysCreated,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, METRICS_NAMESPACE))
+	}
+
+	if cache != nil {
+		cacheCounter := func(name string, help string, value func(ttlcache.Metrics) uint64) prometheus.Collector {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: METRICS_NAMESPACE,
+				Subsystem: "cache",
+				Name:      name,
+				Help:      help,
+			}, func() float64 { return float64(value(cache.Metrics())) })
+		}
+		m.registry.MustRegister(
+			cacheCounter("hits_total", "Key cache hits", func(cm ttlcache.Metrics) uint64 { return cm.Hits }),
+			cacheCounter("misses_total", "Key cache misses", func(cm ttlcache.Metrics) uint64 { return cm.Misses }),
+			cacheCounter("insertions_total", "Key cache insertions", func(cm ttlcache.Metrics) uint64 { return cm.Insertions }),
+			cacheCounter("evictions_total", "Key cache evictions", func(cm ttlcache.Metrics) uint64 { return cm.Evictions }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: METRICS_NAMESPACE,
+				Subsystem: "cache",
+				Name:      "size",
+				Help:      "Number of cached keys",
+			}, func() float64 { return float64(cache.Len()) }),
+		)
+	}
+	m.handler = gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return m
+}
+
+func outcome(status int) string {
+	switch {
+	case status < 300:
+		return OUTCOME_SUCCESS
+	case status == 401:
+		return OUTCOME_UNAUTHORIZED
+	case status == 403:
+		return OUTCOME_FORBIDDEN
+	case status == 429:
+		return OUTCOME_RATE_LIMITED
+	case status < 500:
+		return OUTCOME_INVALID
+	default:
+		return OUTCOME_ERROR
+	}
+}
+
+func algLabel(alg string) string {
+	if alg == "" {
+		return "none"
+	}
+	return alg
+}
+
+// instrument is a middleware counting requests to endpoint by outcome and measuring latency
+func (m *metrics) instrument(endpoint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m == nil {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		m.duration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(endpoint, outcome(c.Writer.Status()), algLabel(c.GetString(ALG_CONTEXT_KEY))).Inc()
+	}
+}
+
+func (m *metrics) keyCreated(alg string) {
+	if m != nil {
+		m.keysCreated.WithLabelValues(algLabel(alg)).Inc()
+	}
+}
+
+func (m *metrics) serve(c *gin.Context) {
+	if m == nil {
+		noMetricsHandler(c)
+		return
+	}
+	m.handler(c)
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthMetrics(t *testing.T) {
+	a := newTestApi(t, Config{})
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:  1,
+		Alg: queries.NullAlgType{AlgType: "ES256", Valid: true},
+	})
+	router := a.Routes("/")
+
+	check := func(apiKey string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		router.ServeHTTP(w, req)
+	}
+	check(apiKey)
+	check((&ApiKey{Id: 1, Secret: algo.GenerateSecret()}).String())
+	check("invalid")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/health/metrics", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	body := w.Body.String()
+
+	assert.Contains(t, body, `apikeyman_requests_total{alg="ES256",endpoint="check",outcome="success"} 1`)
+	assert.Contains(t, body, `apikeyman_requests_total{alg="ES256",endpoint="check",outcome="unauthorized"} 1`)
+	assert.Contains(t, body, `apikeyman_requests_total{alg="none",endpoint="check",outcome="unauthorized"} 1`)
+	assert.Contains(t, body, `apikeyman_request_duration_seconds_count{endpoint="check"} 3`)
+	assert.Contains(t, body, "apikeyman_cache_hits_total 2")
+	assert.Contains(t, body, "apikeyman_cache_size 1")
+}
+
+func TestOutcome(t *testing.T) {
+	assert.Equal(t, OUTCOME_SUCCESS, outcome(200))
+	assert.Equal(t, OUTCOME_UNAUTHORIZED, outcome(401))
+	assert.Equal(t, OUTCOME_FORBIDDEN, outcome(403))
+	assert.Equal(t, OUTCOME_RATE_LIMITED, outcome(429))
+	assert.Equal(t, OUTCOME_INVALID, outcome(400))
+	assert.Equal(t, OUTCOME_ERROR, outcome(500))
+}
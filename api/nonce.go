@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jaspeen/apikeyman/db"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+const (
+	NONCE_STORE_MEMORY   = "memory"
+	NONCE_STORE_POSTGRES = "postgres"
+
+	// max number of nonces kept in memory if not configured
+	NONCE_MEMORY_DEFAULT_MAX_SIZE = 1000000
+)
+
+// ErrNonceStoreFull is returned when memory store has no room for a new nonce
+var ErrNonceStoreFull = errors.New("Nonce store is full")
+
+// NonceStore remembers nonces used with api key to reject replayed requests
+type NonceStore interface {
+	/*
+		Mark nonce as used for the key for ttl duration.
+		Return false if nonce was already used and not yet expired.
+	*/
+	Use(ctx context.Context, apiKeyId int64, nonce string, ttl time.Duration) (bool, error)
+}
+
+// NewNonceStore creates store of the type, maxSize limits memory store
+func NewNonceStore(storeType string, sqlDb *sql.DB, maxSize uint64) (NonceStore, error) {
+	switch storeType {
+	case "", NONCE_STORE_MEMORY:
+		return NewMemoryNonceStore(maxSize), nil
+	case NONCE_STORE_POSTGRES:
+		return NewPostgresNonceStore(sqlDb), nil
+	default:
+		return nil, ErrUnknownNonceStore
+	}
+}
+
+/*
+MemoryNonceStore keeps nonces in process memory, suitable for single replica deployments.
+Store holds at most maxSize nonces. When it is full new nonces are rejected with ErrNonceStoreFull,
+live nonces are never evicted because evicted nonce could be replayed.
+*/
+type MemoryNonceStore struct {
+	mu      sync.Mutex
+	maxSize uint64
+	cache   *ttlcache.Cache[string, struct{}]
+}
+
+// NewMemoryNonceStore creates store limited to maxSize nonces, NONCE_MEMORY_DEFAULT_MAX_SIZE if 0
+func NewMemoryNonceStore(maxSize uint64) *MemoryNonceStore {
+	if maxSize == 0 {
+		maxSize = NONCE_MEMORY_DEFAULT_MAX_SIZE
+	}
+	cache := ttlcache.New[string, struct{}](
+		ttlcache.WithCapacity[string, struct{}](maxSize),
+	)
+	// remove expired nonces in background
+	go cache.Start()
+	return &MemoryNonceStore{maxSize: maxSize, cache: cache}
+}
+
+func (s *MemoryNonceStore) Use(ctx context.Context, apiKeyId int64, nonce string, ttl time.Duration) (bool, error) {
+	key := strconv.FormatInt(apiKeyId, 10) + ":" + nonce
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// check room before inserting, cache would evict the oldest nonce otherwise
+	if uint64(s.cache.Len()) >= s.maxSize && !s.cache.Has(key) {
+		s.cache.DeleteExpired()
+		if uint64(s.cache.Len()) >= s.maxSize {
+			return false, ErrNonceStoreFull
+		}
+	}
+	_, found := s.cache.GetOrSet(key, struct{}{}, ttlcache.WithTTL[string, struct{}](ttl))
+	return !found, nil
+}
+
+// PostgresNonceStore keeps nonces in database so they are shared between replicas
+type PostgresNonceStore struct {
+	Db *sql.DB
+	// how often expired nonces are deleted
+	CleanupInterval time.Duration
+
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewPostgresNonceStore(sqlDb *sql.DB) *PostgresNonceStore {
+	return &PostgresNonceStore{Db: sqlDb, CleanupInterval: time.Minute}
+}
+
+func (s *PostgresNonceStore) Use(ctx context.Context, apiKeyId int64, nonce string, ttl time.Duration) (bool, error) {
+	s.cleanupIfNeeded()
+	rows, err := db.Queries.UseNonce(ctx, s.Db, queries.UseNonceParams{
+		ApikeyID: apiKeyId,
+		Nonce:    nonce,
+		Exp:      time.Now().Add(ttl),
+	})
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (s *PostgresNonceStore) cleanupIfNeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastCleanup) < s.CleanupInterval {
+		return
+	}
+	s.lastCleanup = time.Now()
+	go func() {
+		if err := db.Queries.DeleteExpiredNonces(context.Background(), s.Db); err != nil {
+			slog.Error("Failed to delete expired nonces", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := api.NewMemoryNonceStore(0)
+	ctx := context.Background()
+
+	ok, err := store.Use(ctx, 1, "nonce", 100*time.Millisecond)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = store.Use(ctx, 1, "nonce", 100*time.Millisecond)
+	require.Nil(t, err)
+	assert.False(t, ok, "nonce reused")
+
+	ok, err = store.Use(ctx, 2, "nonce", 100*time.Millisecond)
+	require.Nil(t, err)
+	assert.True(t, ok, "same nonce for other key")
+
+	time.Sleep(150 * time.Millisecond)
+	ok, err = store.Use(ctx, 1, "nonce", 100*time.Millisecond)
+	require.Nil(t, err)
+	assert.True(t, ok, "nonce expired")
+}
+
+func TestMemoryNonceStoreFull(t *testing.T) {
+	store := api.NewMemoryNonceStore(2)
+	ctx := context.Background()
+
+	for _, nonce := range []string{"n1", "n2"} {
+		ok, err := store.Use(ctx, 1, nonce, 100*time.Millisecond)
+		require.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	_, err := store.Use(ctx, 1, "n3", 100*time.Millisecond)
+	assert.ErrorIs(t, err, api.ErrNonceStoreFull)
+
+	ok, err := store.Use(ctx, 1, "n1", 100*time.Millisecond)
+	require.Nil(t, err)
+	assert.False(t, ok, "live nonce is not evicted")
+
+	time.Sleep(150 * time.Millisecond)
+	ok, err = store.Use(ctx, 1, "n3", 100*time.Millisecond)
+	require.Nil(t, err)
+	assert.True(t, ok, "expired nonces make room")
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaspeen/apikeyman/db"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+const (
+	RATE_LIMIT_STORE_MEMORY   = "memory"
+	RATE_LIMIT_STORE_POSTGRES = "postgres"
+
+	RATE_LIMIT_LIMIT_HEADER     = "X-RateLimit-Limit"
+	RATE_LIMIT_REMAINING_HEADER = "X-RateLimit-Remaining"
+	RATE_LIMIT_RESET_HEADER     = "X-RateLimit-Reset"
+	RETRY_AFTER_HEADER          = "Retry-After"
+
+	// buckets not used for this time are dropped, they are full anyway
+	RATE_LIMIT_IDLE_TTL = time.Hour
+)
+
+var ErrRateLimited = errors.New("Rate limit exceeded")
+
+// ErrRateLimiterFailed is returned if rate limiter backend can't be used, request is not authorized then
+var ErrRateLimiterFailed = errors.New("Rate limiter failed")
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst tokens
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type RateLimitResult struct {
+	Allowed bool
+	// tokens left after the request
+	Remaining float64
+}
+
+// RetryAfter returns time until the next token is available
+func (r *RateLimitResult) RetryAfter(limit RateLimit) time.Duration {
+	if r.Remaining >= 1 {
+		return 0
+	}
+	return time.Duration((1 - r.Remaining) / limit.Rate * float64(time.Second))
+}
+
+// Reset returns time until the bucket is full
+func (r *RateLimitResult) Reset(limit RateLimit) time.Duration {
+	return time.Duration((float64(limit.Burst) - r.Remaining) / limit.Rate * float64(time.Second))
+}
+
+// RateLimiter takes a token from per key bucket
+type RateLimiter interface {
+	Take(ctx context.Context, apiKeyId int64, limit RateLimit) (RateLimitResult, error)
+}
+
+func NewRateLimiter(storeType string, sqlDb *sql.DB) (RateLimiter, error) {
+	switch storeType {
+	case "", RATE_LIMIT_STORE_MEMORY:
+		return NewMemoryRateLimiter(), nil
+	case RATE_LIMIT_STORE_POSTGRES:
+		return NewPostgresRateLimiter(sqlDb), nil
+	default:
+		return nil, ErrUnknownRateLimitStore
+	}
+}
+
+type bucket struct {
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryRateLimiter keeps buckets in process memory, limits are per replica
+type MemoryRateLimiter struct {
+	buckets *ttlcache.Cache[int64, *bucket]
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	buckets := ttlcache.New[int64, *bucket](ttlcache.WithTTL[int64, *bucket](RATE_LIMIT_IDLE_TTL))
+	go buckets.Start()
+	return &MemoryRateLimiter{buckets: buckets}
+}
+
+func (l *MemoryRateLimiter) Take(ctx context.Context, apiKeyId int64, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now()
+	item, _ := l.buckets.GetOrSet(apiKeyId, &bucket{tokens: float64(limit.Burst), updated: now})
+	b := item.Value()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return RateLimitResult{Allowed: false, Remaining: b.tokens}, nil
+	}
+	b.tokens--
+	return RateLimitResult{Allowed: true, Remaining: b.tokens}, nil
+}
+
+// PostgresRateLimiter keeps buckets in database so limits are shared between replicas
+type PostgresRateLimiter struct {
+	Db *sql.DB
+	// how often idle buckets are deleted
+	CleanupInterval time.Duration
+
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewPostgresRateLimiter(sqlDb *sql.DB) *PostgresRateLimiter {
+	return &PostgresRateLimiter{Db: sqlDb, CleanupInterval: time.Minute}
+}
+
+func (l *PostgresRateLimiter) Take(ctx context.Context, apiKeyId int64, limit RateLimit) (RateLimitResult, error) {
+	l.cleanupIfNeeded()
+	tokens, err := db.Queries.TakeRateLimitToken(ctx, l.Db, queries.TakeRateLimitTokenParams{
+		ApikeyID: apiKeyId,
+		Burst:    float64(limit.Burst),
+		Rate:     limit.Rate,
+	})
+	if err == nil {
+		return RateLimitResult{Allowed: true, Remaining: tokens}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return RateLimitResult{}, err
+	}
+	// not enough tokens, bucket was not updated
+	tokens, err = db.Queries.GetRateLimitTokens(ctx, l.Db, queries.GetRateLimitTokensParams{
+		ApikeyID: apiKeyId,
+		Burst:    float64(limit.Burst),
+		Rate:     limit.Rate,
+	})
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return RateLimitResult{Allowed: false, Remaining: tokens}, nil
+}
+
+func (l *PostgresRateLimiter) cleanupIfNeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.lastCleanup) < l.CleanupInterval {
+		return
+	}
+	l.lastCleanup = time.Now()
+	go func() {
+		if err := db.Queries.DeleteIdleRateLimits(context.Background(), l.Db, time.Now().Add(-RATE_LIMIT_IDLE_TTL)); err != nil {
+			slog.Error("Failed to delete idle rate limits", "error", err)
+		}
+	}()
+}
+
+// keyRateLimit returns rate limit configured for the key, burst defaults to rate rounded up
+func keyRateLimit(row *queries.GetApiKeyForVerifyRow) (RateLimit, bool) {
+	if !row.RateLimit.Valid || row.RateLimit.Float64 <= 0 {
+		return RateLimit{}, false
+	}
+	limit := RateLimit{Rate: row.RateLimit.Float64, Burst: int(math.Ceil(row.RateLimit.Float64))}
+	if row.RateBurst.Valid && row.RateBurst.Int32 > 0 {
+		limit.Burst = int(row.RateBurst.Int32)
+	}
+	return limit, true
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// takeRateLimit enforces key rate limit, setting X-RateLimit-* headers and Retry-After if exceeded
+func (a *Api) takeRateLimit(c *gin.Context, row *queries.GetApiKeyForVerifyRow) error {
+	if a.RateLimiter == nil {
+		return nil
+	}
+	limit, ok := keyRateLimit(row)
+	if !ok {
+		return nil
+	}
+	res, err := a.RateLimiter.Take(c.Request.Context(), row.ID, limit)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to take rate limit token: %s", err))
+		return fmt.Errorf("%w: %w", ErrRateLimiterFailed, err)
+	}
+	c.Header(RATE_LIMIT_LIMIT_HEADER, strconv.Itoa(limit.Burst))
+	c.Header(RATE_LIMIT_REMAINING_HEADER, strconv.Itoa(int(math.Max(0, math.Floor(res.Remaining)))))
+	c.Header(RATE_LIMIT_RESET_HEADER, ceilSeconds(res.Reset(limit)))
+	if !res.Allowed {
+		c.Header(RETRY_AFTER_HEADER, ceilSeconds(res.RetryAfter(limit)))
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// respondAuthError responds 429 if rate limit is exceeded, 500 if rate limiter failed and 401 otherwise
+func respondAuthError(c *gin.Context, err error) {
+	if errors.Is(err, ErrRateLimited) {
+		setAuthFailure(c, CODE_RATE_LIMITED)
+		c.JSON(429, errorResponse{Error: "Too many requests", Code: CODE_RATE_LIMITED})
+		return
+	}
+	if errors.Is(err, ErrRateLimiterFailed) {
+		respondInternalServerError(c)
+		return
+	}
+	respondUnauthorized(c)
+}
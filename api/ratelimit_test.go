@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	ctx := context.Background()
+	limit := RateLimit{Rate: 10, Burst: 2}
+
+	res, err := limiter.Take(ctx, 1, limit)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.InDelta(t, 1, res.Remaining, 0.1)
+
+	res, err = limiter.Take(ctx, 1, limit)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed)
+
+	res, err = limiter.Take(ctx, 1, limit)
+	require.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.InDelta(t, 100*time.Millisecond, res.RetryAfter(limit), float64(10*time.Millisecond))
+
+	res, err = limiter.Take(ctx, 2, limit)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed, "other key has own bucket")
+
+	time.Sleep(110 * time.Millisecond)
+	res, err = limiter.Take(ctx, 1, limit)
+	require.Nil(t, err)
+	assert.True(t, res.Allowed, "token refilled")
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	a := newTestApi(t, Config{})
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:        1,
+		RateLimit: sql.NullFloat64{Float64: 0.5, Valid: true},
+		RateBurst: sql.NullInt32{Int32: 2, Valid: true},
+	})
+	router := a.Routes("/")
+
+	check := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/check", nil)
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := check()
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Header().Get(RATE_LIMIT_LIMIT_HEADER))
+	assert.Equal(t, "1", w.Header().Get(RATE_LIMIT_REMAINING_HEADER))
+	assert.Equal(t, "2", w.Header().Get(RATE_LIMIT_RESET_HEADER))
+
+	w = check()
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "0", w.Header().Get(RATE_LIMIT_REMAINING_HEADER))
+
+	w = check()
+	require.Equal(t, 429, w.Code)
+	assert.Equal(t, "2", w.Header().Get(RETRY_AFTER_HEADER))
+	assert.Contains(t, w.Body.String(), CODE_RATE_LIMITED)
+}
+
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Take(ctx context.Context, apiKeyId int64, limit RateLimit) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("database is down")
+}
+
+func TestCheckRateLimiterFailure(t *testing.T) {
+	a := newTestApi(t, Config{})
+	a.RateLimiter = failingRateLimiter{}
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:        1,
+		RateLimit: sql.NullFloat64{Float64: 0.5, Valid: true},
+	})
+	router := a.Routes("/")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/check", nil)
+	req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 500, w.Code)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaspeen/apikeyman/algo"
+)
+
+const (
+	// request token in /check and /verify response
+	ISSUE_TOKEN_QUERY_PARAM = "issue_token"
+	ISSUE_TOKEN_HEADER      = "X-Issue-Token"
+
+	TOKEN_DEFAULT_ALG = "ES256"
+
+	// gin context key set by /token to respond with token instead of check response
+	TOKEN_RESPONSE_CONTEXT_KEY = "token_response"
+)
+
+// TokenIssuer mints short-lived JWTs for authenticated keys signed with server key
+type TokenIssuer struct {
+	alg        algo.SignAlgorithm
+	privateKey []byte
+	jwk        algo.JWK
+	issuer     string
+	ttl        time.Duration
+}
+
+/*
+NewTokenIssuer creates issuer signing tokens with PKCS8 DER private key.
+Key is generated if privateKey is nil, such tokens can't be verified after restart or by other replicas' keys.
+*/
+func NewTokenIssuer(algName string, privateKey []byte, issuer string, ttl time.Duration) (*TokenIssuer, error) {
+	if algName == "" {
+		algName = TOKEN_DEFAULT_ALG
+	}
+	alg := algo.GetSignAlgorithm(algName)
+	if alg == nil {
+		return nil, fmt.Errorf("unknown token algorithm '%s'", algName)
+	}
+	if privateKey == nil {
+		keys, err := alg.Generate()
+		if err != nil {
+			return nil, err
+		}
+		privateKey = keys.Private
+	}
+	publicKey, err := algo.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	jwk, err := alg.PublicKeyToJWK(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	// fail early if key doesn't match algorithm
+	if _, err := alg.Sign(privateKey, nil); err != nil {
+		return nil, fmt.Errorf("token key doesn't match algorithm '%s': %w", algName, err)
+	}
+	jwk.Kid = jwk.Thumbprint()
+	jwk.Alg = algName
+	jwk.Use = "sig"
+	return &TokenIssuer{alg: alg, privateKey: privateKey, jwk: *jwk, issuer: issuer, ttl: ttl}, nil
+}
+
+type tokenClaims struct {
+	Iss      string          `json:"iss,omitempty"`
+	Sub      string          `json:"sub"`
+	Iat      int64           `json:"iat"`
+	Exp      int64           `json:"exp"`
+	Jti      string          `json:"jti"`
+	ApiKeyId string          `json:"apikey_id"`
+	Scope    string          `json:"scope,omitempty"`
+	Extra    json.RawMessage `json:"extra,omitempty"`
+}
+
+// Issue returns signed token with key subject, id, scopes and extra
+func (t *TokenIssuer) Issue(apiKeyData *apiKeyData) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(tokenClaims{
+		Iss:      t.issuer,
+		Sub:      apiKeyData.Sub.String,
+		Iat:      now.Unix(),
+		Exp:      now.Add(t.ttl).Unix(),
+		Jti:      base64.RawURLEncoding.EncodeToString(jti),
+		ApiKeyId: strconv.FormatInt(apiKeyData.ID, 10),
+		Scope:    strings.Join(apiKeyData.Scopes, " "),
+		Extra:    apiKeyData.Extra.RawMessage,
+	})
+	if err != nil {
+		return "", err
+	}
+	return algo.SignJWS(t.alg, t.privateKey, algo.JWSHeader{Typ: "JWT", Kid: t.jwk.Kid}, claims)
+}
+
+// JWKS returns public keys to verify issued tokens
+func (t *TokenIssuer) JWKS() algo.JWKS {
+	return algo.JWKS{Keys: []algo.JWK{t.jwk}}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// tokenRequested returns true if caller asked to include token in check response
+func tokenRequested(c *gin.Context) bool {
+	value := c.Query(ISSUE_TOKEN_QUERY_PARAM)
+	if value == "" {
+		value = c.Request.Header.Get(ISSUE_TOKEN_HEADER)
+	}
+	requested, _ := strconv.ParseBool(value)
+	return requested
+}
+
+// issueToken responds 400 if tokens are not enabled and 500 if signing failed
+func (a *Api) issueToken(c *gin.Context, apiKeyData *apiKeyData) (string, bool) {
+	if a.Tokens == nil {
+		c.JSON(400, errorResponse{Error: "Token issuing is not enabled"})
+		return "", false
+	}
+	token, err := a.Tokens.Issue(apiKeyData)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to issue token: %s", err))
+		respondInternalServerError(c)
+		return "", false
+	}
+	return token, true
+}
+
+func (a *Api) respondToken(c *gin.Context, apiKeyData *apiKeyData) {
+	token, ok := a.issueToken(c, apiKeyData)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(200, tokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresIn: int(a.Tokens.ttl.Seconds())})
+}
+
+// Token exchanges API key, optionally with signature like /checkorverify, for short-lived JWT
+func (a *Api) Token(c *gin.Context) {
+	c.Set(TOKEN_RESPONSE_CONTEXT_KEY, true)
+	a.verifyInternal(c, true)
+}
+
+func (a *Api) JWKS(c *gin.Context) {
+	if a.Tokens == nil {
+		c.JSON(200, algo.JWKS{Keys: []algo.JWK{}})
+		return
+	}
+	c.JSON(200, a.Tokens.JWKS())
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaspeen/apikeyman/algo"
+	"github.com/jaspeen/apikeyman/db/queries"
+	"github.com/sqlc-dev/pqtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// verifyToken checks token signature with issuer key and returns header and claims
+func verifyToken(t *testing.T, issuer *TokenIssuer, token string) (algo.JWSHeader, tokenClaims) {
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	publicKey, err := algo.PublicKeyFromPrivate(issuer.privateKey)
+	require.Nil(t, err)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.Nil(t, err)
+	signature, err = algo.ECDSASignatureFromRaw(signature)
+	require.Nil(t, err)
+	require.Nil(t, issuer.alg.ValidateSignature(publicKey, signature, []byte(parts[0]+"."+parts[1])))
+
+	var header algo.JWSHeader
+	data, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	require.Nil(t, json.Unmarshal(data, &header))
+	var claims tokenClaims
+	data, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	require.Nil(t, json.Unmarshal(data, &claims))
+	return header, claims
+}
+
+func TestIssueToken(t *testing.T) {
+	a := newTestApi(t, Config{
+		TokenTTL:          5 * time.Minute,
+		TokenKeyGenerated: true,
+		TokenIssuer:       "https://apikeyman.example.com",
+	})
+	apiKey := cacheKey(a, &queries.GetApiKeyForVerifyRow{
+		ID:     1,
+		Sub:    sql.NullString{String: "service_a", Valid: true},
+		Extra:  pqtype.NullRawMessage{RawMessage: []byte(`{"tier":"pro"}`), Valid: true},
+		Scopes: []string{"orders:read", "orders:write"},
+	})
+	router := a.Routes("/")
+
+	post := func(uri string, apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", uri, nil)
+		req.Header.Set(API_KEY_DEFAULT_HEADER, apiKey)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/check", apiKey)
+	require.Equal(t, 200, w.Code)
+	var resp checkResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Empty(t, resp.Token)
+
+	w = post("/check?issue_token=true", apiKey)
+	require.Equal(t, 200, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	header, claims := verifyToken(t, a.Tokens, resp.Token)
+	assert.Equal(t, "ES256", header.Alg)
+	assert.Equal(t, "service_a", claims.Sub)
+	assert.Equal(t, "1", claims.ApiKeyId)
+	assert.Equal(t, "https://apikeyman.example.com", claims.Iss)
+	assert.Equal(t, "orders:read orders:write", claims.Scope)
+	assert.JSONEq(t, `{"tier":"pro"}`, string(claims.Extra))
+	assert.Equal(t, int64(300), claims.Exp-claims.Iat)
+
+	w = post("/token", apiKey)
+	require.Equal(t, 200, w.Code)
+	var tokenResp tokenResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &tokenResp))
+	assert.Equal(t, "Bearer", tokenResp.TokenType)
+	assert.Equal(t, 300, tokenResp.ExpiresIn)
+	_, tokenClaims := verifyToken(t, a.Tokens, tokenResp.AccessToken)
+	assert.NotEqual(t, claims.Jti, tokenClaims.Jti)
+
+	assert.Equal(t, 401, post("/token", (&ApiKey{Id: 1, Secret: algo.GenerateSecret()}).String()).Code)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var jwks algo.JWKS
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, header.Kid, jwks.Keys[0].Kid)
+	assert.Equal(t, "ES256", jwks.Keys[0].Alg)
+	assert.Equal(t, "sig", jwks.Keys[0].Use)
+
+	// tokens disabled
+	a.Tokens = nil
+	assert.Equal(t, 400, post("/check?issue_token=true", apiKey).Code)
+}
+
+func TestTokenKeyRequired(t *testing.T) {
+	_, err := NewApi(slog.Default(), nil, Config{TokenTTL: 5 * time.Minute})
+	assert.ErrorIs(t, err, ErrTokenKeyRequired)
+
+	keys, err := algo.GetSignAlgorithm(TOKEN_DEFAULT_ALG).Generate()
+	require.Nil(t, err)
+	a, err := NewApi(slog.Default(), nil, Config{TokenTTL: 5 * time.Minute, TokenPrivateKey: keys.Private})
+	require.Nil(t, err)
+	assert.NotNil(t, a.Tokens)
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jaspeen/apikeyman/db"
+	"github.com/jaspeen/apikeyman/db/queries"
+)
+
+type usage struct {
+	count      int64
+	lastUsedAt time.Time
+	lastUsedIp string
+}
+
+/*
+UsageTracker aggregates successful key usages in memory and writes them to database
+in batches, so check and verify don't update the key on every request.
+Usages failed to write are kept until the next flush, not flushed ones are lost if the process is killed.
+*/
+type UsageTracker struct {
+	Db *sql.DB
+
+	mu      sync.Mutex
+	pending map[int64]*usage
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewUsageTracker creates tracker flushing usages every interval in background
+func NewUsageTracker(sqlDb *sql.DB, interval time.Duration) *UsageTracker {
+	t := &UsageTracker{
+		Db:      sqlDb,
+		pending: make(map[int64]*usage),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.run(interval)
+	return t
+}
+
+func (t *UsageTracker) Record(apiKeyId int64, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.pending[apiKeyId]
+	if !ok {
+		u = &usage{}
+		t.pending[apiKeyId] = u
+	}
+	u.count++
+	u.lastUsedAt = time.Now().UTC()
+	u.lastUsedIp = ip
+}
+
+// Flush writes pending usages to database
+func (t *UsageTracker) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[int64]*usage)
+	t.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	params := queries.RecordUsageParams{}
+	for id, u := range pending {
+		params.Ids = append(params.Ids, id)
+		params.Counts = append(params.Counts, u.count)
+		params.LastUsedAts = append(params.LastUsedAts, u.lastUsedAt)
+		params.LastUsedIps = append(params.LastUsedIps, u.lastUsedIp)
+	}
+	if err := db.Queries.RecordUsage(ctx, t.Db, params); err != nil {
+		t.restore(pending)
+		return err
+	}
+	return nil
+}
+
+// restore returns not written usages back to pending, so they are written by the next flush
+func (t *UsageTracker) restore(pending map[int64]*usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, u := range pending {
+		// usages recorded after the failed flush are newer
+		if current, ok := t.pending[id]; ok {
+			current.count += u.count
+		} else {
+			t.pending[id] = u
+		}
+	}
+}
+
+// Stop stops background flushing and flushes pending usages
+func (t *UsageTracker) Stop() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *UsageTracker) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flushAndLog()
+		case <-t.stop:
+			t.flushAndLog()
+			return
+		}
+	}
+}
+
+func (t *UsageTracker) flushAndLog() {
+	if err := t.Flush(context.Background()); err != nil {
+		slog.Error("Failed to record key usage", "error", err)
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageTrackerRecord(t *testing.T) {
+	tracker := &UsageTracker{pending: make(map[int64]*usage)}
+	tracker.Record(1, "10.0.0.1")
+	tracker.Record(1, "10.0.0.2")
+	tracker.Record(2, "10.0.0.3")
+
+	require.Len(t, tracker.pending, 2)
+	assert.Equal(t, int64(2), tracker.pending[1].count)
+	assert.Equal(t, "10.0.0.2", tracker.pending[1].lastUsedIp)
+	assert.False(t, tracker.pending[1].lastUsedAt.IsZero())
+	assert.Equal(t, int64(1), tracker.pending[2].count)
+
+	// nothing to write, database is not touched
+	tracker.pending = make(map[int64]*usage)
+	assert.Nil(t, tracker.Flush(context.Background()))
+}
+
+func TestUsageTrackerFlushFailure(t *testing.T) {
+	sqlDb, err := sql.Open("postgres", "host=/nonexistent")
+	require.Nil(t, err)
+	sqlDb.Close()
+	tracker := &UsageTracker{Db: sqlDb, pending: make(map[int64]*usage)}
+	tracker.Record(1, "10.0.0.1")
+	tracker.Record(1, "10.0.0.2")
+
+	// usages are kept for the next flush
+	assert.NotNil(t, tracker.Flush(context.Background()))
+	require.Len(t, tracker.pending, 1)
+	assert.Equal(t, int64(2), tracker.pending[1].count)
+	assert.Equal(t, "10.0.0.2", tracker.pending[1].lastUsedIp)
+
+	tracker.Record(1, "10.0.0.3")
+	assert.Equal(t, int64(3), tracker.pending[1].count)
+	assert.Equal(t, "10.0.0.3", tracker.pending[1].lastUsedIp)
+}
@@ -0,0 +1,146 @@
+// Package canonical builds canonical request string which is signed instead of body only,
+// so signature can't be reused for another method, path or query.
+// Server and command line share this code to produce identical strings.
+package canonical
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// sign body concatenated with timestamp and nonce
+	MODE_BODY = "body"
+	// sign canonical request
+	MODE_CANONICAL = "canonical"
+)
+
+var ErrUnknownMode = errors.New("unknown sign mode")
+
+func ValidateMode(mode string) error {
+	if mode != MODE_BODY && mode != MODE_CANONICAL {
+		return ErrUnknownMode
+	}
+	return nil
+}
+
+type Request struct {
+	Method string
+	// path with optional query, e.g. /orders?id=1
+	URI    string
+	Header http.Header
+	// names of headers to include, order doesn't matter
+	SignedHeaders []string
+	Body          []byte
+	Timestamp     string
+	Nonce         string
+	// query parameters excluded from canonical query, e.g. api key or signature passed in query
+	IgnoreQueryParams []string
+}
+
+/*
+Build canonical request string. Lines are separated by '\n':
+
+	METHOD
+	/escaped/path
+	sorted=query&params=escaped
+	header1:value
+	header2:value
+	header1;header2
+	hex(sha256(body))
+	timestamp
+	nonce
+
+Header names are lowercased and sorted, multiple values are joined with ','.
+Missing headers are included with empty value.
+*/
+func (r *Request) Build() ([]byte, error) {
+	u, err := url.ParseRequestURI(r.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(r.Method))
+	sb.WriteByte('\n')
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	sb.WriteString(path)
+	sb.WriteByte('\n')
+
+	sb.WriteString(canonicalQuery(u.Query(), r.IgnoreQueryParams))
+	sb.WriteByte('\n')
+
+	names := canonicalHeaderNames(r.SignedHeaders)
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		sb.WriteString(headerValue(r.Header, name))
+		sb.WriteByte('\n')
+	}
+	sb.WriteString(strings.Join(names, ";"))
+	sb.WriteByte('\n')
+
+	bodyHash := sha256.Sum256(r.Body)
+	sb.WriteString(hex.EncodeToString(bodyHash[:]))
+	sb.WriteByte('\n')
+
+	sb.WriteString(r.Timestamp)
+	sb.WriteByte('\n')
+	sb.WriteString(r.Nonce)
+
+	return []byte(sb.String()), nil
+}
+
+func canonicalQuery(query url.Values, ignore []string) string {
+	for _, name := range ignore {
+		query.Del(name)
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func canonicalHeaderNames(headers []string) []string {
+	names := make([]string, 0, len(headers))
+	seen := make(map[string]bool)
+	for _, h := range headers {
+		name := strings.ToLower(strings.TrimSpace(h))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func headerValue(header http.Header, name string) string {
+	values := header.Values(name)
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ",")
+}
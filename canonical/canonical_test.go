@@ -0,0 +1,47 @@
+package canonical_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/canonical"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Add("X-Custom", " a ")
+	header.Add("X-Custom", "b")
+
+	req := canonical.Request{
+		Method:            "post",
+		URI:               "/orders/new%20one?b=2&a=3&a=1&apikey=secret",
+		Header:            header,
+		SignedHeaders:     []string{"X-Custom", "content-type", "X-Missing"},
+		Body:              []byte("test data"),
+		Timestamp:         "1718000000",
+		Nonce:             "abc",
+		IgnoreQueryParams: []string{"apikey"},
+	}
+	res, err := req.Build()
+	require.Nil(t, err)
+	assert.Equal(t, "POST\n"+
+		"/orders/new%20one\n"+
+		"a=1&a=3&b=2\n"+
+		"content-type:application/json\n"+
+		"x-custom:a,b\n"+
+		"x-missing:\n"+
+		"content-type;x-custom;x-missing\n"+
+		"916f0027a575074ce72a331777c3478d6513f786a591bd892da1a577bf2335f9\n"+
+		"1718000000\n"+
+		"abc", string(res))
+}
+
+func TestBuildEmpty(t *testing.T) {
+	req := canonical.Request{Method: "GET", URI: "/"}
+	res, err := req.Build()
+	require.Nil(t, err)
+	assert.Equal(t, "GET\n/\n\n\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n\n", string(res))
+}
@@ -7,10 +7,11 @@ test_dir="./files"
 
 mkdir -p ${test_dir}
 
-# args: akm_name, openssl_name
+# args: akm_name, openssl_name, digest (sha256 if omitted)
 ec_openssl_gen_akm_sign() {
   akm_name="$1"
   openssl_name="$2"
+  digest="${3:-sha256}"
   echo "ec_openssl_gen_akm_sign for akm_name=${akm_name}, openssl_name=${openssl_name}."
 
   # generate private key
@@ -32,15 +33,16 @@ ec_openssl_gen_akm_sign() {
 
   # verify with openssl
   echo -n "${signature}" | openssl enc -d -A -base64 > ${test_dir}/openssl-${akm_name}.sig.bin
-  echo -n "${testdata}" | openssl dgst -sha256 -verify ${test_dir}/openssl-${akm_name}.pub.pem -signature ${test_dir}/openssl-${akm_name}.sig.bin
+  echo -n "${testdata}" | openssl dgst -${digest} -verify ${test_dir}/openssl-${akm_name}.pub.pem -signature ${test_dir}/openssl-${akm_name}.sig.bin
 
   echo "Success"
 }
 
-# args: akm_name, openssl_name
+# args: akm_name, openssl_name, digest (sha256 if omitted)
 ec_akm_gen_openssl_sign() {
   akm_name="$1"
   openssl_name="$2"
+  digest="${3:-sha256}"
   echo "ec_akm_gen_openssl_sign for akm_name=${akm_name}, openssl_name=${openssl_name}."
 
   # generate keypair
@@ -48,7 +50,7 @@ ec_akm_gen_openssl_sign() {
 
   # sign with openssl
   testdata="test data"
-  signature=$(echo -n "${testdata}" | openssl dgst -sha256 -sign ${test_dir}/${akm_name}.priv.pem | openssl enc -base64 -A)
+  signature=$(echo -n "${testdata}" | openssl dgst -${digest} -sign ${test_dir}/${akm_name}.priv.pem | openssl enc -base64 -A)
   echo "Signature: ${signature}"
 
   # verify with akm
@@ -56,7 +58,7 @@ ec_akm_gen_openssl_sign() {
 
   # verify with openssl
   echo -n "${signature}" | openssl enc -d -A -base64 > ${test_dir}/${akm_name}.sig.bin
-  echo -n "${testdata}" | openssl dgst -sha256 -verify ${test_dir}/${akm_name}.pub.pem -signature ${test_dir}/${akm_name}.sig.bin
+  echo -n "${testdata}" | openssl dgst -${digest} -verify ${test_dir}/${akm_name}.pub.pem -signature ${test_dir}/${akm_name}.sig.bin
   echo "Success"
 }
 
@@ -166,7 +168,7 @@ rsa_akm_gen_openssl_sign() {
 
   # sign with openssl
   
-  #signature=$(echo -n "${testdata}" | openssl dgst -sha256 -sign ${test_dir}/${akm_name}.priv.pem | openssl enc -base64 -A)
+  #signature=$(echo -n "${testdata}" | openssl dgst -${digest} -sign ${test_dir}/${akm_name}.priv.pem | openssl enc -base64 -A)
   signature=$(openssl pkeyutl -sign -inkey ${test_dir}/${akm_name}.priv.pem -rawin -in ${test_dir}/${akm_name}.data.bin | openssl enc -base64 -A)
   echo "Signature: ${signature}"
 
@@ -180,16 +182,86 @@ rsa_akm_gen_openssl_sign() {
   echo "Success"
 }
 
+# args: akm_name, digest
+rsa_pss_openssl_gen_akm_sign() {
+  akm_name="$1"
+  digest="$2"
+  echo "rsa_pss_openssl_gen_akm_sign for akm_name=${akm_name}, digest=${digest}."
+
+  # generate private key
+  openssl genpkey -algorithm rsa -pkeyopt rsa_keygen_bits:2048 -out ${test_dir}/openssl-${akm_name}.priv.pem
+
+  # generate pub key from private
+  openssl pkey -in ${test_dir}/openssl-${akm_name}.priv.pem -pubout -out ${test_dir}/openssl-${akm_name}.pub.pem
+
+  # test data
+  testdata="test data"
+  echo -n "${testdata}" > ${test_dir}/openssl-${akm_name}.data.bin
+
+  # sign with akm
+  signature=$(echo -n "${testdata}" | $akm_cmd sign -a ${akm_name} --private ${test_dir}/openssl-${akm_name}.priv.pem)
+  echo "Signature: ${signature}"
+
+  # verify with akm
+  echo -n "${testdata}" | $akm_cmd verify -a ${akm_name} --public ${test_dir}/openssl-${akm_name}.pub.pem --signature "${signature}"
+
+  # verify with openssl, salt length is equal to digest length
+  echo -n "${signature}" | openssl enc -d -A -base64 > ${test_dir}/openssl-${akm_name}.sig.bin
+  openssl dgst -${digest} -verify ${test_dir}/openssl-${akm_name}.pub.pem -sigopt rsa_padding_mode:pss -sigopt rsa_pss_saltlen:digest -signature ${test_dir}/openssl-${akm_name}.sig.bin ${test_dir}/openssl-${akm_name}.data.bin
+
+  echo "Success"
+}
+
+# args: akm_name, digest
+rsa_pss_akm_gen_openssl_sign() {
+  akm_name="$1"
+  digest="$2"
+  echo "rsa_pss_akm_gen_openssl_sign for akm_name=${akm_name}, digest=${digest}."
+
+  # generate keypair
+  $akm_cmd gen -a ${akm_name} --private ${test_dir}/${akm_name}.priv.pem --public ${test_dir}/${akm_name}.pub.pem
+
+  # test data
+  testdata="test data"
+  echo -n "${testdata}" > ${test_dir}/${akm_name}.data.bin
+
+  # sign with openssl
+  signature=$(openssl dgst -${digest} -sign ${test_dir}/${akm_name}.priv.pem -sigopt rsa_padding_mode:pss -sigopt rsa_pss_saltlen:digest ${test_dir}/${akm_name}.data.bin | openssl enc -base64 -A)
+  echo "Signature: ${signature}"
+
+  # verify with akm
+  echo -n "${testdata}" | $akm_cmd verify -a ${akm_name} --public ${test_dir}/${akm_name}.pub.pem --signature "${signature}"
+
+  # verify with openssl
+  echo -n "${signature}" | openssl enc -d -A -base64 > ${test_dir}/${akm_name}.sig.bin
+  openssl dgst -${digest} -verify ${test_dir}/${akm_name}.pub.pem -sigopt rsa_padding_mode:pss -sigopt rsa_pss_saltlen:digest -signature ${test_dir}/${akm_name}.sig.bin ${test_dir}/${akm_name}.data.bin
+
+  echo "Success"
+}
+
 ec_openssl_gen_akm_sign "ES256K" "secp256k1"
 ec_akm_gen_openssl_sign "ES256K" "secp256k1"
 
 ec_openssl_gen_akm_sign "ES256" "prime256v1"
 ec_akm_gen_openssl_sign "ES256" "prime256v1"
 
+ec_openssl_gen_akm_sign "ES384" "secp384r1" "sha384"
+ec_akm_gen_openssl_sign "ES384" "secp384r1" "sha384"
+
+ec_openssl_gen_akm_sign "ES512" "secp521r1" "sha512"
+ec_akm_gen_openssl_sign "ES512" "secp521r1" "sha512"
+
 ed_openssl_gen_akm_sign "EdDSA" "Ed25519"
 ed_akm_gen_openssl_sign "EdDSA" "Ed25519"
 
 rsa_openssl_gen_akm_sign "RS256" "rsa"
 rsa_akm_gen_openssl_sign "RS256" "rsa"
 
+rsa_pss_openssl_gen_akm_sign "PS256" "sha256"
+rsa_pss_akm_gen_openssl_sign "PS256" "sha256"
+rsa_pss_openssl_gen_akm_sign "PS384" "sha384"
+rsa_pss_akm_gen_openssl_sign "PS384" "sha384"
+rsa_pss_openssl_gen_akm_sign "PS512" "sha512"
+rsa_pss_akm_gen_openssl_sign "PS512" "sha512"
+
 echo "All tests passed!"
\ No newline at end of file
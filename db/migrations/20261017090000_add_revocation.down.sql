@@ -0,0 +1,3 @@
+ALTER TABLE apikey DROP COLUMN revoked_at,
+  DROP COLUMN revoked_by,
+  DROP COLUMN reason;
\ No newline at end of file
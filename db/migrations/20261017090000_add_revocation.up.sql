@@ -0,0 +1,4 @@
+ALTER TABLE apikey
+ADD COLUMN revoked_at timestamptz,
+  ADD COLUMN revoked_by text,
+  ADD COLUMN reason text;
\ No newline at end of file
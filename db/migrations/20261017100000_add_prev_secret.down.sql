@@ -0,0 +1,2 @@
+ALTER TABLE apikey DROP COLUMN prev_sec,
+  DROP COLUMN prev_sec_exp;
\ No newline at end of file
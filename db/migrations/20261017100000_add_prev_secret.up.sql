@@ -0,0 +1,3 @@
+ALTER TABLE apikey
+ADD COLUMN prev_sec bytea,
+  ADD COLUMN prev_sec_exp timestamptz;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE nonce;
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE nonce (
+  apikey_id bigint NOT NULL,
+  nonce text NOT NULL,
+  exp timestamptz NOT NULL,
+  PRIMARY KEY (apikey_id, nonce)
+);
+CREATE INDEX idx_nonce_exp ON nonce (exp);
\ No newline at end of file
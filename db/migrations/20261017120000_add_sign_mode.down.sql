@@ -0,0 +1 @@
+ALTER TABLE apikey DROP COLUMN sign_mode;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE apikey
+ADD COLUMN sign_mode text;
\ No newline at end of file
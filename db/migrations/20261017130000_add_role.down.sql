@@ -0,0 +1 @@
+ALTER TABLE apikey DROP COLUMN role;
\ No newline at end of file
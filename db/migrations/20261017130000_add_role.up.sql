@@ -0,0 +1,2 @@
+ALTER TABLE apikey
+ADD COLUMN role text;
\ No newline at end of file
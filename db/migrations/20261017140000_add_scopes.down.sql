@@ -0,0 +1 @@
+ALTER TABLE apikey DROP COLUMN scopes;
\ No newline at end of file
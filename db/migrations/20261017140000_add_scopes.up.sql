@@ -0,0 +1,2 @@
+ALTER TABLE apikey
+ADD COLUMN scopes text[];
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE apikey DROP COLUMN version,
+  DROP COLUMN updated_at;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE apikey
+ADD COLUMN version bigint NOT NULL DEFAULT 1,
+  ADD COLUMN updated_at timestamptz;
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX idx_apikey_sub_pattern;
+DROP INDEX idx_apikey_name;
+DROP INDEX idx_apikey_exp;
+DROP INDEX idx_apikey_extra;
\ No newline at end of file
@@ -0,0 +1,4 @@
+CREATE INDEX idx_apikey_sub_pattern ON apikey (sub text_pattern_ops, id);
+CREATE INDEX idx_apikey_name ON apikey (name, id);
+CREATE INDEX idx_apikey_exp ON apikey (exp, id);
+CREATE INDEX idx_apikey_extra ON apikey USING gin (extra jsonb_path_ops);
\ No newline at end of file
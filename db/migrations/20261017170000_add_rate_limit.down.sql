@@ -0,0 +1,3 @@
+DROP TABLE rate_limit;
+ALTER TABLE apikey DROP COLUMN rate_limit,
+  DROP COLUMN rate_burst;
\ No newline at end of file
@@ -0,0 +1,8 @@
+ALTER TABLE apikey
+ADD COLUMN rate_limit double precision,
+  ADD COLUMN rate_burst integer;
+CREATE TABLE rate_limit (
+  apikey_id bigint PRIMARY KEY,
+  tokens double precision NOT NULL,
+  updated_at timestamptz NOT NULL
+);
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX idx_apikey_last_used_at;
+ALTER TABLE apikey DROP COLUMN last_used_at,
+  DROP COLUMN last_used_ip,
+  DROP COLUMN usage_count;
\ No newline at end of file
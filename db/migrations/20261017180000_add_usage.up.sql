@@ -0,0 +1,5 @@
+ALTER TABLE apikey
+ADD COLUMN last_used_at timestamptz,
+  ADD COLUMN last_used_ip text,
+  ADD COLUMN usage_count bigint NOT NULL DEFAULT 0;
+CREATE INDEX idx_apikey_last_used_at ON apikey (last_used_at);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP TRIGGER audit_event_append_only ON audit_event;
+DROP FUNCTION audit_event_append_only;
+DROP TABLE audit_event;
\ No newline at end of file
@@ -0,0 +1,24 @@
+-- append-only trail of management and authentication events
+CREATE TABLE audit_event (
+  id bigserial PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT NOW(),
+  /* key_created, key_updated, key_revoked, key_rotated or auth_failed */
+  event text NOT NULL,
+  apikey_id bigint,
+  /* authenticated management api caller */
+  actor text,
+  /* client address */
+  ip text,
+  /* failure reason or revocation reason */
+  reason text,
+  /* event specific data like changed fields */
+  details jsonb
+);
+CREATE INDEX idx_audit_event_created_at ON audit_event (created_at, id);
+CREATE INDEX idx_audit_event_apikey_id ON audit_event (apikey_id, id);
+CREATE FUNCTION audit_event_append_only() RETURNS trigger AS $$ BEGIN RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_event_append_only BEFORE
+UPDATE
+  OR DELETE ON audit_event FOR EACH ROW EXECUTE FUNCTION audit_event_append_only();
\ No newline at end of file
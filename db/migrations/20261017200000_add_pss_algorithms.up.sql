@@ -0,0 +1,3 @@
+ALTER TYPE alg_type ADD VALUE 'PS256';
+ALTER TYPE alg_type ADD VALUE 'PS384';
+ALTER TYPE alg_type ADD VALUE 'PS512';
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TYPE alg_type ADD VALUE 'ES384';
+ALTER TYPE alg_type ADD VALUE 'ES512';
\ No newline at end of file
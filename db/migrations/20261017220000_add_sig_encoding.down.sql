@@ -0,0 +1 @@
+ALTER TABLE apikey DROP COLUMN sig_encoding;
\ No newline at end of file
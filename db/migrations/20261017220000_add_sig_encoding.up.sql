@@ -0,0 +1,2 @@
+ALTER TABLE apikey
+ADD COLUMN sig_encoding text;
\ No newline at end of file
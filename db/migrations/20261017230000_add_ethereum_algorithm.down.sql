@@ -0,0 +1,5 @@
+/* fails if there are keys with removed algorithms */
+ALTER TYPE alg_type RENAME TO alg_type_old;
+CREATE TYPE alg_type AS ENUM ('RS256', 'RS512', 'ES256', 'ES256K', 'EdDSA', 'PS256', 'PS384', 'PS512', 'ES384', 'ES512');
+ALTER TABLE apikey ALTER COLUMN alg TYPE alg_type USING alg::text::alg_type;
+DROP TYPE alg_type_old;
\ No newline at end of file
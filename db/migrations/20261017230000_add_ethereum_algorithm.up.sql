@@ -0,0 +1 @@
+ALTER TYPE alg_type ADD VALUE 'ETH';
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TRIGGER audit_event_no_truncate ON audit_event;
\ No newline at end of file
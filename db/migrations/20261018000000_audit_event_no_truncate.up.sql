@@ -0,0 +1,2 @@
+/* TRUNCATE doesn't fire row triggers */
+CREATE TRIGGER audit_event_no_truncate BEFORE TRUNCATE ON audit_event FOR EACH STATEMENT EXECUTE FUNCTION audit_event_append_only();
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP INDEX idx_apikey_exp_sort;
+DROP INDEX idx_apikey_sub_sort;
\ No newline at end of file
@@ -0,0 +1,3 @@
+/* search sorts by the same expressions, nulls are last in ascending order */
+CREATE INDEX idx_apikey_exp_sort ON apikey ((COALESCE(exp, 'infinity'::timestamptz)), id);
+CREATE INDEX idx_apikey_sub_sort ON apikey ((COALESCE(sub, '')), id);
\ No newline at end of file
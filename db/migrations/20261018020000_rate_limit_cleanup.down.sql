@@ -0,0 +1 @@
+DROP INDEX idx_rate_limit_updated_at;
\ No newline at end of file
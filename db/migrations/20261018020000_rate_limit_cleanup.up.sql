@@ -0,0 +1 @@
+CREATE INDEX idx_rate_limit_updated_at ON rate_limit (updated_at);
\ No newline at end of file
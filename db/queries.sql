@@ -6,7 +6,23 @@ SELECT id,
   alg,
   exp,
   name,
-  extra
+  extra,
+  revoked_at,
+  revoked_by,
+  reason,
+  prev_sec,
+  prev_sec_exp,
+  sign_mode,
+  sig_encoding,
+  role,
+  scopes,
+  version,
+  updated_at,
+  rate_limit,
+  rate_burst,
+  last_used_at,
+  last_used_ip,
+  usage_count
 FROM apikey
 WHERE id = $1;
 -- name: GetApiKeyForVerify :one
@@ -15,16 +31,39 @@ SELECT id,
   KEY,
   sub,
   alg,
-  extra
+  extra,
+  prev_sec,
+  prev_sec_exp,
+  sign_mode,
+  sig_encoding,
+  role,
+  scopes,
+  rate_limit,
+  rate_burst
 FROM apikey
 WHERE id = $1
+  AND revoked_at IS NULL
   AND (
     exp IS NULL
     OR exp > NOW()
   );
 -- name: InsertApiKey :one
-INSERT INTO apikey (sec, KEY, sub, alg, exp, name, extra)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+INSERT INTO apikey (
+    sec,
+    KEY,
+    sub,
+    alg,
+    exp,
+    name,
+    extra,
+    sign_mode,
+    sig_encoding,
+    role,
+    scopes,
+    rate_limit,
+    rate_burst
+  )
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 RETURNING id;
 -- name: SearchApiKeys :many
 SELECT id,
@@ -33,9 +72,253 @@ SELECT id,
   sub,
   alg,
   exp,
-  name
+  name,
+  extra,
+  revoked_at,
+  revoked_by,
+  reason,
+  prev_sec,
+  prev_sec_exp,
+  sign_mode,
+  sig_encoding,
+  role,
+  scopes,
+  version,
+  updated_at,
+  rate_limit,
+  rate_burst,
+  last_used_at,
+  last_used_ip,
+  usage_count
 FROM apikey
 WHERE (
-    sub = $1
-    OR $1 IS NULL
-  );
\ No newline at end of file
+    sqlc.narg(sub)::text IS NULL
+    OR sub = sqlc.narg(sub)
+  )
+  AND (
+    sqlc.narg(sub_pattern)::text IS NULL
+    OR sub LIKE sqlc.narg(sub_pattern)
+  )
+  AND (
+    sqlc.narg(name)::text IS NULL
+    OR name = sqlc.narg(name)
+  )
+  AND (
+    sqlc.narg(alg)::alg_type IS NULL
+    OR alg = sqlc.narg(alg)
+  )
+  AND (
+    sqlc.narg(exp_after)::timestamptz IS NULL
+    OR exp >= sqlc.narg(exp_after)
+  )
+  AND (
+    sqlc.narg(exp_before)::timestamptz IS NULL
+    OR exp < sqlc.narg(exp_before)
+  )
+  AND (
+    sqlc.narg(extra)::jsonb IS NULL
+    OR extra @> sqlc.narg(extra)
+  )
+  AND (
+    sqlc.narg(unused_since)::timestamptz IS NULL
+    OR last_used_at IS NULL
+    OR last_used_at < sqlc.narg(unused_since)
+  )
+  AND (
+    sqlc.narg(cursor_id)::bigint IS NULL
+    OR (
+      sqlc.arg(sort_by)::text = 'id'
+      AND NOT sqlc.arg(sort_desc)::boolean
+      AND id > sqlc.narg(cursor_id)
+    )
+    OR (
+      sqlc.arg(sort_by)::text = 'id'
+      AND sqlc.arg(sort_desc)::boolean
+      AND id < sqlc.narg(cursor_id)
+    )
+    OR (
+      sqlc.arg(sort_by)::text = 'exp'
+      AND NOT sqlc.arg(sort_desc)::boolean
+      AND (COALESCE(exp, 'infinity'), id) > (
+        COALESCE(sqlc.narg(cursor_exp)::timestamptz, 'infinity'),
+        sqlc.narg(cursor_id)
+      )
+    )
+    OR (
+      sqlc.arg(sort_by)::text = 'exp'
+      AND sqlc.arg(sort_desc)::boolean
+      AND (COALESCE(exp, 'infinity'), id) < (
+        COALESCE(sqlc.narg(cursor_exp)::timestamptz, 'infinity'),
+        sqlc.narg(cursor_id)
+      )
+    )
+    OR (
+      sqlc.arg(sort_by)::text = 'sub'
+      AND NOT sqlc.arg(sort_desc)::boolean
+      AND (COALESCE(sub, ''), id) > (sqlc.narg(cursor_sub)::text, sqlc.narg(cursor_id))
+    )
+    OR (
+      sqlc.arg(sort_by)::text = 'sub'
+      AND sqlc.arg(sort_desc)::boolean
+      AND (COALESCE(sub, ''), id) < (sqlc.narg(cursor_sub)::text, sqlc.narg(cursor_id))
+    )
+  )
+  -- sort and cursor expressions must match idx_apikey_exp_sort and idx_apikey_sub_sort
+ORDER BY CASE
+    WHEN sqlc.arg(sort_by)::text = 'exp'
+    AND NOT sqlc.arg(sort_desc)::boolean THEN COALESCE(exp, 'infinity')
+  END ASC,
+  CASE
+    WHEN sqlc.arg(sort_by)::text = 'exp'
+    AND sqlc.arg(sort_desc)::boolean THEN COALESCE(exp, 'infinity')
+  END DESC,
+  CASE
+    WHEN sqlc.arg(sort_by)::text = 'sub'
+    AND NOT sqlc.arg(sort_desc)::boolean THEN COALESCE(sub, '')
+  END ASC,
+  CASE
+    WHEN sqlc.arg(sort_by)::text = 'sub'
+    AND sqlc.arg(sort_desc)::boolean THEN COALESCE(sub, '')
+  END DESC,
+  CASE
+    WHEN NOT sqlc.arg(sort_desc)::boolean THEN id
+  END ASC,
+  CASE
+    WHEN sqlc.arg(sort_desc)::boolean THEN id
+  END DESC
+LIMIT sqlc.arg(page_size);
+-- name: RevokeApiKey :one
+UPDATE apikey
+SET revoked_at = NOW(),
+  revoked_by = $2,
+  reason = $3
+WHERE id = $1
+  AND revoked_at IS NULL
+RETURNING revoked_at;
+-- name: UpdateApiKey :one
+UPDATE apikey
+SET name = $2,
+  extra = $3,
+  exp = $4,
+  scopes = $5,
+  rate_limit = $6,
+  rate_burst = $7,
+  version = version + 1,
+  updated_at = NOW()
+WHERE id = $1
+  AND version = $8
+  AND revoked_at IS NULL
+RETURNING version,
+  updated_at;
+-- name: RotateApiKeySecret :one
+UPDATE apikey
+SET prev_sec = sec,
+  prev_sec_exp = $3,
+  sec = $2
+WHERE id = $1
+  AND revoked_at IS NULL
+  AND (
+    exp IS NULL
+    OR exp > NOW()
+  )
+RETURNING id;
+-- name: UseNonce :execrows
+INSERT INTO nonce (apikey_id, nonce, exp)
+VALUES ($1, $2, $3) ON CONFLICT (apikey_id, nonce) DO
+UPDATE
+SET exp = EXCLUDED.exp
+WHERE nonce.exp < NOW();
+-- name: DeleteExpiredNonces :exec
+DELETE FROM nonce
+WHERE exp < NOW();
+-- name: TakeRateLimitToken :one
+INSERT INTO rate_limit AS r (apikey_id, tokens, updated_at)
+VALUES (
+    sqlc.arg(apikey_id),
+    sqlc.arg(burst)::double precision - 1,
+    NOW()
+  ) ON CONFLICT (apikey_id) DO
+UPDATE
+SET tokens = LEAST(
+    sqlc.arg(burst)::double precision,
+    r.tokens + EXTRACT(
+      EPOCH
+      FROM NOW() - r.updated_at
+    )::double precision * sqlc.arg(rate)::double precision
+  ) - 1,
+  updated_at = NOW()
+WHERE LEAST(
+    sqlc.arg(burst)::double precision,
+    r.tokens + EXTRACT(
+      EPOCH
+      FROM NOW() - r.updated_at
+    )::double precision * sqlc.arg(rate)::double precision
+  ) >= 1
+RETURNING tokens;
+-- name: GetRateLimitTokens :one
+SELECT LEAST(
+    sqlc.arg(burst)::double precision,
+    tokens + EXTRACT(
+      EPOCH
+      FROM NOW() - updated_at
+    )::double precision * sqlc.arg(rate)::double precision
+  )::double precision AS tokens
+FROM rate_limit
+WHERE apikey_id = sqlc.arg(apikey_id);
+-- name: DeleteIdleRateLimits :exec
+DELETE FROM rate_limit
+WHERE updated_at < sqlc.arg(idle_before);
+-- name: RecordUsage :exec
+UPDATE apikey AS a
+SET usage_count = a.usage_count + u.count,
+  last_used_at = GREATEST(a.last_used_at, u.last_used_at),
+  last_used_ip = CASE
+    WHEN a.last_used_at IS NULL
+    OR u.last_used_at >= a.last_used_at THEN u.last_used_ip
+    ELSE a.last_used_ip
+  END
+FROM (
+    SELECT unnest(sqlc.arg(ids)::bigint []) AS id,
+      unnest(sqlc.arg(counts)::bigint []) AS count,
+      unnest(sqlc.arg(last_used_ats)::timestamptz []) AS last_used_at,
+      unnest(sqlc.arg(last_used_ips)::text []) AS last_used_ip
+  ) AS u
+WHERE a.id = u.id;
+-- name: InsertAuditEvent :one
+INSERT INTO audit_event (created_at, event, apikey_id, actor, ip, reason, details)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id;
+
+-- name: SearchAuditEvents :many
+SELECT *
+FROM audit_event
+WHERE (
+    sqlc.narg(event)::text IS NULL
+    OR event = sqlc.narg(event)
+  )
+  AND (
+    sqlc.narg(apikey_id)::bigint IS NULL
+    OR apikey_id = sqlc.narg(apikey_id)
+  )
+  AND (
+    sqlc.narg(actor)::text IS NULL
+    OR actor = sqlc.narg(actor)
+  )
+  AND (
+    sqlc.narg(ip)::text IS NULL
+    OR ip = sqlc.narg(ip)
+  )
+  AND (
+    sqlc.narg(since)::timestamptz IS NULL
+    OR created_at >= sqlc.narg(since)
+  )
+  AND (
+    sqlc.narg(until)::timestamptz IS NULL
+    OR created_at < sqlc.narg(until)
+  )
+  AND (
+    sqlc.narg(cursor_id)::bigint IS NULL
+    OR id < sqlc.narg(cursor_id)
+  )
+ORDER BY id DESC
+LIMIT sqlc.arg(page_size);
@@ -8,6 +8,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"time"
 
 	"github.com/sqlc-dev/pqtype"
 )
@@ -20,6 +21,12 @@ const (
 	AlgTypeES256  AlgType = "ES256"
 	AlgTypeES256K AlgType = "ES256K"
 	AlgTypeEdDSA  AlgType = "EdDSA"
+	AlgTypePS256  AlgType = "PS256"
+	AlgTypePS384  AlgType = "PS384"
+	AlgTypePS512  AlgType = "PS512"
+	AlgTypeES384  AlgType = "ES384"
+	AlgTypeES512  AlgType = "ES512"
+	AlgTypeETH    AlgType = "ETH"
 )
 
 func (e *AlgType) Scan(src interface{}) error {
@@ -58,12 +65,51 @@ func (ns NullAlgType) Value() (driver.Value, error) {
 }
 
 type Apikey struct {
-	ID    int64                 `json:"id"`
-	Sec   []byte                `json:"sec"`
-	Key   []byte                `json:"key"`
-	Sub   sql.NullString        `json:"sub"`
-	Alg   NullAlgType           `json:"alg"`
-	Exp   sql.NullTime          `json:"exp"`
-	Name  sql.NullString        `json:"name"`
-	Extra pqtype.NullRawMessage `json:"extra"`
+	ID          int64                 `json:"id"`
+	Sec         []byte                `json:"sec"`
+	Key         []byte                `json:"key"`
+	Sub         sql.NullString        `json:"sub"`
+	Alg         NullAlgType           `json:"alg"`
+	Exp         sql.NullTime          `json:"exp"`
+	Name        sql.NullString        `json:"name"`
+	Extra       pqtype.NullRawMessage `json:"extra"`
+	RevokedAt   sql.NullTime          `json:"revoked_at"`
+	RevokedBy   sql.NullString        `json:"revoked_by"`
+	Reason      sql.NullString        `json:"reason"`
+	PrevSec     []byte                `json:"prev_sec"`
+	PrevSecExp  sql.NullTime          `json:"prev_sec_exp"`
+	SignMode    sql.NullString        `json:"sign_mode"`
+	SigEncoding sql.NullString        `json:"sig_encoding"`
+	Role        sql.NullString        `json:"role"`
+	Scopes      []string              `json:"scopes"`
+	Version     int64                 `json:"version"`
+	UpdatedAt   sql.NullTime          `json:"updated_at"`
+	RateLimit   sql.NullFloat64       `json:"rate_limit"`
+	RateBurst   sql.NullInt32         `json:"rate_burst"`
+	LastUsedAt  sql.NullTime          `json:"last_used_at"`
+	LastUsedIp  sql.NullString        `json:"last_used_ip"`
+	UsageCount  int64                 `json:"usage_count"`
+}
+
+type AuditEvent struct {
+	ID        int64                 `json:"id"`
+	CreatedAt time.Time             `json:"created_at"`
+	Event     string                `json:"event"`
+	ApikeyID  sql.NullInt64         `json:"apikey_id"`
+	Actor     sql.NullString        `json:"actor"`
+	Ip        sql.NullString        `json:"ip"`
+	Reason    sql.NullString        `json:"reason"`
+	Details   pqtype.NullRawMessage `json:"details"`
+}
+
+type Nonce struct {
+	ApikeyID int64     `json:"apikey_id"`
+	Nonce    string    `json:"nonce"`
+	Exp      time.Time `json:"exp"`
+}
+
+type RateLimit struct {
+	ApikeyID  int64     `json:"apikey_id"`
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -8,10 +8,32 @@ package queries
 import (
 	"context"
 	"database/sql"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/sqlc-dev/pqtype"
 )
 
+const deleteExpiredNonces = `-- name: DeleteExpiredNonces :exec
+DELETE FROM nonce
+WHERE exp < NOW()
+`
+
+func (q *Queries) DeleteExpiredNonces(ctx context.Context, db DBTX) error {
+	_, err := db.ExecContext(ctx, deleteExpiredNonces)
+	return err
+}
+
+const deleteIdleRateLimits = `-- name: DeleteIdleRateLimits :exec
+DELETE FROM rate_limit
+WHERE updated_at < $1
+`
+
+func (q *Queries) DeleteIdleRateLimits(ctx context.Context, db DBTX, idleBefore time.Time) error {
+	_, err := db.ExecContext(ctx, deleteIdleRateLimits, idleBefore)
+	return err
+}
+
 const getApiKey = `-- name: GetApiKey :one
 SELECT id,
   sec,
@@ -20,7 +42,23 @@ SELECT id,
   alg,
   exp,
   name,
-  extra
+  extra,
+  revoked_at,
+  revoked_by,
+  reason,
+  prev_sec,
+  prev_sec_exp,
+  sign_mode,
+  sig_encoding,
+  role,
+  scopes,
+  version,
+  updated_at,
+  rate_limit,
+  rate_burst,
+  last_used_at,
+  last_used_ip,
+  usage_count
 FROM apikey
 WHERE id = $1
 `
@@ -37,6 +75,22 @@ func (q *Queries) GetApiKey(ctx context.Context, db DBTX, id int64) (Apikey, err
 		&i.Exp,
 		&i.Name,
 		&i.Extra,
+		&i.RevokedAt,
+		&i.RevokedBy,
+		&i.Reason,
+		&i.PrevSec,
+		&i.PrevSecExp,
+		&i.SignMode,
+		&i.SigEncoding,
+		&i.Role,
+		pq.Array(&i.Scopes),
+		&i.Version,
+		&i.UpdatedAt,
+		&i.RateLimit,
+		&i.RateBurst,
+		&i.LastUsedAt,
+		&i.LastUsedIp,
+		&i.UsageCount,
 	)
 	return i, err
 }
@@ -47,9 +101,18 @@ SELECT id,
   KEY,
   sub,
   alg,
-  extra
+  extra,
+  prev_sec,
+  prev_sec_exp,
+  sign_mode,
+  sig_encoding,
+  role,
+  scopes,
+  rate_limit,
+  rate_burst
 FROM apikey
 WHERE id = $1
+  AND revoked_at IS NULL
   AND (
     exp IS NULL
     OR exp > NOW()
@@ -57,12 +120,20 @@ WHERE id = $1
 `
 
 type GetApiKeyForVerifyRow struct {
-	ID    int64                 `json:"id"`
-	Sec   []byte                `json:"sec"`
-	Key   []byte                `json:"key"`
-	Sub   sql.NullString        `json:"sub"`
-	Alg   NullAlgType           `json:"alg"`
-	Extra pqtype.NullRawMessage `json:"extra"`
+	ID          int64                 `json:"id"`
+	Sec         []byte                `json:"sec"`
+	Key         []byte                `json:"key"`
+	Sub         sql.NullString        `json:"sub"`
+	Alg         NullAlgType           `json:"alg"`
+	Extra       pqtype.NullRawMessage `json:"extra"`
+	PrevSec     []byte                `json:"prev_sec"`
+	PrevSecExp  sql.NullTime          `json:"prev_sec_exp"`
+	SignMode    sql.NullString        `json:"sign_mode"`
+	SigEncoding sql.NullString        `json:"sig_encoding"`
+	Role        sql.NullString        `json:"role"`
+	Scopes      []string              `json:"scopes"`
+	RateLimit   sql.NullFloat64       `json:"rate_limit"`
+	RateBurst   sql.NullInt32         `json:"rate_burst"`
 }
 
 func (q *Queries) GetApiKeyForVerify(ctx context.Context, db DBTX, id int64) (GetApiKeyForVerifyRow, error) {
@@ -75,24 +146,77 @@ func (q *Queries) GetApiKeyForVerify(ctx context.Context, db DBTX, id int64) (Ge
 		&i.Sub,
 		&i.Alg,
 		&i.Extra,
+		&i.PrevSec,
+		&i.PrevSecExp,
+		&i.SignMode,
+		&i.SigEncoding,
+		&i.Role,
+		pq.Array(&i.Scopes),
+		&i.RateLimit,
+		&i.RateBurst,
 	)
 	return i, err
 }
 
+const getRateLimitTokens = `-- name: GetRateLimitTokens :one
+SELECT LEAST(
+    $1::double precision,
+    tokens + EXTRACT(
+      EPOCH
+      FROM NOW() - updated_at
+    )::double precision * $2::double precision
+  )::double precision AS tokens
+FROM rate_limit
+WHERE apikey_id = $3
+`
+
+type GetRateLimitTokensParams struct {
+	Burst    float64 `json:"burst"`
+	Rate     float64 `json:"rate"`
+	ApikeyID int64   `json:"apikey_id"`
+}
+
+func (q *Queries) GetRateLimitTokens(ctx context.Context, db DBTX, arg GetRateLimitTokensParams) (float64, error) {
+	row := db.QueryRowContext(ctx, getRateLimitTokens, arg.Burst, arg.Rate, arg.ApikeyID)
+	var tokens float64
+	err := row.Scan(&tokens)
+	return tokens, err
+}
+
 const insertApiKey = `-- name: InsertApiKey :one
-INSERT INTO apikey (sec, KEY, sub, alg, exp, name, extra)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+INSERT INTO apikey (
+    sec,
+    KEY,
+    sub,
+    alg,
+    exp,
+    name,
+    extra,
+    sign_mode,
+    sig_encoding,
+    role,
+    scopes,
+    rate_limit,
+    rate_burst
+  )
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 RETURNING id
 `
 
 type InsertApiKeyParams struct {
-	Sec   []byte                `json:"sec"`
-	Key   []byte                `json:"key"`
-	Sub   sql.NullString        `json:"sub"`
-	Alg   NullAlgType           `json:"alg"`
-	Exp   sql.NullTime          `json:"exp"`
-	Name  sql.NullString        `json:"name"`
-	Extra pqtype.NullRawMessage `json:"extra"`
+	Sec         []byte                `json:"sec"`
+	Key         []byte                `json:"key"`
+	Sub         sql.NullString        `json:"sub"`
+	Alg         NullAlgType           `json:"alg"`
+	Exp         sql.NullTime          `json:"exp"`
+	Name        sql.NullString        `json:"name"`
+	Extra       pqtype.NullRawMessage `json:"extra"`
+	SignMode    sql.NullString        `json:"sign_mode"`
+	SigEncoding sql.NullString        `json:"sig_encoding"`
+	Role        sql.NullString        `json:"role"`
+	Scopes      []string              `json:"scopes"`
+	RateLimit   sql.NullFloat64       `json:"rate_limit"`
+	RateBurst   sql.NullInt32         `json:"rate_burst"`
 }
 
 func (q *Queries) InsertApiKey(ctx context.Context, db DBTX, arg InsertApiKeyParams) (int64, error) {
@@ -104,7 +228,129 @@ func (q *Queries) InsertApiKey(ctx context.Context, db DBTX, arg InsertApiKeyPar
 		arg.Exp,
 		arg.Name,
 		arg.Extra,
+		arg.SignMode,
+		arg.SigEncoding,
+		arg.Role,
+		pq.Array(arg.Scopes),
+		arg.RateLimit,
+		arg.RateBurst,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const insertAuditEvent = `-- name: InsertAuditEvent :one
+INSERT INTO audit_event (created_at, event, apikey_id, actor, ip, reason, details)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id
+`
+
+type InsertAuditEventParams struct {
+	CreatedAt time.Time             `json:"created_at"`
+	Event     string                `json:"event"`
+	ApikeyID  sql.NullInt64         `json:"apikey_id"`
+	Actor     sql.NullString        `json:"actor"`
+	Ip        sql.NullString        `json:"ip"`
+	Reason    sql.NullString        `json:"reason"`
+	Details   pqtype.NullRawMessage `json:"details"`
+}
+
+func (q *Queries) InsertAuditEvent(ctx context.Context, db DBTX, arg InsertAuditEventParams) (int64, error) {
+	row := db.QueryRowContext(ctx, insertAuditEvent,
+		arg.CreatedAt,
+		arg.Event,
+		arg.ApikeyID,
+		arg.Actor,
+		arg.Ip,
+		arg.Reason,
+		arg.Details,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const recordUsage = `-- name: RecordUsage :exec
+UPDATE apikey AS a
+SET usage_count = a.usage_count + u.count,
+  last_used_at = GREATEST(a.last_used_at, u.last_used_at),
+  last_used_ip = CASE
+    WHEN a.last_used_at IS NULL
+    OR u.last_used_at >= a.last_used_at THEN u.last_used_ip
+    ELSE a.last_used_ip
+  END
+FROM (
+    SELECT unnest($1::bigint []) AS id,
+      unnest($2::bigint []) AS count,
+      unnest($3::timestamptz []) AS last_used_at,
+      unnest($4::text []) AS last_used_ip
+  ) AS u
+WHERE a.id = u.id
+`
+
+type RecordUsageParams struct {
+	Ids         []int64     `json:"ids"`
+	Counts      []int64     `json:"counts"`
+	LastUsedAts []time.Time `json:"last_used_ats"`
+	LastUsedIps []string    `json:"last_used_ips"`
+}
+
+func (q *Queries) RecordUsage(ctx context.Context, db DBTX, arg RecordUsageParams) error {
+	_, err := db.ExecContext(ctx, recordUsage,
+		pq.Array(arg.Ids),
+		pq.Array(arg.Counts),
+		pq.Array(arg.LastUsedAts),
+		pq.Array(arg.LastUsedIps),
 	)
+	return err
+}
+
+const revokeApiKey = `-- name: RevokeApiKey :one
+UPDATE apikey
+SET revoked_at = NOW(),
+  revoked_by = $2,
+  reason = $3
+WHERE id = $1
+  AND revoked_at IS NULL
+RETURNING revoked_at
+`
+
+type RevokeApiKeyParams struct {
+	ID        int64          `json:"id"`
+	RevokedBy sql.NullString `json:"revoked_by"`
+	Reason    sql.NullString `json:"reason"`
+}
+
+func (q *Queries) RevokeApiKey(ctx context.Context, db DBTX, arg RevokeApiKeyParams) (sql.NullTime, error) {
+	row := db.QueryRowContext(ctx, revokeApiKey, arg.ID, arg.RevokedBy, arg.Reason)
+	var revoked_at sql.NullTime
+	err := row.Scan(&revoked_at)
+	return revoked_at, err
+}
+
+const rotateApiKeySecret = `-- name: RotateApiKeySecret :one
+UPDATE apikey
+SET prev_sec = sec,
+  prev_sec_exp = $3,
+  sec = $2
+WHERE id = $1
+  AND revoked_at IS NULL
+  AND (
+    exp IS NULL
+    OR exp > NOW()
+  )
+RETURNING id
+`
+
+type RotateApiKeySecretParams struct {
+	ID         int64        `json:"id"`
+	Sec        []byte       `json:"sec"`
+	PrevSecExp sql.NullTime `json:"prev_sec_exp"`
+}
+
+func (q *Queries) RotateApiKeySecret(ctx context.Context, db DBTX, arg RotateApiKeySecretParams) (int64, error) {
+	row := db.QueryRowContext(ctx, rotateApiKeySecret, arg.ID, arg.Sec, arg.PrevSecExp)
 	var id int64
 	err := row.Scan(&id)
 	return id, err
@@ -117,33 +363,164 @@ SELECT id,
   sub,
   alg,
   exp,
-  name
+  name,
+  extra,
+  revoked_at,
+  revoked_by,
+  reason,
+  prev_sec,
+  prev_sec_exp,
+  sign_mode,
+  sig_encoding,
+  role,
+  scopes,
+  version,
+  updated_at,
+  rate_limit,
+  rate_burst,
+  last_used_at,
+  last_used_ip,
+  usage_count
 FROM apikey
 WHERE (
-    sub = $1
-    OR $1 IS NULL
+    $1::text IS NULL
+    OR sub = $1
+  )
+  AND (
+    $2::text IS NULL
+    OR sub LIKE $2
+  )
+  AND (
+    $3::text IS NULL
+    OR name = $3
+  )
+  AND (
+    $4::alg_type IS NULL
+    OR alg = $4
+  )
+  AND (
+    $5::timestamptz IS NULL
+    OR exp >= $5
+  )
+  AND (
+    $6::timestamptz IS NULL
+    OR exp < $6
+  )
+  AND (
+    $7::jsonb IS NULL
+    OR extra @> $7
+  )
+  AND (
+    $8::timestamptz IS NULL
+    OR last_used_at IS NULL
+    OR last_used_at < $8
+  )
+  AND (
+    $9::bigint IS NULL
+    OR (
+      $10::text = 'id'
+      AND NOT $11::boolean
+      AND id > $9
+    )
+    OR (
+      $10::text = 'id'
+      AND $11::boolean
+      AND id < $9
+    )
+    OR (
+      $10::text = 'exp'
+      AND NOT $11::boolean
+      AND (COALESCE(exp, 'infinity'), id) > (
+        COALESCE($12::timestamptz, 'infinity'),
+        $9
+      )
+    )
+    OR (
+      $10::text = 'exp'
+      AND $11::boolean
+      AND (COALESCE(exp, 'infinity'), id) < (
+        COALESCE($12::timestamptz, 'infinity'),
+        $9
+      )
+    )
+    OR (
+      $10::text = 'sub'
+      AND NOT $11::boolean
+      AND (COALESCE(sub, ''), id) > ($13::text, $9)
+    )
+    OR (
+      $10::text = 'sub'
+      AND $11::boolean
+      AND (COALESCE(sub, ''), id) < ($13::text, $9)
+    )
   )
+  -- sort and cursor expressions must match idx_apikey_exp_sort and idx_apikey_sub_sort
+ORDER BY CASE
+    WHEN $10::text = 'exp'
+    AND NOT $11::boolean THEN COALESCE(exp, 'infinity')
+  END ASC,
+  CASE
+    WHEN $10::text = 'exp'
+    AND $11::boolean THEN COALESCE(exp, 'infinity')
+  END DESC,
+  CASE
+    WHEN $10::text = 'sub'
+    AND NOT $11::boolean THEN COALESCE(sub, '')
+  END ASC,
+  CASE
+    WHEN $10::text = 'sub'
+    AND $11::boolean THEN COALESCE(sub, '')
+  END DESC,
+  CASE
+    WHEN NOT $11::boolean THEN id
+  END ASC,
+  CASE
+    WHEN $11::boolean THEN id
+  END DESC
+LIMIT $14
 `
 
-type SearchApiKeysRow struct {
-	ID   int64          `json:"id"`
-	Sec  []byte         `json:"sec"`
-	Key  []byte         `json:"key"`
-	Sub  sql.NullString `json:"sub"`
-	Alg  NullAlgType    `json:"alg"`
-	Exp  sql.NullTime   `json:"exp"`
-	Name sql.NullString `json:"name"`
+type SearchApiKeysParams struct {
+	Sub         sql.NullString        `json:"sub"`
+	SubPattern  sql.NullString        `json:"sub_pattern"`
+	Name        sql.NullString        `json:"name"`
+	Alg         NullAlgType           `json:"alg"`
+	ExpAfter    sql.NullTime          `json:"exp_after"`
+	ExpBefore   sql.NullTime          `json:"exp_before"`
+	Extra       pqtype.NullRawMessage `json:"extra"`
+	UnusedSince sql.NullTime          `json:"unused_since"`
+	CursorID    sql.NullInt64         `json:"cursor_id"`
+	SortBy      string                `json:"sort_by"`
+	SortDesc    bool                  `json:"sort_desc"`
+	CursorExp   sql.NullTime          `json:"cursor_exp"`
+	CursorSub   sql.NullString        `json:"cursor_sub"`
+	PageSize    int32                 `json:"page_size"`
 }
 
-func (q *Queries) SearchApiKeys(ctx context.Context, db DBTX, sub sql.NullString) ([]SearchApiKeysRow, error) {
-	rows, err := db.QueryContext(ctx, searchApiKeys, sub)
+func (q *Queries) SearchApiKeys(ctx context.Context, db DBTX, arg SearchApiKeysParams) ([]Apikey, error) {
+	rows, err := db.QueryContext(ctx, searchApiKeys,
+		arg.Sub,
+		arg.SubPattern,
+		arg.Name,
+		arg.Alg,
+		arg.ExpAfter,
+		arg.ExpBefore,
+		arg.Extra,
+		arg.UnusedSince,
+		arg.CursorID,
+		arg.SortBy,
+		arg.SortDesc,
+		arg.CursorExp,
+		arg.CursorSub,
+		arg.PageSize,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []SearchApiKeysRow
+	var items []Apikey
 	for rows.Next() {
-		var i SearchApiKeysRow
+		var i Apikey
 		if err := rows.Scan(
 			&i.ID,
 			&i.Sec,
@@ -152,6 +529,23 @@ func (q *Queries) SearchApiKeys(ctx context.Context, db DBTX, sub sql.NullString
 			&i.Alg,
 			&i.Exp,
 			&i.Name,
+			&i.Extra,
+			&i.RevokedAt,
+			&i.RevokedBy,
+			&i.Reason,
+			&i.PrevSec,
+			&i.PrevSecExp,
+			&i.SignMode,
+			&i.SigEncoding,
+			&i.Role,
+			pq.Array(&i.Scopes),
+			&i.Version,
+			&i.UpdatedAt,
+			&i.RateLimit,
+			&i.RateBurst,
+			&i.LastUsedAt,
+			&i.LastUsedIp,
+			&i.UsageCount,
 		); err != nil {
 			return nil, err
 		}
@@ -165,3 +559,200 @@ func (q *Queries) SearchApiKeys(ctx context.Context, db DBTX, sub sql.NullString
 	}
 	return items, nil
 }
+
+const searchAuditEvents = `-- name: SearchAuditEvents :many
+SELECT id, created_at, event, apikey_id, actor, ip, reason, details
+FROM audit_event
+WHERE (
+    $1::text IS NULL
+    OR event = $1
+  )
+  AND (
+    $2::bigint IS NULL
+    OR apikey_id = $2
+  )
+  AND (
+    $3::text IS NULL
+    OR actor = $3
+  )
+  AND (
+    $4::text IS NULL
+    OR ip = $4
+  )
+  AND (
+    $5::timestamptz IS NULL
+    OR created_at >= $5
+  )
+  AND (
+    $6::timestamptz IS NULL
+    OR created_at < $6
+  )
+  AND (
+    $7::bigint IS NULL
+    OR id < $7
+  )
+ORDER BY id DESC
+LIMIT $8
+`
+
+type SearchAuditEventsParams struct {
+	Event    sql.NullString `json:"event"`
+	ApikeyID sql.NullInt64  `json:"apikey_id"`
+	Actor    sql.NullString `json:"actor"`
+	Ip       sql.NullString `json:"ip"`
+	Since    sql.NullTime   `json:"since"`
+	Until    sql.NullTime   `json:"until"`
+	CursorID sql.NullInt64  `json:"cursor_id"`
+	PageSize int32          `json:"page_size"`
+}
+
+func (q *Queries) SearchAuditEvents(ctx context.Context, db DBTX, arg SearchAuditEventsParams) ([]AuditEvent, error) {
+	rows, err := db.QueryContext(ctx, searchAuditEvents,
+		arg.Event,
+		arg.ApikeyID,
+		arg.Actor,
+		arg.Ip,
+		arg.Since,
+		arg.Until,
+		arg.CursorID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuditEvent
+	for rows.Next() {
+		var i AuditEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.Event,
+			&i.ApikeyID,
+			&i.Actor,
+			&i.Ip,
+			&i.Reason,
+			&i.Details,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const takeRateLimitToken = `-- name: TakeRateLimitToken :one
+INSERT INTO rate_limit AS r (apikey_id, tokens, updated_at)
+VALUES (
+    $1,
+    $2::double precision - 1,
+    NOW()
+  ) ON CONFLICT (apikey_id) DO
+UPDATE
+SET tokens = LEAST(
+    $2::double precision,
+    r.tokens + EXTRACT(
+      EPOCH
+      FROM NOW() - r.updated_at
+    )::double precision * $3::double precision
+  ) - 1,
+  updated_at = NOW()
+WHERE LEAST(
+    $2::double precision,
+    r.tokens + EXTRACT(
+      EPOCH
+      FROM NOW() - r.updated_at
+    )::double precision * $3::double precision
+  ) >= 1
+RETURNING tokens
+`
+
+type TakeRateLimitTokenParams struct {
+	ApikeyID int64   `json:"apikey_id"`
+	Burst    float64 `json:"burst"`
+	Rate     float64 `json:"rate"`
+}
+
+func (q *Queries) TakeRateLimitToken(ctx context.Context, db DBTX, arg TakeRateLimitTokenParams) (float64, error) {
+	row := db.QueryRowContext(ctx, takeRateLimitToken, arg.ApikeyID, arg.Burst, arg.Rate)
+	var tokens float64
+	err := row.Scan(&tokens)
+	return tokens, err
+}
+
+const updateApiKey = `-- name: UpdateApiKey :one
+UPDATE apikey
+SET name = $2,
+  extra = $3,
+  exp = $4,
+  scopes = $5,
+  rate_limit = $6,
+  rate_burst = $7,
+  version = version + 1,
+  updated_at = NOW()
+WHERE id = $1
+  AND version = $8
+  AND revoked_at IS NULL
+RETURNING version,
+  updated_at
+`
+
+type UpdateApiKeyParams struct {
+	ID        int64                 `json:"id"`
+	Name      sql.NullString        `json:"name"`
+	Extra     pqtype.NullRawMessage `json:"extra"`
+	Exp       sql.NullTime          `json:"exp"`
+	Scopes    []string              `json:"scopes"`
+	RateLimit sql.NullFloat64       `json:"rate_limit"`
+	RateBurst sql.NullInt32         `json:"rate_burst"`
+	Version   int64                 `json:"version"`
+}
+
+type UpdateApiKeyRow struct {
+	Version   int64        `json:"version"`
+	UpdatedAt sql.NullTime `json:"updated_at"`
+}
+
+func (q *Queries) UpdateApiKey(ctx context.Context, db DBTX, arg UpdateApiKeyParams) (UpdateApiKeyRow, error) {
+	row := db.QueryRowContext(ctx, updateApiKey,
+		arg.ID,
+		arg.Name,
+		arg.Extra,
+		arg.Exp,
+		pq.Array(arg.Scopes),
+		arg.RateLimit,
+		arg.RateBurst,
+		arg.Version,
+	)
+	var i UpdateApiKeyRow
+	err := row.Scan(&i.Version, &i.UpdatedAt)
+	return i, err
+}
+
+const useNonce = `-- name: UseNonce :execrows
+INSERT INTO nonce (apikey_id, nonce, exp)
+VALUES ($1, $2, $3) ON CONFLICT (apikey_id, nonce) DO
+UPDATE
+SET exp = EXCLUDED.exp
+WHERE nonce.exp < NOW()
+`
+
+type UseNonceParams struct {
+	ApikeyID int64     `json:"apikey_id"`
+	Nonce    string    `json:"nonce"`
+	Exp      time.Time `json:"exp"`
+}
+
+func (q *Queries) UseNonce(ctx context.Context, db DBTX, arg UseNonceParams) (int64, error) {
+	result, err := db.ExecContext(ctx, useNonce, arg.ApikeyID, arg.Nonce, arg.Exp)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
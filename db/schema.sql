@@ -1,10 +1,10 @@
-CREATE TYPE alg_type AS ENUM ('RS256', 'RS512', 'ES256', 'ES256K', 'EdDSA');
+CREATE TYPE alg_type AS ENUM ('RS256', 'RS512', 'ES256', 'ES256K', 'EdDSA', 'PS256', 'PS384', 'PS512', 'ES384', 'ES512', 'ETH');
 CREATE TABLE apikey (
   /* api key ID */
   id BIGSERIAL PRIMARY KEY,
   /* hash of the secret */
   sec bytea NOT NULL,
-  /* optional encryption public key if alg is not NULL */
+  /* optional encryption public key if alg is not NULL, or address for ETH */
   KEY bytea,
   /* optional user id, subject; if null id will be returned as subject */
   sub text,
@@ -15,8 +15,90 @@ CREATE TABLE apikey (
   /* optional label */
   name text,
   /* optional extra data */
-  extra jsonb
+  extra jsonb,
+  /* revocation time; revoked keys are never accepted */
+  revoked_at timestamptz,
+  /* who revoked the key */
+  revoked_by text,
+  /* optional revocation reason */
+  reason text,
+  /* hash of the secret replaced by last rotation */
+  prev_sec bytea,
+  /* previous secret is accepted until this time */
+  prev_sec_exp timestamptz,
+  /* optional signature mode, server default is used if null */
+  sign_mode text,
+  /* optional ECDSA signature encoding, 'der' or 'raw', der if null */
+  sig_encoding text,
+  /* optional role, 'admin' keys can access management api */
+  role text,
+  /* optional permissions, can be required by check and verify */
+  scopes text [],
+  /* incremented on every metadata update for optimistic concurrency */
+  version bigint NOT NULL DEFAULT 1,
+  /* last metadata update time */
+  updated_at timestamptz,
+  /* optional allowed requests per second */
+  rate_limit double precision,
+  /* optional max requests in burst, rate_limit rounded up if null */
+  rate_burst integer,
+  /* last successful check or verify, updated in batches */
+  last_used_at timestamptz,
+  /* client address of the last successful check or verify */
+  last_used_ip text,
+  /* number of successful checks and verifies */
+  usage_count bigint NOT NULL DEFAULT 0
 );
 CREATE INDEX idx_apikey_id_exp ON apikey (id, exp);
 -- for list of apikeys
-CREATE INDEX idx_apikey_sub ON apikey (sub);
\ No newline at end of file
+CREATE INDEX idx_apikey_sub ON apikey (sub);
+-- for search
+CREATE INDEX idx_apikey_sub_pattern ON apikey (sub text_pattern_ops, id);
+CREATE INDEX idx_apikey_name ON apikey (name, id);
+CREATE INDEX idx_apikey_exp ON apikey (exp, id);
+CREATE INDEX idx_apikey_exp_sort ON apikey ((COALESCE(exp, 'infinity'::timestamptz)), id);
+CREATE INDEX idx_apikey_sub_sort ON apikey ((COALESCE(sub, '')), id);
+CREATE INDEX idx_apikey_extra ON apikey USING gin (extra jsonb_path_ops);
+CREATE INDEX idx_apikey_last_used_at ON apikey (last_used_at);
+-- used nonces for replay protection
+CREATE TABLE nonce (
+  apikey_id bigint NOT NULL,
+  nonce text NOT NULL,
+  /* nonce can be reused after this time */
+  exp timestamptz NOT NULL,
+  PRIMARY KEY (apikey_id, nonce)
+);
+CREATE INDEX idx_nonce_exp ON nonce (exp);
+-- token buckets for rate limiting shared between replicas
+CREATE TABLE rate_limit (
+  apikey_id bigint PRIMARY KEY,
+  /* tokens left at updated_at */
+  tokens double precision NOT NULL,
+  updated_at timestamptz NOT NULL
+);
+CREATE INDEX idx_rate_limit_updated_at ON rate_limit (updated_at);
+-- append-only trail of management and authentication events
+CREATE TABLE audit_event (
+  id bigserial PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT NOW(),
+  /* key_created, key_updated, key_revoked, key_rotated or auth_failed */
+  event text NOT NULL,
+  apikey_id bigint,
+  /* authenticated management api caller */
+  actor text,
+  /* client address */
+  ip text,
+  /* failure reason or revocation reason */
+  reason text,
+  /* event specific data like changed fields */
+  details jsonb
+);
+CREATE INDEX idx_audit_event_created_at ON audit_event (created_at, id);
+CREATE INDEX idx_audit_event_apikey_id ON audit_event (apikey_id, id);
+CREATE FUNCTION audit_event_append_only() RETURNS trigger AS $$ BEGIN RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_event_append_only BEFORE
+UPDATE
+  OR DELETE ON audit_event FOR EACH ROW EXECUTE FUNCTION audit_event_append_only();
+CREATE TRIGGER audit_event_no_truncate BEFORE TRUNCATE ON audit_event FOR EACH STATEMENT EXECUTE FUNCTION audit_event_append_only();
\ No newline at end of file
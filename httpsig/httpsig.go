@@ -0,0 +1,316 @@
+// Package httpsig implements RFC 9421 HTTP Message Signatures for requests.
+// It is shared by server verifier and command line signer.
+package httpsig
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jaspeen/apikeyman/algo"
+)
+
+const (
+	SIGNATURE_INPUT_HEADER = "Signature-Input"
+	SIGNATURE_HEADER       = "Signature"
+	CONTENT_DIGEST_HEADER  = "Content-Digest"
+
+	DEFAULT_LABEL = "sig1"
+)
+
+var ErrNoSignature = errors.New("no signature")
+var ErrUnsupportedComponent = errors.New("unsupported component")
+var ErrMissingComponent = errors.New("missing component")
+var ErrDuplicateComponent = errors.New("duplicate component")
+var ErrContentDigestMismatch = errors.New("content digest mismatch")
+
+// algorithm names from RFC 9421 registry mapped to algo package names
+var algorithms = map[string]string{
+	"rsa-v1_5-sha256":   "RS256",
+	"rsa-pss-sha512":    "PS512",
+	"ecdsa-p256-sha256": "ES256",
+	"ecdsa-p384-sha384": "ES384",
+	"ed25519":           "EdDSA",
+}
+
+// AlgorithmName returns algo package name for http signature algorithm
+func AlgorithmName(httpSigAlg string) (string, bool) {
+	alg, ok := algorithms[httpSigAlg]
+	return alg, ok
+}
+
+// HttpSigAlgorithmName returns http signature algorithm for algo package name
+func HttpSigAlgorithmName(alg string) (string, bool) {
+	for k, v := range algorithms {
+		if v == alg {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// ECDSAKeySize returns size of r and s for ECDSA algorithms which signatures must be converted from r||s
+func ECDSAKeySize(alg string) (int, bool) {
+	return algo.ECDSAKeySize(alg)
+}
+
+// Message is the request being signed or verified
+type Message struct {
+	Method    string
+	Scheme    string
+	Authority string
+	// path with optional query
+	URI    string
+	Header http.Header
+}
+
+type Signature struct {
+	Label string
+	// covered components with signature parameters
+	Input InnerList
+	Value []byte
+}
+
+func (s *Signature) KeyId() string {
+	v, _ := s.Input.Params.String("keyid")
+	return v
+}
+
+func (s *Signature) Alg() string {
+	v, _ := s.Input.Params.String("alg")
+	return v
+}
+
+func (s *Signature) Nonce() string {
+	v, _ := s.Input.Params.String("nonce")
+	return v
+}
+
+func (s *Signature) Created() (int64, bool) {
+	return s.Input.Params.Int("created")
+}
+
+func (s *Signature) Expires() (int64, bool) {
+	return s.Input.Params.Int("expires")
+}
+
+// Covers returns true if component is covered by signature
+func (s *Signature) Covers(name string) bool {
+	for _, item := range s.Input.Items {
+		if v, ok := item.Value.(string); ok && v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSignatures parses Signature-Input and Signature headers, signatures are returned in Signature-Input order
+func ParseSignatures(signatureInput string, signature string) ([]Signature, error) {
+	inputs, err := ParseDictionary(signatureInput)
+	if err != nil {
+		return nil, err
+	}
+	values, err := ParseDictionary(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Signature
+	for _, input := range inputs {
+		list, ok := input.Value.(InnerList)
+		if !ok {
+			return nil, ErrInvalidStructuredField
+		}
+		for _, value := range values {
+			if value.Name != input.Name {
+				continue
+			}
+			item, ok := value.Value.(Item)
+			if !ok {
+				return nil, ErrInvalidStructuredField
+			}
+			sig, ok := item.Value.([]byte)
+			if !ok {
+				return nil, ErrInvalidStructuredField
+			}
+			res = append(res, Signature{Label: input.Name, Input: list, Value: sig})
+		}
+	}
+	if len(res) == 0 {
+		return nil, ErrNoSignature
+	}
+	return res, nil
+}
+
+// NewSignatureInput creates covered components list with signature parameters
+func NewSignatureInput(components []string, params Params) InnerList {
+	list := InnerList{Params: params}
+	for _, c := range components {
+		list.Items = append(list.Items, Item{Value: strings.ToLower(c)})
+	}
+	return list
+}
+
+// FormatHeaders returns Signature-Input and Signature header values
+func FormatHeaders(label string, input InnerList, signature []byte) (string, string, error) {
+	serializedInput, err := SerializeInnerList(input)
+	if err != nil {
+		return "", "", err
+	}
+	var sb strings.Builder
+	if err := serializeBareItem(&sb, signature); err != nil {
+		return "", "", err
+	}
+	return label + "=" + serializedInput, label + "=" + sb.String(), nil
+}
+
+// SignatureBase builds signature base for covered components of the message
+func SignatureBase(msg *Message, input InnerList) ([]byte, error) {
+	u, err := url.ParseRequestURI(msg.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	seen := make(map[string]bool)
+	for _, item := range input.Items {
+		name, ok := item.Value.(string)
+		if !ok {
+			return nil, ErrInvalidStructuredField
+		}
+		var id strings.Builder
+		if err := serializeItem(&id, item); err != nil {
+			return nil, err
+		}
+		if seen[id.String()] {
+			return nil, ErrDuplicateComponent
+		}
+		seen[id.String()] = true
+
+		value, err := componentValue(msg, u, name, item.Params)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, ErrInvalidStructuredField
+		}
+		sb.WriteString(id.String())
+		sb.WriteString(": ")
+		sb.WriteString(value)
+		sb.WriteByte('\n')
+	}
+
+	params, err := SerializeInnerList(input)
+	if err != nil {
+		return nil, err
+	}
+	sb.WriteString(`"@signature-params": `)
+	sb.WriteString(params)
+	return []byte(sb.String()), nil
+}
+
+func componentValue(msg *Message, u *url.URL, name string, params Params) (string, error) {
+	if !strings.HasPrefix(name, "@") {
+		// only plain field values are supported
+		if len(params) > 0 || name != strings.ToLower(name) {
+			return "", ErrUnsupportedComponent
+		}
+		values := msg.Header.Values(name)
+		if len(values) == 0 {
+			return "", fmt.Errorf("%w: %s", ErrMissingComponent, name)
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.TrimSpace(v)
+		}
+		return strings.Join(trimmed, ", "), nil
+	}
+
+	if name != "@query-param" && len(params) > 0 {
+		return "", ErrUnsupportedComponent
+	}
+
+	switch name {
+	case "@method":
+		return msg.Method, nil
+	case "@target-uri":
+		return strings.ToLower(msg.Scheme) + "://" + strings.ToLower(msg.Authority) + msg.URI, nil
+	case "@authority":
+		return strings.ToLower(msg.Authority), nil
+	case "@scheme":
+		return strings.ToLower(msg.Scheme), nil
+	case "@request-target":
+		return msg.URI, nil
+	case "@path":
+		path := u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		return path, nil
+	case "@query":
+		return "?" + u.RawQuery, nil
+	case "@query-param":
+		paramName, ok := params.String("name")
+		if !ok || len(params) != 1 {
+			return "", ErrUnsupportedComponent
+		}
+		values := u.Query()[paramName]
+		// parameters occurring multiple times must not be signed
+		if len(values) != 1 {
+			return "", fmt.Errorf("%w: %s", ErrMissingComponent, paramName)
+		}
+		return url.QueryEscape(values[0]), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedComponent, name)
+	}
+}
+
+// ContentDigest returns Content-Digest header value for the body
+func ContentDigest(body []byte) string {
+	hash := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(hash[:]) + ":"
+}
+
+// VerifyContentDigest checks that all supported digests in Content-Digest header match the body
+func VerifyContentDigest(header string, body []byte) error {
+	members, err := ParseDictionary(header)
+	if err != nil {
+		return err
+	}
+	verified := false
+	for _, member := range members {
+		item, ok := member.Value.(Item)
+		if !ok {
+			return ErrInvalidStructuredField
+		}
+		digest, ok := item.Value.([]byte)
+		if !ok {
+			return ErrInvalidStructuredField
+		}
+		var expected []byte
+		switch member.Name {
+		case "sha-256":
+			hash := sha256.Sum256(body)
+			expected = hash[:]
+		case "sha-512":
+			hash := sha512.Sum512(body)
+			expected = hash[:]
+		default:
+			continue
+		}
+		if subtle.ConstantTimeCompare(expected, digest) != 1 {
+			return ErrContentDigestMismatch
+		}
+		verified = true
+	}
+	if !verified {
+		return ErrContentDigestMismatch
+	}
+	return nil
+}
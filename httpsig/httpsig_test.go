@@ -0,0 +1,110 @@
+package httpsig_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/jaspeen/apikeyman/algo"
+	_ "github.com/jaspeen/apikeyman/algo/eddsa"
+	"github.com/jaspeen/apikeyman/httpsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 9421 Appendix B.2 test request
+func testMessage() *httpsig.Message {
+	header := http.Header{}
+	header.Set("Host", "example.com")
+	header.Set("Date", "Tue, 20 Apr 2021 02:07:55 GMT")
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Digest", "sha-512=:WZDPaVn/7XgHaAy8pmojAkGWoRx2UFChF41A2svX+TaPm+AbwAgBWnrIiYllu7BNNyealdVLvRwEmTHWXvJwew==:")
+	header.Set("Content-Length", "18")
+	return &httpsig.Message{
+		Method:    "POST",
+		Scheme:    "https",
+		Authority: "example.com",
+		URI:       "/foo?param=Value&Pet=dog",
+		Header:    header,
+	}
+}
+
+const testBody = `{"hello": "world"}`
+
+// RFC 9421 Appendix B.1.4
+const testPublicKeyEd25519 = "MCowBQYDK2VwAyEAJrQLj5P/89iXES9+vFgrIy29clF9CC/oPPsw3c5D0bs="
+
+// RFC 9421 Appendix B.2.6
+func TestSignatureBaseEd25519(t *testing.T) {
+	msg := testMessage()
+	sigs, err := httpsig.ParseSignatures(
+		`sig-b26=("date" "@method" "@path" "@authority" "content-type" "content-length");created=1618884473;keyid="test-key-ed25519"`,
+		`sig-b26=:wqcAqbmYJ2ji2glfAMaRy4gruYYnx2nEFN2HN6jrnDnQCK1u02Gb04v9EDgwUPiu4A0w6vuQv5lIp5WPpBKRCw==:`)
+	require.Nil(t, err)
+	require.Len(t, sigs, 1)
+	sig := sigs[0]
+	assert.Equal(t, "sig-b26", sig.Label)
+	assert.Equal(t, "test-key-ed25519", sig.KeyId())
+	created, ok := sig.Created()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1618884473), created)
+
+	base, err := httpsig.SignatureBase(msg, sig.Input)
+	require.Nil(t, err)
+	assert.Equal(t, `"date": Tue, 20 Apr 2021 02:07:55 GMT
+"@method": POST
+"@path": /foo
+"@authority": example.com
+"content-type": application/json
+"content-length": 18
+"@signature-params": ("date" "@method" "@path" "@authority" "content-type" "content-length");created=1618884473;keyid="test-key-ed25519"`, string(base))
+
+	publicKey, err := base64.StdEncoding.DecodeString(testPublicKeyEd25519)
+	require.Nil(t, err)
+	err = algo.GetSignAlgorithm("EdDSA").ValidateSignature(publicKey, sig.Value, base)
+	assert.Nil(t, err)
+}
+
+func TestDerivedComponents(t *testing.T) {
+	msg := testMessage()
+	input := httpsig.NewSignatureInput([]string{"@target-uri", "@scheme", "@request-target", "@query"}, nil)
+	input.Items = append(input.Items, httpsig.Item{Value: "@query-param", Params: httpsig.Params{{Name: "name", Value: "Pet"}}})
+	base, err := httpsig.SignatureBase(msg, input)
+	require.Nil(t, err)
+	assert.Equal(t, `"@target-uri": https://example.com/foo?param=Value&Pet=dog
+"@scheme": https
+"@request-target": /foo?param=Value&Pet=dog
+"@query": ?param=Value&Pet=dog
+"@query-param";name="Pet": dog
+"@signature-params": ("@target-uri" "@scheme" "@request-target" "@query" "@query-param";name="Pet")`, string(base))
+}
+
+func TestMissingComponent(t *testing.T) {
+	_, err := httpsig.SignatureBase(testMessage(), httpsig.NewSignatureInput([]string{"x-missing"}, nil))
+	assert.ErrorIs(t, err, httpsig.ErrMissingComponent)
+}
+
+func TestFormatHeaders(t *testing.T) {
+	input := httpsig.NewSignatureInput([]string{"@method", "@path"}, httpsig.Params{
+		{Name: "created", Value: int64(1618884473)},
+		{Name: "keyid", Value: "1"},
+	})
+	sigInput, sig, err := httpsig.FormatHeaders("sig1", input, []byte{1, 2, 3})
+	require.Nil(t, err)
+	assert.Equal(t, `sig1=("@method" "@path");created=1618884473;keyid="1"`, sigInput)
+	assert.Equal(t, `sig1=:AQID:`, sig)
+
+	sigs, err := httpsig.ParseSignatures(sigInput, sig)
+	require.Nil(t, err)
+	require.Len(t, sigs, 1)
+	assert.Equal(t, input, sigs[0].Input)
+	assert.Equal(t, []byte{1, 2, 3}, sigs[0].Value)
+}
+
+func TestContentDigest(t *testing.T) {
+	msg := testMessage()
+	assert.Nil(t, httpsig.VerifyContentDigest(msg.Header.Get(httpsig.CONTENT_DIGEST_HEADER), []byte(testBody)))
+	assert.ErrorIs(t, httpsig.VerifyContentDigest(msg.Header.Get(httpsig.CONTENT_DIGEST_HEADER), []byte("other")), httpsig.ErrContentDigestMismatch)
+	assert.Equal(t, "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:", httpsig.ContentDigest([]byte(testBody)))
+	assert.Nil(t, httpsig.VerifyContentDigest(httpsig.ContentDigest([]byte(testBody)), []byte(testBody)))
+}
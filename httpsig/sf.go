@@ -0,0 +1,419 @@
+package httpsig
+
+// Minimal RFC 8941 structured fields support, enough for Signature-Input and Signature headers
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidStructuredField = errors.New("invalid structured field")
+
+// Token is a structured field token, serialized without quotes
+type Token string
+
+// Param is a parameter of an item or inner list, value is one of int64, string, Token, bool or []byte
+type Param struct {
+	Name  string
+	Value interface{}
+}
+
+type Params []Param
+
+func (p Params) Get(name string) (interface{}, bool) {
+	for _, param := range p {
+		if param.Name == name {
+			return param.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (p Params) String(name string) (string, bool) {
+	v, ok := p.Get(name)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+func (p Params) Int(name string) (int64, bool) {
+	v, ok := p.Get(name)
+	if !ok {
+		return 0, false
+	}
+	i, ok := v.(int64)
+	return i, ok
+}
+
+// Item is a bare item with parameters
+type Item struct {
+	Value  interface{}
+	Params Params
+}
+
+type InnerList struct {
+	Items  []Item
+	Params Params
+}
+
+// Member is a dictionary member, value is either Item or InnerList
+type Member struct {
+	Name  string
+	Value interface{}
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *parser) skipSP() {
+	for !p.eof() && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) skipOWS() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// ParseDictionary parses structured field dictionary keeping members order
+func ParseDictionary(s string) ([]Member, error) {
+	p := &parser{s: s}
+	var members []Member
+	p.skipSP()
+	for !p.eof() {
+		name, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if p.peek() == '=' {
+			p.pos++
+			value, err = p.parseItemOrInnerList()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			params, err := p.parseParams()
+			if err != nil {
+				return nil, err
+			}
+			value = Item{Value: true, Params: params}
+		}
+		members = append(members, Member{Name: name, Value: value})
+		p.skipOWS()
+		if p.eof() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, ErrInvalidStructuredField
+		}
+		p.pos++
+		p.skipOWS()
+		if p.eof() {
+			return nil, ErrInvalidStructuredField
+		}
+	}
+	return members, nil
+}
+
+func (p *parser) parseItemOrInnerList() (interface{}, error) {
+	if p.peek() == '(' {
+		return p.parseInnerList()
+	}
+	return p.parseItem()
+}
+
+func (p *parser) parseInnerList() (InnerList, error) {
+	var list InnerList
+	p.pos++ // (
+	for !p.eof() {
+		p.skipSP()
+		if p.peek() == ')' {
+			p.pos++
+			params, err := p.parseParams()
+			if err != nil {
+				return list, err
+			}
+			list.Params = params
+			return list, nil
+		}
+		item, err := p.parseItem()
+		if err != nil {
+			return list, err
+		}
+		list.Items = append(list.Items, item)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return list, ErrInvalidStructuredField
+		}
+	}
+	return list, ErrInvalidStructuredField
+}
+
+func (p *parser) parseItem() (Item, error) {
+	value, err := p.parseBareItem()
+	if err != nil {
+		return Item{}, err
+	}
+	params, err := p.parseParams()
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{Value: value, Params: params}, nil
+}
+
+func (p *parser) parseParams() (Params, error) {
+	var params Params
+	for p.peek() == ';' {
+		p.pos++
+		p.skipSP()
+		name, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = true
+		if p.peek() == '=' {
+			p.pos++
+			value, err = p.parseBareItem()
+			if err != nil {
+				return nil, err
+			}
+		}
+		params = append(params, Param{Name: name, Value: value})
+	}
+	return params, nil
+}
+
+func isLcAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isTChar(c byte) bool {
+	return isAlpha(c) || isDigit(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func (p *parser) parseKey() (string, error) {
+	start := p.pos
+	if c := p.peek(); !isLcAlpha(c) && c != '*' {
+		return "", ErrInvalidStructuredField
+	}
+	for !p.eof() {
+		c := p.s[p.pos]
+		if !isLcAlpha(c) && !isDigit(c) && c != '_' && c != '-' && c != '.' && c != '*' {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos], nil
+}
+
+func (p *parser) parseBareItem() (interface{}, error) {
+	c := p.peek()
+	switch {
+	case c == '-' || isDigit(c):
+		return p.parseInteger()
+	case c == '"':
+		return p.parseString()
+	case c == ':':
+		return p.parseByteSequence()
+	case c == '?':
+		return p.parseBoolean()
+	case isAlpha(c) || c == '*':
+		return p.parseToken()
+	default:
+		return nil, ErrInvalidStructuredField
+	}
+}
+
+func (p *parser) parseInteger() (int64, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	for !p.eof() && isDigit(p.s[p.pos]) {
+		p.pos++
+	}
+	// decimals are not used by http signatures
+	if p.peek() == '.' {
+		return 0, ErrInvalidStructuredField
+	}
+	if p.pos-start > 16 {
+		return 0, ErrInvalidStructuredField
+	}
+	i, err := strconv.ParseInt(p.s[start:p.pos], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidStructuredField
+	}
+	return i, nil
+}
+
+func (p *parser) parseString() (string, error) {
+	var sb strings.Builder
+	p.pos++ // "
+	for !p.eof() {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\':
+			if p.eof() {
+				return "", ErrInvalidStructuredField
+			}
+			next := p.s[p.pos]
+			if next != '"' && next != '\\' {
+				return "", ErrInvalidStructuredField
+			}
+			sb.WriteByte(next)
+			p.pos++
+		case c == '"':
+			return sb.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", ErrInvalidStructuredField
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", ErrInvalidStructuredField
+}
+
+func (p *parser) parseToken() (Token, error) {
+	start := p.pos
+	for !p.eof() {
+		c := p.s[p.pos]
+		if !isTChar(c) && c != ':' && c != '/' {
+			break
+		}
+		p.pos++
+	}
+	return Token(p.s[start:p.pos]), nil
+}
+
+func (p *parser) parseByteSequence() ([]byte, error) {
+	p.pos++ // :
+	end := strings.IndexByte(p.s[p.pos:], ':')
+	if end < 0 {
+		return nil, ErrInvalidStructuredField
+	}
+	encoded := p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidStructuredField
+	}
+	return b, nil
+}
+
+func (p *parser) parseBoolean() (bool, error) {
+	p.pos++ // ?
+	switch p.peek() {
+	case '0':
+		p.pos++
+		return false, nil
+	case '1':
+		p.pos++
+		return true, nil
+	default:
+		return false, ErrInvalidStructuredField
+	}
+}
+
+func serializeBareItem(sb *strings.Builder, v interface{}) error {
+	switch value := v.(type) {
+	case int64:
+		sb.WriteString(strconv.FormatInt(value, 10))
+	case string:
+		sb.WriteByte('"')
+		for i := 0; i < len(value); i++ {
+			c := value[i]
+			if c < 0x20 || c > 0x7e {
+				return ErrInvalidStructuredField
+			}
+			if c == '"' || c == '\\' {
+				sb.WriteByte('\\')
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteByte('"')
+	case Token:
+		sb.WriteString(string(value))
+	case bool:
+		if value {
+			sb.WriteString("?1")
+		} else {
+			sb.WriteString("?0")
+		}
+	case []byte:
+		sb.WriteByte(':')
+		sb.WriteString(base64.StdEncoding.EncodeToString(value))
+		sb.WriteByte(':')
+	default:
+		return ErrInvalidStructuredField
+	}
+	return nil
+}
+
+func serializeParams(sb *strings.Builder, params Params) error {
+	for _, param := range params {
+		sb.WriteByte(';')
+		sb.WriteString(param.Name)
+		if b, ok := param.Value.(bool); ok && b {
+			continue
+		}
+		sb.WriteByte('=')
+		if err := serializeBareItem(sb, param.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serializeItem(sb *strings.Builder, item Item) error {
+	if err := serializeBareItem(sb, item.Value); err != nil {
+		return err
+	}
+	return serializeParams(sb, item.Params)
+}
+
+// SerializeInnerList returns canonical serialization of inner list with parameters
+func SerializeInnerList(list InnerList) (string, error) {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for i, item := range list.Items {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		if err := serializeItem(&sb, item); err != nil {
+			return "", err
+		}
+	}
+	sb.WriteByte(')')
+	if err := serializeParams(&sb, list.Params); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}